@@ -25,21 +25,32 @@ func (cr *Celery) GenerateBroker() *CeleryBroker {
 
 // GenerateSchedulers defines the way to create schedulers based on config
 func (cr *Celery) GenerateSchedulers() []*CeleryScheduler {
-	labels := map[string]string{
-		"celery-app": cr.Name,
-		"type":       "scheduler",
-	}
 	defaultImage := cr.Spec.Image
-	brokerAddr := cr.Status.BrokerAddress
 	schedulers := make([]*CeleryScheduler, 0)
-	for i, schedulerSpec := range cr.Spec.Schedulers {
+	for _, pool := range cr.Spec.Schedulers {
+		labels := map[string]string{
+			"celery-app": cr.Name,
+			"type":       "scheduler",
+			"pool":       pool.Name,
+		}
+		schedulerSpec := pool.CelerySchedulerSpec
 		if schedulerSpec.Image == "" {
 			schedulerSpec.Image = defaultImage
 		}
-		schedulerSpec.BrokerAddress = brokerAddr
+		schedulerSpec.PodTemplate = MergePodTemplates(cr.Spec.PodTemplate, schedulerSpec.PodTemplate)
+		if schedulerSpec.CeleryVersion == "" {
+			schedulerSpec.CeleryVersion = cr.Spec.CeleryVersion
+		}
+		// The broker url is delivered through the secret
+		schedulerSpec.BrokerAddress = ""
+		schedulerSpec.BrokerAddressSecretRef = cr.Status.BrokerAddressSecretRef
+		schedulerSpec.BrokerAddressHash = cr.Status.BrokerAddressHash
+		schedulerSpec.BrokerTransportOptions = cr.Status.BrokerTransportOptions
+		schedulerSpec.ResultBackend = cr.getResultBackend()
+		schedulerSpec.Config = MergeConfig(cr.Spec.Config, schedulerSpec.Config)
 		scheduler := &CeleryScheduler{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-scheduler-%d", cr.GetName(), i+1),
+				Name:      fmt.Sprintf("%s-scheduler-%s", cr.GetName(), pool.Name),
 				Namespace: cr.GetNamespace(),
 				Labels:    labels,
 			},
@@ -52,21 +63,32 @@ func (cr *Celery) GenerateSchedulers() []*CeleryScheduler {
 
 // GenerateWorkers defines the way to create workers based on config
 func (cr *Celery) GenerateWorkers() []*CeleryWorker {
-	labels := map[string]string{
-		"celery-app": cr.Name,
-		"type":       "worker",
-	}
 	defaultImage := cr.Spec.Image
-	brokerAddr := cr.Status.BrokerAddress
 	workers := make([]*CeleryWorker, 0)
-	for i, workerSpec := range cr.Spec.Workers {
+	for _, pool := range cr.Spec.Workers {
+		labels := map[string]string{
+			"celery-app": cr.Name,
+			"type":       "worker",
+			"pool":       pool.Name,
+		}
+		workerSpec := pool.CeleryWorkerSpec
 		if workerSpec.Image == "" {
 			workerSpec.Image = defaultImage
 		}
-		workerSpec.BrokerAddress = brokerAddr
+		workerSpec.PodTemplate = MergePodTemplates(cr.Spec.PodTemplate, workerSpec.PodTemplate)
+		if workerSpec.CeleryVersion == "" {
+			workerSpec.CeleryVersion = cr.Spec.CeleryVersion
+		}
+		// The broker url is delivered through the secret
+		workerSpec.BrokerAddress = ""
+		workerSpec.BrokerAddressSecretRef = cr.Status.BrokerAddressSecretRef
+		workerSpec.BrokerAddressHash = cr.Status.BrokerAddressHash
+		workerSpec.BrokerTransportOptions = cr.Status.BrokerTransportOptions
+		workerSpec.ResultBackend = cr.getResultBackend()
+		workerSpec.Config = MergeConfig(cr.Spec.Config, workerSpec.Config)
 		worker := &CeleryWorker{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-worker-%d", cr.GetName(), i+1),
+				Name:      fmt.Sprintf("%s-worker-%s", cr.GetName(), pool.Name),
 				Namespace: cr.GetNamespace(),
 				Labels:    labels,
 			},
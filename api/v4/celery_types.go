@@ -15,6 +15,8 @@ limitations under the License.
 package v4
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -23,19 +25,113 @@ import (
 
 // CelerySpec defines the desired state of Celery
 type CelerySpec struct {
-	Broker     CeleryBrokerSpec      `json:"broker,omitempty"`
-	Workers    []CeleryWorkerSpec    `json:"workers,omitempty"`
-	Schedulers []CelerySchedulerSpec `json:"schedulers,omitempty"`
+	Broker CeleryBrokerSpec `json:"broker,omitempty"`
+	// ResultBackend defines where the task results are stored.
+	// The result backend is not configured by the operator if it is not set
+	ResultBackend *ResultBackendSpec `json:"resultBackend,omitempty"`
+	// Workers defines the worker pools keyed by their names
+	// +listType=map
+	// +listMapKey=name
+	Workers []CeleryWorkerPool `json:"workers,omitempty"`
+	// Schedulers defines the scheduler pools keyed by their names
+	// +listType=map
+	// +listMapKey=name
+	Schedulers []CelerySchedulerPool `json:"schedulers,omitempty"`
 	Image      string                `json:"image,omitempty"`
+	// CeleryVersion defines the default celery version of workers and schedulers, e.g. 4 or 5.2.
+	// It decides the style of the generated command line. Defaults to 4
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)*$`
+	CeleryVersion string `json:"celeryVersion,omitempty"`
+	// PodTemplate defines the default pod template of workers and schedulers.
+	// The pod template of each pool is merged on top of it
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// Config defines the default celery settings of workers and schedulers in lowercase,
+	// e.g. worker_prefetch_multiplier or task_routes. The config of each pool overrides it by keys
+	Config map[string]apiextensionsv1.JSON `json:"config,omitempty"`
+}
+
+// CeleryWorkerPool defines a pool of workers managed by a CeleryWorker
+type CeleryWorkerPool struct {
+	// Name defines the unique name of the pool. The CeleryWorker is named as <celery>-worker-<name>
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name             string `json:"name"`
+	CeleryWorkerSpec `json:",inline"`
+}
+
+// CelerySchedulerPool defines a pool of schedulers managed by a CeleryScheduler
+type CelerySchedulerPool struct {
+	// Name defines the unique name of the pool. The CeleryScheduler is named as <celery>-scheduler-<name>
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name                string `json:"name"`
+	CelerySchedulerSpec `json:",inline"`
 }
 
 // CeleryStatus defines the observed state of Celery
 type CeleryStatus struct {
+	// BrokerAddress is the address of the broker published by the CeleryBroker with the password redacted
 	BrokerAddress string `json:"brokerAddress,omitempty"`
+	// BrokerAddressSecretRef refers to the secret keeping the full broker url
+	BrokerAddressSecretRef *corev1.SecretKeySelector `json:"brokerAddressSecretRef,omitempty"`
+	// BrokerAddressHash defines the hash of the full broker url published by the CeleryBroker
+	BrokerAddressHash string `json:"brokerAddressHash,omitempty"`
+	// BrokerTransportOptions defines the broker_transport_options published by the CeleryBroker
+	BrokerTransportOptions map[string]string `json:"brokerTransportOptions,omitempty"`
+	// BrokerPrimary defines the name of the primary broker pod in high availability mode
+	BrokerPrimary string `json:"brokerPrimary,omitempty"`
+	// BrokerType defines the type of the broker, i.e. redis, rabbitmq or external
+	BrokerType BrokerType `json:"brokerType,omitempty"`
+	// BrokerReady is true when the broker can accept connections
+	BrokerReady bool `json:"brokerReady"`
+	// ResultBackendAddress is the address of the result backend with the password redacted
+	ResultBackendAddress string `json:"resultBackendAddress,omitempty"`
+	// ResultBackend defines the resolved result backend passed to workers and schedulers
+	ResultBackend *ResultBackendReference `json:"resultBackend,omitempty"`
+	// Phase summarizes the health of the broker, schedulers and workers
+	Phase CeleryPhase `json:"phase,omitempty"`
+	// WorkersReady summarizes the ready and desired workers of all pools, e.g. 2/3
+	WorkersReady string `json:"workersReady,omitempty"`
+	// WorkerPools defines the observed state of each worker pool
+	WorkerPools []CeleryPoolStatus `json:"workerPools,omitempty"`
+	// SchedulerPools defines the observed state of each scheduler pool
+	SchedulerPools []CeleryPoolStatus `json:"schedulerPools,omitempty"`
+	// Conditions defines the latest observations of the Celery stack
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// CeleryPhase defines the overall health of a Celery stack
+// +kubebuilder:validation:Enum=Pending;Running;Degraded
+type CeleryPhase string
+
+const (
+	// CeleryPending means the broker or some pods are not ready yet
+	CeleryPending CeleryPhase = "Pending"
+	// CeleryRunning means the broker and all the desired pods are ready
+	CeleryRunning CeleryPhase = "Running"
+	// CeleryDegraded means some pods cannot run, e.g. CrashLoopBackOff or Unschedulable
+	CeleryDegraded CeleryPhase = "Degraded"
+)
+
+// CeleryPoolStatus summarizes the pods of a worker or scheduler pool
+type CeleryPoolStatus struct {
+	// Name defines the name of the pool
+	Name string `json:"name"`
+	// DesiredReplicas defines the number of pods wanted by the pool
+	DesiredReplicas int `json:"desiredReplicas"`
+	// ReadyReplicas defines the number of pods passing the readiness check
+	ReadyReplicas int `json:"readyReplicas"`
+	// UpdatedReplicas defines the number of pods generated from the current spec
+	UpdatedReplicas int `json:"updatedReplicas"`
+	// Reason defines why the pool is degraded, e.g. CrashLoopBackOff
+	Reason string `json:"reason,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Broker",type=string,JSONPath=`.status.brokerType`
+// +kubebuilder:printcolumn:name="Broker Ready",type=boolean,JSONPath=`.status.brokerReady`
+// +kubebuilder:printcolumn:name="Workers",type=string,JSONPath=`.status.workersReady`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Celery is the Schema for the celeries API
 type Celery struct {
@@ -0,0 +1,135 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var celerylog = logf.Log.WithName("celery-resource")
+
+func (r *Celery) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-celery-celeryproject-org-v4-celery,mutating=true,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeries,verbs=create;update,versions=v4,name=mcelery.kb.io
+
+var _ webhook.Defaulter = &Celery{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// The images of the pools are left empty, so they keep following spec.image after it is updated.
+// The replicas are only defaulted on creation, so the pools can still be scaled to zero.
+func (r *Celery) Default() {
+	celerylog.Info("default", "name", r.Name)
+
+	if r.Spec.Broker.Type == "" {
+		r.Spec.Broker.Type = RedisBroker
+	}
+	if r.Spec.ResultBackend != nil && r.Spec.ResultBackend.Type == "" {
+		r.Spec.ResultBackend.Type = BrokerResultBackend
+	}
+	if r.ResourceVersion != "" {
+		return
+	}
+	for i := range r.Spec.Workers {
+		if r.Spec.Workers[i].Replicas == 0 {
+			r.Spec.Workers[i].Replicas = 1
+		}
+	}
+	for i := range r.Spec.Schedulers {
+		if r.Spec.Schedulers[i].Replicas == 0 {
+			r.Spec.Schedulers[i].Replicas = 1
+		}
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-celery-celeryproject-org-v4-celery,mutating=false,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeries,versions=v4,name=vcelery.kb.io
+
+var _ webhook.Validator = &Celery{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Celery) ValidateCreate() error {
+	celerylog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *Celery) ValidateUpdate(old runtime.Object) error {
+	celerylog.Info("validate update", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *Celery) ValidateDelete() error {
+	return nil
+}
+
+func (r *Celery) validate() error {
+	specPath := field.NewPath("spec")
+	allErrs := validateBrokerSpec(&r.Spec.Broker, specPath.Child("broker"))
+	allErrs = append(allErrs, validateConfig(r.Spec.Config, specPath.Child("config"))...)
+	if r.Spec.ResultBackend != nil {
+		allErrs = append(allErrs, validateResultBackendSpec(r.Spec.ResultBackend, &r.Spec.Broker, len(r.Spec.Schedulers) > 0, specPath.Child("resultBackend"))...)
+	}
+
+	// Each queue should be consumed by one pool only, otherwise the pools compete for the same tasks
+	queuePools := make(map[string]string)
+	for i := range r.Spec.Workers {
+		pool := &r.Spec.Workers[i]
+		poolPath := specPath.Child("workers").Index(i)
+		allErrs = append(allErrs, validateWorkerSpec(&pool.CeleryWorkerSpec, poolPath)...)
+		if r.Spec.Image == "" && pool.Image == "" {
+			allErrs = append(allErrs, field.Required(poolPath.Child("image"), "either spec.image or the image of pool is required"))
+		}
+		if len(pool.TargetQueues) == 0 {
+			// The pools without target queues consume the default queue
+			queue := getDefaultQueue(MergeConfig(r.Spec.Config, pool.Config))
+			if owner, ok := queuePools[queue]; ok && owner != pool.Name {
+				allErrs = append(allErrs, field.Invalid(poolPath.Child("targetQueues"), pool.TargetQueues, "default queue "+queue+" is already consumed by pool "+owner))
+			}
+			queuePools[queue] = pool.Name
+		}
+		for j, queue := range pool.TargetQueues {
+			if owner, ok := queuePools[queue]; ok && owner != pool.Name {
+				allErrs = append(allErrs, field.Invalid(poolPath.Child("targetQueues").Index(j), queue, "queue is already consumed by pool "+owner))
+			}
+			queuePools[queue] = pool.Name
+		}
+	}
+	for i := range r.Spec.Schedulers {
+		pool := &r.Spec.Schedulers[i]
+		poolPath := specPath.Child("schedulers").Index(i)
+		allErrs = append(allErrs, validateSchedulerSpec(&pool.CelerySchedulerSpec, poolPath)...)
+		if r.Spec.Image == "" && pool.Image == "" {
+			allErrs = append(allErrs, field.Required(poolPath.Child("image"), "either spec.image or the image of pool is required"))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Celery").GroupKind(), r.Name, allErrs)
+}
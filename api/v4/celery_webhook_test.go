@@ -0,0 +1,122 @@
+package v4
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newValidCelery() *Celery {
+	return &Celery{
+		ObjectMeta: metav1.ObjectMeta{Name: "celery", Namespace: "default"},
+		Spec: CelerySpec{
+			Image: "celery:4",
+			Workers: []CeleryWorkerPool{
+				{Name: "1", CeleryWorkerSpec: CeleryWorkerSpec{AppName: "app", TargetQueues: []string{"a"}}},
+				{Name: "2", CeleryWorkerSpec: CeleryWorkerSpec{AppName: "app", TargetQueues: []string{"b"}}},
+			},
+			Schedulers: []CelerySchedulerPool{
+				{Name: "1", CelerySchedulerSpec: CelerySchedulerSpec{AppName: "app"}},
+			},
+		},
+	}
+}
+
+func TestCeleryDefault(t *testing.T) {
+	celery := newValidCelery()
+	celery.Default()
+	if celery.Spec.Broker.Type != RedisBroker {
+		t.Errorf("expected broker type redis, got %q", celery.Spec.Broker.Type)
+	}
+	if celery.Spec.Workers[0].Replicas != 1 || celery.Spec.Schedulers[0].Replicas != 1 {
+		t.Errorf("expected the replicas of pools to be defaulted to 1")
+	}
+	if celery.Spec.Workers[0].Image != "" {
+		t.Errorf("expected the image of pool to follow spec.image")
+	}
+
+	// The pools scaled to zero should be kept after creation
+	celery.ResourceVersion = "1"
+	celery.Spec.Workers[0].Replicas = 0
+	celery.Default()
+	if celery.Spec.Workers[0].Replicas != 0 {
+		t.Errorf("expected the replicas to be kept after creation")
+	}
+}
+
+func TestCeleryValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Celery)
+		field  string
+	}{
+		{"valid", func(_ *Celery) {}, ""},
+		{"negative replicas", func(c *Celery) { c.Spec.Workers[0].Replicas = -1 }, "spec.workers[0].replicas"},
+		{"external broker without address", func(c *Celery) { c.Spec.Broker.Type = ExternalBroker }, "spec.broker.brokerAddress"},
+		{"malformed broker url", func(c *Celery) {
+			c.Spec.Broker.Type = ExternalBroker
+			c.Spec.Broker.BrokerAddress = "redis//broker:6379"
+		}, "spec.broker.brokerAddress"},
+		{"sentinel broker url", func(c *Celery) {
+			c.Spec.Broker.Type = ExternalBroker
+			c.Spec.Broker.BrokerAddress = "sentinel://:pw@s-0:26379;sentinel://:pw@s-1:26379"
+		}, ""},
+		{"duplicate queues across pools", func(c *Celery) { c.Spec.Workers[1].TargetQueues = []string{"a"} }, "spec.workers[1].targetQueues[0]"},
+		{"default queue across pools", func(c *Celery) {
+			c.Spec.Workers[0].TargetQueues = nil
+			c.Spec.Workers[1].TargetQueues = nil
+		}, "spec.workers[1].targetQueues"},
+		{"default queue consumed explicitly", func(c *Celery) {
+			c.Spec.Workers[0].TargetQueues = nil
+			c.Spec.Workers[1].TargetQueues = []string{"celery"}
+		}, "spec.workers[1].targetQueues[0]"},
+		{"different default queues", func(c *Celery) {
+			c.Spec.Workers[0].TargetQueues = nil
+			c.Spec.Workers[1].TargetQueues = nil
+			c.Spec.Workers[1].Config = map[string]apiextensionsv1.JSON{"task_default_queue": {Raw: []byte(`"low"`)}}
+		}, ""},
+		{"standby schedulers", func(c *Celery) { c.Spec.Schedulers[0].Replicas = 2 }, ""},
+		{"negative schedulers", func(c *Celery) { c.Spec.Schedulers[0].Replicas = -1 }, "spec.schedulers[0].replicas"},
+		{"standbys on the node of the schedule", func(c *Celery) {
+			c.Spec.Schedulers[0].Replicas = 2
+			c.Spec.Schedulers[0].Persistence = &SchedulePersistence{}
+		}, ""},
+		{"standbys with shared schedule", func(c *Celery) {
+			c.Spec.Schedulers[0].Replicas = 2
+			c.Spec.Schedulers[0].Persistence = &SchedulePersistence{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			}
+		}, ""},
+		{"empty app name", func(c *Celery) { c.Spec.Workers[0].AppName = "" }, "spec.workers[0].appName"},
+		{"missing image", func(c *Celery) { c.Spec.Image = "" }, "spec.workers[0].image"},
+	}
+	for _, test := range tests {
+		celery := newValidCelery()
+		celery.Default()
+		test.mutate(celery)
+		err := celery.ValidateCreate()
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.field) {
+			t.Errorf("%s: expected an error on %s, got %v", test.name, test.field, err)
+		}
+	}
+}
+
+func TestCeleryWorkerDefault(t *testing.T) {
+	worker := &CeleryWorker{Spec: CeleryWorkerSpec{AppName: "app", Image: "celery:4"}}
+	worker.Default()
+	if worker.Spec.Replicas != 1 {
+		t.Errorf("expected the replicas to be defaulted to 1, got %d", worker.Spec.Replicas)
+	}
+	if err := worker.ValidateCreate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
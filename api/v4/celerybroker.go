@@ -1,19 +1,47 @@
 package v4
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/url"
+	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	// BrokerUsernameKey is the key of username in the broker credentials secret
+	BrokerUsernameKey = "username"
+	// BrokerPasswordKey is the key of password in the broker credentials secret
+	BrokerPasswordKey = "password"
+	// BrokerURLKey is the key of the broker url in the secret consumed by workers and schedulers
+	BrokerURLKey = "url"
+	// BrokerAddressHashAnnotation keeps the hash of the broker url used by the pod
+	BrokerAddressHashAnnotation = "celery.celeryproject.org/broker-address-hash"
 )
 
 func (cbr *CeleryBroker) Equal(target *CeleryBroker) bool {
-	return cbr.Spec.Type == target.Spec.Type
+	return equality.Semantic.DeepEqual(cbr.Spec, target.Spec)
 }
 
-// Generate will create the pod spec of the broker.
-func (cbr *CeleryBroker) Generate() (*corev1.Pod, *corev1.Service, string) {
+// GetType returns the type of the broker. Defaults to redis
+func (cbr *CeleryBroker) GetType() BrokerType {
+	if cbr.Spec.Type == "" {
+		return RedisBroker
+	}
+	return cbr.Spec.Type
+}
+
+// GenerateRedis will create the statefulset and service of the redis broker.
+// The password is read from the given secret generated by GenerateCredentials.
+func (cbr *CeleryBroker) GenerateRedis(credentials *corev1.Secret) (*appsv1.StatefulSet, *corev1.Service, string) {
 	labels := map[string]string{
 		"celery-app": cbr.Name,
 		"type":       "broker",
@@ -37,26 +65,615 @@ func (cbr *CeleryBroker) Generate() (*corev1.Pod, *corev1.Service, string) {
 			},
 		},
 	}
-	pod := &corev1.Pod{
+	replicas := int32(1)
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cbr.GetName() + "-broker-redis",
+			Namespace: cbr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: service.Name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "redis",
+							Image:   cbr.getRedisImage(),
+							Command: cbr.getRedisCommand(),
+							Env:     []corev1.EnvVar{generateCredentialEnv("REDIS_PASSWORD", credentials, BrokerPasswordKey)},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "redis",
+									ContainerPort: 6379,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "data",
+									MountPath: "/data",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	cbr.addRedisDataVolume(statefulSet)
+	cbr.applyPodTemplate(statefulSet)
+	addr := fmt.Sprintf("redis://:%s@%s.%s",
+		url.QueryEscape(string(credentials.Data[BrokerPasswordKey])),
+		service.Name,
+		cbr.Namespace,
+	)
+	return statefulSet, service, addr
+}
+
+// IsHighAvailability checks whether the redis broker runs with sentinels
+func (cbr *CeleryBroker) IsHighAvailability() bool {
+	return cbr.Spec.Type != ExternalBroker && cbr.Spec.Type != RabbitMQBroker &&
+		cbr.Spec.Redis != nil && cbr.Spec.Redis.HighAvailability != nil
+}
+
+// GetSentinelMasterName returns the name of the primary monitored by sentinels
+func (cbr *CeleryBroker) GetSentinelMasterName() string {
+	if cbr.IsHighAvailability() && cbr.Spec.Redis.HighAvailability.MasterName != "" {
+		return cbr.Spec.Redis.HighAvailability.MasterName
+	}
+	return "mymaster"
+}
+
+// GetTransportOptions returns the broker_transport_options celery needs for the managed broker
+func (cbr *CeleryBroker) GetTransportOptions() map[string]string {
+	if !cbr.IsHighAvailability() {
+		return nil
+	}
+	return map[string]string{
+		"master_name": cbr.GetSentinelMasterName(),
+	}
+}
+
+// GenerateRedisHighAvailability will create the statefulsets of redis and sentinel
+// with their headless services. The redis nodes ask the sentinels for the current
+// primary on start and the first node becomes the primary if no sentinel knows it.
+// The password is read from the given secret generated by GenerateCredentials.
+func (cbr *CeleryBroker) GenerateRedisHighAvailability(credentials *corev1.Secret) (*appsv1.StatefulSet, *appsv1.StatefulSet, []*corev1.Service, string) {
+	redisLabels := map[string]string{
+		"celery-app": cbr.Name,
+		"type":       "broker",
+	}
+	sentinelLabels := map[string]string{
+		"celery-app": cbr.Name,
+		"type":       "broker-sentinel",
+	}
+
+	replicas, sentinels := int32(3), int32(3)
+	var quorum *int32
+	if cbr.IsHighAvailability() {
+		ha := cbr.Spec.Redis.HighAvailability
+		if ha.Replicas != nil {
+			replicas = *ha.Replicas
+		}
+		if ha.Sentinels != nil {
+			sentinels = *ha.Sentinels
+		}
+		quorum = ha.Quorum
+	}
+	if quorum == nil {
+		majority := sentinels/2 + 1
+		quorum = &majority
+	}
+
+	redisName := cbr.GetName() + "-broker-redis"
+	sentinelName := cbr.GetName() + "-broker-sentinel"
+	redisService := generateHeadlessService(redisName+"-headless", cbr.GetNamespace(), redisLabels, "redis", 6379)
+	sentinelService := generateHeadlessService(sentinelName, cbr.GetNamespace(), sentinelLabels, "sentinel", 26379)
+
+	initialPrimary := fmt.Sprintf("%s-0.%s.%s", redisName, redisService.Name, cbr.Namespace)
+	sentinelHost := fmt.Sprintf("%s.%s", sentinelService.Name, cbr.Namespace)
+	masterName := cbr.GetSentinelMasterName()
+
+	redisScript := fmt.Sprintf(`PRIMARY=$(redis-cli -h %[1]s -p 26379 sentinel get-master-addr-by-name %[2]s 2>/dev/null | head -n 1)
+if [ -z "$PRIMARY" ]; then
+  if [ "${HOSTNAME##*-}" = "0" ]; then exec %[3]s; fi
+  PRIMARY=%[4]s
+fi
+if [ "$PRIMARY" = "$POD_IP" ]; then exec %[3]s; fi
+exec %[3]s --replicaof "$PRIMARY" 6379
+`, sentinelHost, shellQuote(masterName), shellJoin(append(cbr.getRedisCommand(), "--masterauth", "$(REDIS_PASSWORD)")), initialPrimary)
+	sentinelScript := fmt.Sprintf(`PRIMARY=$(redis-cli -h %[1]s -p 26379 sentinel get-master-addr-by-name %[2]s 2>/dev/null | head -n 1)
+if [ -z "$PRIMARY" ]; then PRIMARY=%[3]s; fi
+cat > /tmp/sentinel.conf <<EOF
+port 26379
+sentinel resolve-hostnames yes
+sentinel monitor %[2]s $PRIMARY 6379 %[4]d
+sentinel down-after-milliseconds %[2]s 5000
+sentinel failover-timeout %[2]s 60000
+sentinel parallel-syncs %[2]s 1
+sentinel auth-pass %[2]s $(REDIS_PASSWORD)
+EOF
+exec redis-sentinel /tmp/sentinel.conf
+`, sentinelHost, masterName, initialPrimary, *quorum)
+
+	redis := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      redisName,
+			Namespace: cbr.GetNamespace(),
+			Labels:    redisLabels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: redisService.Name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: redisLabels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: redisLabels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "redis",
+							Image:   cbr.getRedisImage(),
+							Command: []string{"sh", "-c", redisScript},
+							Env: []corev1.EnvVar{
+								generateCredentialEnv("REDIS_PASSWORD", credentials, BrokerPasswordKey),
+								{
+									Name: "POD_IP",
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
+									},
+								},
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "redis",
+									ContainerPort: 6379,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "data",
+									MountPath: "/data",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	cbr.addRedisDataVolume(redis)
+	cbr.applyPodTemplate(redis)
+
+	sentinel := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sentinelName,
+			Namespace: cbr.GetNamespace(),
+			Labels:    sentinelLabels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &sentinels,
+			ServiceName: sentinelService.Name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: sentinelLabels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: sentinelLabels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "sentinel",
+							Image:   cbr.getRedisImage(),
+							Command: []string{"sh", "-c", sentinelScript},
+							Env:     []corev1.EnvVar{generateCredentialEnv("REDIS_PASSWORD", credentials, BrokerPasswordKey)},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "sentinel",
+									ContainerPort: 26379,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	cbr.applyPodTemplate(sentinel)
+
+	password := url.QueryEscape(string(credentials.Data[BrokerPasswordKey]))
+	addresses := make([]string, 0, sentinels)
+	for i := int32(0); i < sentinels; i++ {
+		addresses = append(addresses, fmt.Sprintf("sentinel://:%s@%s-%d.%s.%s:26379", password, sentinelName, i, sentinelService.Name, cbr.Namespace))
+	}
+	return redis, sentinel, []*corev1.Service{redisService, sentinelService}, strings.Join(addresses, ";")
+}
+
+// applyPodTemplate merges the generated pod into the pod template of the broker
+func (cbr *CeleryBroker) applyPodTemplate(statefulSet *appsv1.StatefulSet) {
+	if cbr.Spec.PodTemplate == nil {
+		return
+	}
+	statefulSet.Spec.Template = *applyPodTemplate(cbr.Spec.PodTemplate, &statefulSet.Spec.Template)
+}
+
+func generateHeadlessService(name, namespace string, labels map[string]string, portName string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      "ClusterIP",
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  labels,
+			// The nodes need to find each other before they are ready
+			PublishNotReadyAddresses: true,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       portName,
+					Port:       port,
+					TargetPort: intstr.FromInt(int(port)),
+				},
+			},
+		},
+	}
+}
+
+func (cbr *CeleryBroker) getRedisImage() string {
+	if cbr.Spec.Redis != nil && cbr.Spec.Redis.Image != "" {
+		return cbr.Spec.Redis.Image
+	}
+	if cbr.IsHighAvailability() {
+		return "redis:6.2"
+	}
+	return "redis:3.0.5"
+}
+
+// addRedisDataVolume mounts either the persistent volume or an empty dir as the redis data
+func (cbr *CeleryBroker) addRedisDataVolume(statefulSet *appsv1.StatefulSet) {
+	if cbr.Spec.Redis != nil && cbr.Spec.Redis.Persistence != nil {
+		statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
+			generateVolumeClaimTemplate("data", cbr.Spec.Redis.Persistence),
+		}
+		return
+	}
+	statefulSet.Spec.Template.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func shellJoin(command []string) string {
+	quoted := make([]string, 0, len(command))
+	for _, arg := range command {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (cbr *CeleryBroker) getRedisCommand() []string {
+	// The password is expanded from the environment by kubelet
+	command := []string{"redis-server", "--dir", "/data", "--requirepass", "$(REDIS_PASSWORD)"}
+	if cbr.Spec.Redis == nil {
+		return command
+	}
+	if cbr.Spec.Redis.AppendOnly {
+		appendFsync := cbr.Spec.Redis.AppendFsync
+		if appendFsync == "" {
+			appendFsync = "everysec"
+		}
+		command = append(command, "--appendonly", "yes", "--appendfsync", appendFsync)
+	}
+	if cbr.Spec.Redis.Save != nil {
+		if len(cbr.Spec.Redis.Save) == 0 {
+			command = append(command, "--save", "")
+		}
+		for _, rule := range cbr.Spec.Redis.Save {
+			command = append(command, "--save", rule)
+		}
+	}
+	return command
+}
+
+func generateVolumeClaimTemplate(name string, persistence *BrokerPersistence) corev1.PersistentVolumeClaim {
+	size := resource.MustParse("1Gi")
+	if persistence.Size != nil {
+		size = *persistence.Size
+	}
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: persistence.StorageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+}
+
+// GenerateCredentials will create the secret keeping the credentials of the managed broker.
+// The password is randomly generated, so the secret should only be created once.
+func (cbr *CeleryBroker) GenerateCredentials() *corev1.Secret {
+	labels := map[string]string{
+		"celery-app": cbr.Name,
+		"type":       "broker",
+	}
+
+	username := "celery"
+	if cbr.Spec.RabbitMQ != nil && cbr.Spec.RabbitMQ.Username != "" {
+		username = cbr.Spec.RabbitMQ.Username
+	}
+	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cbr.GetName() + "-broker",
+			Name:      cbr.GetName() + "-broker-credentials",
 			Namespace: cbr.GetNamespace(),
 			Labels:    labels,
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			BrokerUsernameKey: username,
+			BrokerPasswordKey: rand.String(32),
+		},
+	}
+}
+
+// GenerateURLSecret will create the secret keeping the broker url for workers and schedulers
+func (cbr *CeleryBroker) GenerateURLSecret(addr string) *corev1.Secret {
+	labels := map[string]string{
+		"celery-app": cbr.Name,
+		"type":       "broker",
+	}
+	return newBrokerURLSecret(cbr.GetName()+"-broker-url", cbr.GetNamespace(), labels, addr)
+}
+
+// newBrokerURLSecret creates the secret keeping the broker url, which is consumed by the pods through BrokerURLKey
+func newBrokerURLSecret(name string, namespace string, labels map[string]string, addr string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			BrokerURLKey: []byte(addr),
+		},
+	}
+}
+
+// ResolveExternalAddress reads the address of external broker from the secret.
+// The credentials are inserted into every address if the address is split into keys.
+func (cbr *CeleryBroker) ResolveExternalAddress(secret *corev1.Secret) (string, error) {
+	ref := cbr.Spec.BrokerAddressSecretRef
+	getValue := func(key string) (string, error) {
+		value, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %q is not found in secret %s", key, secret.Name)
+		}
+		return string(value), nil
+	}
+	if ref.Key != "" {
+		return getValue(ref.Key)
+	}
+	if ref.HostKey == "" {
+		return "", fmt.Errorf("either key or hostKey should be set in brokerAddressSecretRef")
+	}
+	host, err := getValue(ref.HostKey)
+	if err != nil {
+		return "", err
+	}
+	var username, password string
+	if ref.UserKey != "" {
+		if username, err = getValue(ref.UserKey); err != nil {
+			return "", err
+		}
+	}
+	if ref.PasswordKey != "" {
+		if password, err = getValue(ref.PasswordKey); err != nil {
+			return "", err
+		}
+	}
+	parts := strings.Split(host, ";")
+	for i, part := range parts {
+		brokerURL, err := url.Parse(part)
+		if err != nil {
+			return "", fmt.Errorf("invalid broker address in key %q: %v", ref.HostKey, err)
+		}
+		if ref.PasswordKey != "" {
+			brokerURL.User = url.UserPassword(username, password)
+		} else if ref.UserKey != "" {
+			brokerURL.User = url.User(username)
+		}
+		parts[i] = brokerURL.String()
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// HashBrokerAddress returns a short hash of the broker url to detect the rotation of credentials
+func HashBrokerAddress(addr string) string {
+	hash := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// RedactBrokerAddress removes the passwords from the broker address, so it can be shown in status
+func RedactBrokerAddress(addr string) string {
+	parts := strings.Split(addr, ";")
+	for i, part := range parts {
+		brokerURL, err := url.Parse(part)
+		if err != nil {
+			parts[i] = ""
+			continue
+		}
+		if _, ok := brokerURL.User.Password(); ok {
+			brokerURL.User = url.UserPassword(brokerURL.User.Username(), "xxxxx")
+		}
+		parts[i] = brokerURL.String()
+	}
+	return strings.Join(parts, ";")
+}
+
+func generateCredentialEnv(name string, credentials *corev1.Secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: credentials.Name},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// GenerateRabbitMQ will create the statefulset and services of the rabbitmq broker.
+// The credentials are read from the given secret generated by GenerateCredentials.
+func (cbr *CeleryBroker) GenerateRabbitMQ(credentials *corev1.Secret) (*appsv1.StatefulSet, []*corev1.Service, string) {
+	labels := map[string]string{
+		"celery-app": cbr.Name,
+		"type":       "broker",
+	}
+
+	image := "rabbitmq:3.8-management"
+	virtualHost := "/"
+	if cbr.Spec.RabbitMQ != nil {
+		if cbr.Spec.RabbitMQ.Image != "" {
+			image = cbr.Spec.RabbitMQ.Image
+		}
+		if cbr.Spec.RabbitMQ.VirtualHost != "" {
+			virtualHost = cbr.Spec.RabbitMQ.VirtualHost
+		}
+	}
+
+	amqpService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cbr.GetName() + "-broker-amqp",
+			Namespace: cbr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     "ClusterIP",
+			Selector: labels,
+			Ports: []corev1.ServicePort{
 				{
-					Name:  "redis",
-					Image: "redis:3.0.5",
-					Ports: []corev1.ContainerPort{
+					Name:       "amqp",
+					Port:       5672,
+					TargetPort: intstr.FromInt(5672),
+				},
+			},
+		},
+	}
+	managementService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cbr.GetName() + "-broker-management",
+			Namespace: cbr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     "ClusterIP",
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "management",
+					Port:       15672,
+					TargetPort: intstr.FromInt(15672),
+				},
+			},
+		},
+	}
+
+	replicas := int32(1)
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cbr.GetName() + "-broker-rabbitmq",
+			Namespace: cbr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: amqpService.Name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
 						{
-							Name:          "redis",
-							ContainerPort: 6379,
+							Name:  "rabbitmq",
+							Image: image,
+							Env: []corev1.EnvVar{
+								generateCredentialEnv("RABBITMQ_DEFAULT_USER", credentials, BrokerUsernameKey),
+								generateCredentialEnv("RABBITMQ_DEFAULT_PASS", credentials, BrokerPasswordKey),
+								{
+									Name:  "RABBITMQ_DEFAULT_VHOST",
+									Value: virtualHost,
+								},
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "amqp",
+									ContainerPort: 5672,
+								},
+								{
+									Name:          "management",
+									ContainerPort: 15672,
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"rabbitmq-diagnostics", "-q", "check_port_connectivity"},
+									},
+								},
+								InitialDelaySeconds: 10,
+								PeriodSeconds:       10,
+								TimeoutSeconds:      10,
+								SuccessThreshold:    1,
+								FailureThreshold:    3,
+							},
 						},
 					},
 				},
 			},
 		},
 	}
-	return pod, service, fmt.Sprintf("redis://%s.%s", cbr.Name+"-broker-service", cbr.Namespace)
+
+	cbr.applyPodTemplate(statefulSet)
+
+	addr := fmt.Sprintf("amqp://%s:%s@%s.%s:5672/%s",
+		url.QueryEscape(string(credentials.Data[BrokerUsernameKey])),
+		url.QueryEscape(string(credentials.Data[BrokerPasswordKey])),
+		amqpService.Name,
+		cbr.Namespace,
+		url.PathEscape(virtualHost),
+	)
+	return statefulSet, []*corev1.Service{amqpService, managementService}, addr
 }
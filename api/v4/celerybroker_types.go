@@ -17,6 +17,8 @@ limitations under the License.
 package v4
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -33,6 +35,89 @@ type CeleryBrokerSpec struct {
 	// BrokerAddress defines the broker address for external broker type
 	// If it is not `external` type, this item will be ignored
 	BrokerAddress string `json:"brokerAddress,omitempty"`
+	// BrokerAddressSecretRef defines the secret keeping the address of external broker.
+	// It takes precedence over BrokerAddress
+	BrokerAddressSecretRef *BrokerAddressSecretReference `json:"brokerAddressSecretRef,omitempty"`
+	// PodTemplate defines the pod template of the managed broker, e.g. tolerations and affinity.
+	// It is merged with the pods generated by the operator. The containers are named redis, sentinel and rabbitmq
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// Redis defines the settings of the redis broker
+	// If it is not `redis` type, this item will be ignored
+	Redis *RedisBrokerSpec `json:"redis,omitempty"`
+	// RabbitMQ defines the settings of the rabbitmq broker
+	// If it is not `rabbitmq` type, this item will be ignored
+	RabbitMQ *RabbitMQBrokerSpec `json:"rabbitmq,omitempty"`
+}
+
+// BrokerAddressSecretReference defines the keys of the broker address in a secret.
+// Either the full url in Key or the split address in HostKey, UserKey and PasswordKey should be given
+type BrokerAddressSecretReference struct {
+	// Name defines the name of the secret in the same namespace
+	Name string `json:"name"`
+	// Key defines the key of the full broker url
+	Key string `json:"key,omitempty"`
+	// HostKey defines the key of the broker url without credentials, e.g. redis://redis:6379/0
+	HostKey string `json:"hostKey,omitempty"`
+	// UserKey defines the key of the username inserted into the url of HostKey
+	UserKey string `json:"userKey,omitempty"`
+	// PasswordKey defines the key of the password inserted into the url of HostKey
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// RedisBrokerSpec defines the settings of the redis created by the operator
+type RedisBrokerSpec struct {
+	// Image defines the redis image. Defaults to redis:3.0.5
+	Image string `json:"image,omitempty"`
+	// Persistence defines the volume keeping the redis data.
+	// The queued messages will be lost after restart if it is not set
+	Persistence *BrokerPersistence `json:"persistence,omitempty"`
+	// AppendOnly enables the AOF persistence
+	AppendOnly bool `json:"appendOnly,omitempty"`
+	// AppendFsync defines the fsync policy of AOF. Defaults to everysec
+	// +kubebuilder:validation:Enum=always;everysec;no
+	AppendFsync string `json:"appendFsync,omitempty"`
+	// Save defines the RDB snapshot rules in the format of "<seconds> <changes>", e.g. "900 1".
+	// The default rules of redis are used if it is not set and RDB is disabled if it is empty
+	Save []string `json:"save,omitempty"`
+	// HighAvailability deploys a primary with replicas and sentinels for automatic failover.
+	// The image defaults to redis:6.2 as the sentinels need to resolve the hostnames
+	HighAvailability *RedisHighAvailability `json:"highAvailability,omitempty"`
+}
+
+// RedisHighAvailability defines the topology of redis with sentinel failover
+type RedisHighAvailability struct {
+	// Replicas defines the number of redis nodes including the primary. Defaults to 3
+	// +kubebuilder:validation:Minimum=2
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Sentinels defines the number of sentinels. Defaults to 3
+	// +kubebuilder:validation:Minimum=1
+	Sentinels *int32 `json:"sentinels,omitempty"`
+	// Quorum defines the number of sentinels agreeing on the primary failure.
+	// Defaults to the majority of sentinels
+	// +kubebuilder:validation:Minimum=1
+	Quorum *int32 `json:"quorum,omitempty"`
+	// MasterName defines the name of the primary monitored by sentinels. Defaults to mymaster
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9._-]+$`
+	MasterName string `json:"masterName,omitempty"`
+}
+
+// BrokerPersistence defines the persistent volume of the broker data
+type BrokerPersistence struct {
+	// StorageClassName defines the storage class of the volume.
+	// The default storage class will be used if it is not set
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Size defines the size of the volume. Defaults to 1Gi
+	Size *resource.Quantity `json:"size,omitempty"`
+}
+
+// RabbitMQBrokerSpec defines the settings of the rabbitmq created by the operator
+type RabbitMQBrokerSpec struct {
+	// Image defines the rabbitmq image with management plugin. Defaults to rabbitmq:3.8-management
+	Image string `json:"image,omitempty"`
+	// Username defines the user celery connects with. Defaults to celery
+	Username string `json:"username,omitempty"`
+	// VirtualHost defines the virtual host celery connects to. Defaults to /
+	VirtualHost string `json:"virtualHost,omitempty"`
 }
 
 // BrokerType defines the type of broker
@@ -41,13 +126,26 @@ type BrokerType string
 const (
 	// RedisBroker is to use a dynamic redis instead within cluster
 	RedisBroker BrokerType = "redis"
+	// RabbitMQBroker is to use a dynamic rabbitmq within cluster
+	RabbitMQBroker BrokerType = "rabbitmq"
 	// ExternalBroker is to use an external broker with given string
 	ExternalBroker BrokerType = "external"
 )
 
 // CeleryBrokerStatus defines the observed state of CeleryBroker
 type CeleryBrokerStatus struct {
+	// BrokerAddress defines the broker address with the password redacted
 	BrokerAddress string `json:"brokerAddress,omitempty"`
+	// BrokerAddressSecretRef refers to the secret keeping the full broker url
+	BrokerAddressSecretRef *corev1.SecretKeySelector `json:"brokerAddressSecretRef,omitempty"`
+	// BrokerAddressHash defines the hash of the full broker url to roll out the rotated credentials
+	BrokerAddressHash string `json:"brokerAddressHash,omitempty"`
+	// Ready defines whether the broker is able to accept connections
+	Ready bool `json:"ready,omitempty"`
+	// TransportOptions defines the broker_transport_options celery needs to connect to the broker
+	TransportOptions map[string]string `json:"transportOptions,omitempty"`
+	// Primary defines the name of the primary redis pod in high availability mode
+	Primary string `json:"primary,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,77 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var celerybrokerlog = logf.Log.WithName("celerybroker-resource")
+
+func (r *CeleryBroker) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-celery-celeryproject-org-v4-celerybroker,mutating=true,failurePolicy=fail,groups=celery.celeryproject.org,resources=celerybrokers,verbs=create;update,versions=v4,name=mcelerybroker.kb.io
+
+var _ webhook.Defaulter = &CeleryBroker{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *CeleryBroker) Default() {
+	celerybrokerlog.Info("default", "name", r.Name)
+
+	r.Spec.Type = r.GetType()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-celery-celeryproject-org-v4-celerybroker,mutating=false,failurePolicy=fail,groups=celery.celeryproject.org,resources=celerybrokers,versions=v4,name=vcelerybroker.kb.io
+
+var _ webhook.Validator = &CeleryBroker{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryBroker) ValidateCreate() error {
+	celerybrokerlog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryBroker) ValidateUpdate(old runtime.Object) error {
+	celerybrokerlog.Info("validate update", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryBroker) ValidateDelete() error {
+	return nil
+}
+
+func (r *CeleryBroker) validate() error {
+	allErrs := validateBrokerSpec(&r.Spec, field.NewPath("spec"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("CeleryBroker").GroupKind(), r.Name, allErrs)
+}
@@ -0,0 +1,121 @@
+package v4
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// SchedulerTarget refers to a CeleryScheduler
+	SchedulerTarget = "CeleryScheduler"
+	// CeleryTarget refers to a scheduler pool of Celery
+	CeleryTarget = "Celery"
+)
+
+// ResolveSchedulerName returns the name of the CeleryScheduler running the task.
+// The celery is required if the target is Celery, and the first scheduler pool is used if the pool is not set.
+func (cpt *CeleryPeriodicTask) ResolveSchedulerName(celery *Celery) (string, error) {
+	target := cpt.Spec.Target
+	if target.Kind != CeleryTarget {
+		return target.Name, nil
+	}
+	if celery == nil {
+		return "", fmt.Errorf("celery %s is not found", target.Name)
+	}
+	pool := target.Pool
+	if pool == "" {
+		if len(celery.Spec.Schedulers) == 0 {
+			return "", fmt.Errorf("celery %s has no scheduler pool", target.Name)
+		}
+		pool = celery.Spec.Schedulers[0].Name
+	}
+	for _, schedulerPool := range celery.Spec.Schedulers {
+		if schedulerPool.Name == pool {
+			return fmt.Sprintf("%s-scheduler-%s", celery.GetName(), pool), nil
+		}
+	}
+	return "", fmt.Errorf("scheduler pool %s is not found in celery %s", pool, target.Name)
+}
+
+// GetDueTimes returns the last and next time the task is due according to the crontab, which is evaluated
+// in the timezone of beat. The runs of interval depend on when beat started, which it does not report,
+// so no due time is returned for them.
+func (cpt *CeleryPeriodicTask) GetDueTimes(now time.Time, location *time.Location) (time.Time, time.Time, error) {
+	if cpt.Spec.Crontab != "" {
+		crontab, err := ParseCrontab(cpt.Spec.Crontab)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		now = now.In(location)
+		return toUTC(crontab.Prev(now)), toUTC(crontab.Next(now)), nil
+	}
+	if cpt.Spec.Interval == nil || cpt.Spec.Interval.Duration <= 0 {
+		return time.Time{}, time.Time{}, errors.New("either crontab or a positive interval is required")
+	}
+	return time.Time{}, time.Time{}, nil
+}
+
+// toUTC keeps the zero time, which means no run, as it is
+func toUTC(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.UTC()
+}
+
+// beatScheduleEntry is an entry of beat_schedule loaded by the beat pods
+type beatScheduleEntry struct {
+	Task     string                     `json:"task"`
+	Schedule map[string]interface{}     `json:"schedule"`
+	Args     []json.RawMessage          `json:"args,omitempty"`
+	Kwargs   map[string]json.RawMessage `json:"kwargs,omitempty"`
+	Options  map[string]interface{}     `json:"options,omitempty"`
+}
+
+// generateBeatScheduleEntry converts the task to the arguments of beat_schedule.
+// The crontab fields are passed to celery.schedules.crontab and the interval is in seconds.
+func (cpt *CeleryPeriodicTask) generateBeatScheduleEntry() (*beatScheduleEntry, error) {
+	entry := &beatScheduleEntry{
+		Task:    cpt.Spec.Task,
+		Options: map[string]interface{}{},
+	}
+	if cpt.Spec.Crontab != "" {
+		crontab, err := ParseCrontab(cpt.Spec.Crontab)
+		if err != nil {
+			return nil, err
+		}
+		entry.Schedule = map[string]interface{}{
+			"crontab": map[string]string{
+				"minute":        crontab.Minute,
+				"hour":          crontab.Hour,
+				"day_of_month":  crontab.DayOfMonth,
+				"month_of_year": crontab.MonthOfYear,
+				"day_of_week":   crontab.DayOfWeek,
+			},
+		}
+	} else if cpt.Spec.Interval != nil && cpt.Spec.Interval.Duration > 0 {
+		entry.Schedule = map[string]interface{}{
+			"interval": cpt.Spec.Interval.Duration.Seconds(),
+		}
+	} else {
+		return nil, errors.New("either crontab or a positive interval is required")
+	}
+	for _, arg := range cpt.Spec.Args {
+		entry.Args = append(entry.Args, json.RawMessage(arg.Raw))
+	}
+	if len(cpt.Spec.Kwargs) > 0 {
+		entry.Kwargs = make(map[string]json.RawMessage)
+		for key, value := range cpt.Spec.Kwargs {
+			entry.Kwargs[key] = json.RawMessage(value.Raw)
+		}
+	}
+	if cpt.Spec.Queue != "" {
+		entry.Options["queue"] = cpt.Spec.Queue
+	}
+	if cpt.Spec.ExpiresSeconds != nil {
+		entry.Options["expires"] = *cpt.Spec.ExpiresSeconds
+	}
+	return entry, nil
+}
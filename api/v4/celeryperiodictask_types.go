@@ -0,0 +1,101 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CeleryPeriodicTaskSpec defines the desired state of CeleryPeriodicTask
+type CeleryPeriodicTaskSpec struct {
+	// Task defines the registered name of the task, e.g. proj.tasks.add
+	// +kubebuilder:validation:MinLength=1
+	Task string `json:"task"`
+	// Args defines the positional arguments of the task
+	Args []apiextensionsv1.JSON `json:"args,omitempty"`
+	// Kwargs defines the keyword arguments of the task
+	Kwargs map[string]apiextensionsv1.JSON `json:"kwargs,omitempty"`
+	// Crontab defines the schedule in cron format "<minute> <hour> <day of month> <month> <day of week>"
+	// in the timezone of the config of the scheduler (UTC if it is not set), e.g. "*/15 * * * *". Either crontab or interval should be set.
+	// The day of month and day of week should both match like the crontab of celery
+	Crontab string `json:"crontab,omitempty"`
+	// Interval defines the interval between two runs, e.g. 30s or 1h
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Queue defines the queue the task is sent to. The default queue is used if it is not set
+	Queue string `json:"queue,omitempty"`
+	// ExpiresSeconds defines the seconds after which the task is revoked if it has not been started
+	// +kubebuilder:validation:Minimum=1
+	ExpiresSeconds *int32 `json:"expiresSeconds,omitempty"`
+	// Target refers to the scheduler running the task
+	Target PeriodicTaskTarget `json:"target"`
+}
+
+// PeriodicTaskTarget refers to a CeleryScheduler or a scheduler pool of Celery in the same namespace
+type PeriodicTaskTarget struct {
+	// Kind defines the kind of the target
+	// +kubebuilder:validation:Enum=CeleryScheduler;Celery
+	Kind string `json:"kind"`
+	// Name defines the name of the target
+	Name string `json:"name"`
+	// Pool defines the scheduler pool if the target is Celery. Defaults to the first scheduler pool
+	Pool string `json:"pool,omitempty"`
+}
+
+// CeleryPeriodicTaskStatus defines the observed state of CeleryPeriodicTask
+type CeleryPeriodicTaskStatus struct {
+	// Scheduler defines the name of the CeleryScheduler running the task
+	Scheduler string `json:"scheduler,omitempty"`
+	// LastDueTime defines the latest time the task was due according to the crontab. It is computed in the timezone
+	// of the scheduler rather than observed from beat, so a run missed by beat is not reflected.
+	// It is not reported for interval, whose runs depend on when beat started
+	LastDueTime *metav1.Time `json:"lastDueTime,omitempty"`
+	// NextDueTime defines the next time the task will be due according to the crontab
+	NextDueTime *metav1.Time `json:"nextDueTime,omitempty"`
+	// Conditions defines the latest observations of the task, i.e. Scheduled
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Task",type=string,JSONPath=`.spec.task`
+// +kubebuilder:printcolumn:name="Scheduler",type=string,JSONPath=`.status.scheduler`
+// +kubebuilder:printcolumn:name="Last Due",type=date,JSONPath=`.status.lastDueTime`
+// +kubebuilder:printcolumn:name="Next Due",type=date,JSONPath=`.status.nextDueTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CeleryPeriodicTask is the Schema for the celeryperiodictasks API
+type CeleryPeriodicTask struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CeleryPeriodicTaskSpec   `json:"spec,omitempty"`
+	Status CeleryPeriodicTaskStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CeleryPeriodicTaskList contains a list of CeleryPeriodicTask
+type CeleryPeriodicTaskList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CeleryPeriodicTask `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CeleryPeriodicTask{}, &CeleryPeriodicTaskList{})
+}
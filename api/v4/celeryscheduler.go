@@ -1,34 +1,316 @@
 package v4
 
 import (
-	"reflect"
-	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
 
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/rand"
 )
 
 func (csr *CeleryScheduler) IsUpToDate(podList []corev1.Pod) bool {
 	for _, pod := range podList {
-		if len(pod.Spec.Containers) != 1 ||
-			pod.Spec.Containers[0].Image != csr.Spec.Image ||
-			strings.Join(pod.Spec.Containers[0].Command, "") != strings.Join(csr.getCommand(), "") ||
-			!reflect.DeepEqual(pod.Spec.Containers[0].Resources, csr.Spec.Resources) {
+		if !csr.IsPodUpToDate(&pod) {
 			return false
 		}
 	}
 	return true
 }
 
+// IsPodUpToDate checks whether the pod matches the current spec of the scheduler
+func (csr *CeleryScheduler) IsPodUpToDate(pod *corev1.Pod) bool {
+	return isPodUpToDate(csr.Spec.CeleryVersion, csr.generatePod(), pod)
+}
+
+// GetPodLabels returns the labels selecting the pods of the scheduler
+func (csr *CeleryScheduler) GetPodLabels() map[string]string {
+	return map[string]string{
+		"celery-app": csr.Name,
+		"type":       "scheduler",
+	}
+}
+
+// GetSpecHash returns the spec hash of the pods generated from the current spec
+func (csr *CeleryScheduler) GetSpecHash() string {
+	return csr.generatePod().Annotations[SpecHashAnnotation]
+}
+
+// BeatRoleAnnotation tells the scheduler pod whether it should run beat.
+// It is exposed to the pod through the downward api, so the standbys take over without restarting.
+const BeatRoleAnnotation = "celery.celeryproject.org/beat-role"
+
+const (
+	// BeatRoleActive is the role of the only pod running beat
+	BeatRoleActive = "active"
+	// BeatRoleStandby is the role of the pods waiting to take over
+	BeatRoleStandby = "standby"
+)
+
+// BeatDemotedAnnotation records the restart count of the scheduler container when the active beat is demoted
+// by a rollout. The wrapper exits after beat has stopped, so the lease is handed over once the container restarts
+// rather than after the lease expires.
+const BeatDemotedAnnotation = "celery.celeryproject.org/beat-demoted"
+
+// BeatLeaseDuration defines how long the active beat can be unhealthy before a standby takes over
+const BeatLeaseDuration = 30 * time.Second
+
+// GetLeaseName returns the name of the lease held by the active beat
+func (csr *CeleryScheduler) GetLeaseName() string {
+	return csr.GetName() + "-beat"
+}
+
+// GenerateLease creates the lease without holder. The holder is elected by the operator
+func (csr *CeleryScheduler) GenerateLease() *coordinationv1.Lease {
+	duration := int32(BeatLeaseDuration / time.Second)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      csr.GetLeaseName(),
+			Namespace: csr.GetNamespace(),
+			Labels:    csr.GetPodLabels(),
+		},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &duration,
+		},
+	}
+}
+
+// beatRoleDir is where the downward api volume with the beat role is mounted
+const beatRoleDir = "/etc/celery-beat"
+
+// beatWrapperScript only starts beat after the pod becomes active and stops beat after it is demoted.
+// The demoted pod exits and comes back as a standby after the restart.
+const beatWrapperScript = `role_file=` + beatRoleDir + `/role
+while [ "$(cat "$role_file" 2>/dev/null)" != "` + BeatRoleActive + `" ]; do
+  sleep 1
+done
+"$@" &
+pid=$!
+trap 'kill -TERM "$pid" 2>/dev/null' TERM INT
+while kill -0 "$pid" 2>/dev/null; do
+  if [ "$(cat "$role_file" 2>/dev/null)" != "` + BeatRoleActive + `" ]; then
+    kill -TERM "$pid" 2>/dev/null
+  fi
+  sleep 1
+done
+wait "$pid"`
+
+// scheduleDir is where the volume keeping the beat schedule is mounted
+const scheduleDir = "/var/lib/celery-beat"
+
+// GetScheduleClaimName returns the name of the volume claim keeping the beat schedule
+func (csr *CeleryScheduler) GetScheduleClaimName() string {
+	return csr.GetName() + "-schedule"
+}
+
+// GenerateScheduleClaim creates the volume claim keeping the beat schedule
+func (csr *CeleryScheduler) GenerateScheduleClaim() *corev1.PersistentVolumeClaim {
+	persistence := csr.Spec.Persistence
+	size := resource.MustParse("1Gi")
+	if persistence.Size != nil {
+		size = *persistence.Size
+	}
+	accessModes := persistence.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      csr.GetScheduleClaimName(),
+			Namespace: csr.GetNamespace(),
+			Labels:    csr.GetPodLabels(),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: persistence.StorageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+}
+
+// BeatScheduleHashAnnotation records the hash of the periodic tasks on the scheduler and its pods,
+// so beat is restarted after they are changed
+const BeatScheduleHashAnnotation = "celery.celeryproject.org/beat-schedule-hash"
+
+// beatScheduleDir is where the config map with the periodic tasks is mounted
+const beatScheduleDir = "/etc/celery-beat-schedule"
+
+// beatScheduleModule is the scheduler class loading the periodic tasks on top of the scheduler class of the spec
+const beatScheduleModule = "celery_operator_beat"
+
+// beatScheduleShim merges the periodic tasks into beat_schedule before the base scheduler sets up the schedule
+const beatScheduleShim = `import json
+import os
+
+from celery import schedules
+from celery.utils.imports import symbol_by_name
+
+SCHEDULE_FILE = os.path.join(os.path.dirname(os.path.abspath(__file__)), "beat_schedule.json")
+BaseScheduler = symbol_by_name(os.environ.get("CELERY_OPERATOR_BASE_SCHEDULER") or "celery.beat:PersistentScheduler")
+
+
+def load_beat_schedule():
+    with open(SCHEDULE_FILE) as f:
+        entries = json.load(f)
+    beat_schedule = {}
+    for name, entry in entries.items():
+        schedule = entry.pop("schedule")
+        if "crontab" in schedule:
+            entry["schedule"] = schedules.crontab(**schedule["crontab"])
+        else:
+            entry["schedule"] = schedules.schedule(schedule["interval"])
+        beat_schedule[name] = entry
+    return beat_schedule
+
+
+class Scheduler(BaseScheduler):
+    def setup_schedule(self):
+        self.app.conf.beat_schedule.update(load_beat_schedule())
+        super(Scheduler, self).setup_schedule()
+`
+
+// GetBeatScheduleName returns the name of the config map keeping the periodic tasks
+func (csr *CeleryScheduler) GetBeatScheduleName() string {
+	return csr.GetName() + "-beat-schedule"
+}
+
+// GetBeatScheduleHash returns the hash of the periodic tasks the pods are generated with
+func (csr *CeleryScheduler) GetBeatScheduleHash() string {
+	return csr.GetAnnotations()[BeatScheduleHashAnnotation]
+}
+
+// SetBeatScheduleHash records the hash of the rendered periodic tasks in the annotations.
+// The annotation is removed if the hash is empty, i.e. there is no task.
+func (csr *CeleryScheduler) SetBeatScheduleHash(hash string) {
+	if hash == "" {
+		delete(csr.Annotations, BeatScheduleHashAnnotation)
+		return
+	}
+	if csr.Annotations == nil {
+		csr.Annotations = make(map[string]string)
+	}
+	csr.Annotations[BeatScheduleHashAnnotation] = hash
+}
+
+// GenerateBeatSchedule renders the periodic tasks into the config map loaded by beat.
+// The tasks are keyed by their names, and the hash of the rendered schedule is returned with the config map.
+func (csr *CeleryScheduler) GenerateBeatSchedule(tasks []CeleryPeriodicTask) (*corev1.ConfigMap, string, error) {
+	entries := make(map[string]*beatScheduleEntry)
+	for i := range tasks {
+		entry, err := tasks[i].generateBeatScheduleEntry()
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid periodic task %s: %v", tasks[i].Name, err)
+		}
+		entries[tasks[i].Name] = entry
+	}
+	// The keys of map are sorted by json, so the same tasks are always rendered in the same way
+	schedule, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(append(schedule, beatScheduleShim...))
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      csr.GetBeatScheduleName(),
+			Namespace: csr.GetNamespace(),
+			Labels:    csr.GetPodLabels(),
+		},
+		Data: map[string]string{
+			"beat_schedule.json":       string(schedule),
+			beatScheduleModule + ".py": beatScheduleShim,
+		},
+	}
+	return configMap, hex.EncodeToString(hash[:])[:16], nil
+}
+
 func (csr *CeleryScheduler) getCommand() []string {
-	command := []string{"celery", "beat", "-A", csr.Spec.AppName, "-b", csr.Spec.BrokerAddress}
-	if csr.Spec.SchedulerClass != "" {
-		command = append(command, []string{"--scheduler", csr.Spec.SchedulerClass}...)
+	args := []string{}
+	if csr.GetBeatScheduleHash() != "" {
+		// The scheduler class of the spec is loaded by the shim
+		args = append(args, []string{"--scheduler", beatScheduleModule + ":Scheduler"}...)
+	} else if csr.Spec.SchedulerClass != "" {
+		args = append(args, []string{"--scheduler", csr.Spec.SchedulerClass}...)
+	}
+	if csr.Spec.Persistence != nil {
+		args = append(args, []string{"--schedule", scheduleDir + "/celerybeat-schedule"}...)
+	}
+	appConfig := csr.getAppConfig()
+	command := buildCeleryCommand(csr.Spec.CeleryVersion, "beat", []string{"-A", getConfigApp(csr.Spec.AppName, appConfig)}, args)
+	// The shims are loaded from the mounted config maps
+	var pythonPath []string
+	if len(appConfig) > 0 {
+		pythonPath = append(pythonPath, configDir)
+	}
+	if csr.GetBeatScheduleHash() != "" {
+		pythonPath = append(pythonPath, beatScheduleDir)
+	}
+	if len(pythonPath) > 0 {
+		command = append([]string{"sh", "-c", pythonPathScript(pythonPath...), "celery-beat-schedule"}, command...)
 	}
 	return command
 }
 
+// GetTimezone returns the timezone beat evaluates the crontab schedules in, i.e. timezone of the config.
+// Defaults to UTC like celery when the timezone is not set
+func (csr *CeleryScheduler) GetTimezone() (*time.Location, error) {
+	value, ok := csr.Spec.Config["timezone"]
+	if !ok {
+		return time.UTC, nil
+	}
+	var name string
+	if err := json.Unmarshal(value.Raw, &name); err != nil {
+		return nil, fmt.Errorf("timezone should be a string: %v", err)
+	}
+	if name == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", name, err)
+	}
+	return location, nil
+}
+
+// GetBrokerURLSecretName returns the name of the secret keeping the plain broker address of the schedulers
+func (csr *CeleryScheduler) GetBrokerURLSecretName() string {
+	return brokerURLSecretName(csr.GetName())
+}
+
+// GenerateBrokerURLSecret keeps the plain broker address of the schedulers in a secret.
+// It returns nil if the address is read from the secret given in the spec.
+func (csr *CeleryScheduler) GenerateBrokerURLSecret() *corev1.Secret {
+	return generateBrokerURLSecret(csr.GetName(), csr.GetNamespace(), csr.GetPodLabels(), csr.Spec.BrokerAddress, csr.Spec.BrokerAddressSecretRef)
+}
+
+// GetConfigMapName returns the name of the config map keeping the rendered celery config
+func (csr *CeleryScheduler) GetConfigMapName() string {
+	return csr.GetName() + "-config"
+}
+
+// getAppConfig returns the settings applied to the app of the schedulers
+func (csr *CeleryScheduler) getAppConfig() map[string]apiextensionsv1.JSON {
+	return buildAppConfig(csr.Spec.Config, csr.Spec.BrokerTransportOptions, csr.Spec.ResultBackend)
+}
+
+// GenerateConfigMap renders the celery config of the schedulers. It returns nil if there is no setting to apply
+func (csr *CeleryScheduler) GenerateConfigMap() (*corev1.ConfigMap, error) {
+	appConfig := csr.getAppConfig()
+	if len(appConfig) == 0 {
+		return nil, nil
+	}
+	return generateConfigMap(csr.GetConfigMapName(), csr.GetNamespace(), csr.GetPodLabels(), appConfig)
+}
+
 // Generate will create the pod spec of the broker.
 func (csr *CeleryScheduler) Generate(count ...int) []*corev1.Pod {
 	var targetNumber int
@@ -38,31 +320,161 @@ func (csr *CeleryScheduler) Generate(count ...int) []*corev1.Pod {
 		targetNumber = count[0]
 	}
 
-	labels := map[string]string{
-		"celery-app": csr.Name,
-		"type":       "scheduler",
-	}
-
 	podList := make([]*corev1.Pod, 0)
 	for i := 0; i < targetNumber; i++ {
-		pod := &corev1.Pod{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      csr.GetName() + "-" + rand.String(5),
-				Namespace: csr.GetNamespace(),
-				Labels:    labels,
+		pod := csr.generatePod()
+		pod.Name = csr.GetName() + "-" + rand.String(5)
+		podList = append(podList, pod)
+	}
+	return podList
+}
+
+// generatePod merges the pod template with the scheduler container
+func (csr *CeleryScheduler) generatePod() *corev1.Pod {
+	brokerSecretRef, brokerHash := resolveBrokerSecretRef(csr.GetName(), csr.Spec.BrokerAddress, csr.Spec.BrokerAddressSecretRef, csr.Spec.BrokerAddressHash)
+	template := applyPodTemplate(csr.Spec.PodTemplate, &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      csr.GetPodLabels(),
+			Annotations: generateBrokerAnnotations(brokerHash, csr.Spec.ResultBackend),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:      "celery-scheduler",
+					Image:     csr.Spec.Image,
+					Resources: csr.Spec.Resources,
+					Command:   []string{"sh", "-c", beatWrapperScript, "celery-beat"},
+					Args:      csr.getCommand(),
+					Env: append(generateBrokerEnv(brokerSecretRef),
+						generateResultBackendEnv(csr.Spec.ResultBackend)...),
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "beat-role",
+							MountPath: beatRoleDir,
+							ReadOnly:  true,
+						},
+					},
+				},
 			},
-			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{
-					{
-						Name:      "celery-scheduler",
-						Image:     csr.Spec.Image,
-						Resources: csr.Spec.Resources,
-						Command:   csr.getCommand(),
+			Volumes: []corev1.Volume{
+				{
+					Name: "beat-role",
+					VolumeSource: corev1.VolumeSource{
+						DownwardAPI: &corev1.DownwardAPIVolumeSource{
+							Items: []corev1.DownwardAPIVolumeFile{
+								{
+									Path: "role",
+									FieldRef: &corev1.ObjectFieldSelector{
+										FieldPath: fmt.Sprintf("metadata.annotations['%s']", BeatRoleAnnotation),
+									},
+								},
+							},
+						},
 					},
 				},
 			},
+		},
+	})
+	if csr.Spec.Persistence != nil {
+		addScheduleVolume(&template.Spec, csr.GetScheduleClaimName())
+		if !isSharedVolume(csr.Spec.Persistence.AccessModes) {
+			addScheduleAffinity(&template.Spec, csr.GetPodLabels())
+		}
+	}
+	if appConfig := csr.getAppConfig(); len(appConfig) > 0 {
+		addConfigVolume(template, "celery-scheduler", csr.GetConfigMapName(), appConfig, csr.Spec.AppName)
+	}
+	if hash := csr.GetBeatScheduleHash(); hash != "" {
+		addBeatScheduleVolume(template, csr.GetBeatScheduleName(), hash, csr.Spec.SchedulerClass)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   csr.GetNamespace(),
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+		},
+		Spec: template.Spec,
+	}
+	setSpecHash(pod)
+	return pod
+}
+
+// addScheduleVolume mounts the volume claim keeping the beat schedule to the scheduler container
+func addScheduleVolume(spec *corev1.PodSpec, claimName string) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "beat-schedule",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+			},
+		},
+	})
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == "celery-scheduler" {
+			spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      "beat-schedule",
+				MountPath: scheduleDir,
+			})
+		}
+	}
+}
+
+// isSharedVolume checks whether the volume can be attached to the pods on different nodes
+func isSharedVolume(accessModes []corev1.PersistentVolumeAccessMode) bool {
+	for _, mode := range accessModes {
+		if mode == corev1.ReadWriteMany {
+			return true
+		}
+	}
+	return false
+}
+
+// addScheduleAffinity keeps the pods on the node the volume is attached to, so the standbys and the new pods
+// of a rollout, which are started before the old ones are deleted, can mount the volume of a single node
+func addScheduleAffinity(spec *corev1.PodSpec, labels map[string]string) {
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.PodAffinity == nil {
+		spec.Affinity.PodAffinity = &corev1.PodAffinity{}
+	}
+	podAffinity := spec.Affinity.PodAffinity
+	podAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(podAffinity.RequiredDuringSchedulingIgnoredDuringExecution, corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: labels},
+		TopologyKey:   "kubernetes.io/hostname",
+	})
+}
+
+// addBeatScheduleVolume mounts the config map with the periodic tasks to the scheduler container.
+// The hash is recorded in the annotations, so the pods are recreated after the tasks are changed.
+func addBeatScheduleVolume(template *corev1.PodTemplateSpec, configMapName string, hash string, baseScheduler string) {
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[BeatScheduleHashAnnotation] = hash
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: "beat-periodic-tasks",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		},
+	})
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != "celery-scheduler" {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "beat-periodic-tasks",
+			MountPath: beatScheduleDir,
+			ReadOnly:  true,
+		})
+		if baseScheduler != "" {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  "CELERY_OPERATOR_BASE_SCHEDULER",
+				Value: baseScheduler,
+			})
 		}
-		podList = append(podList, pod)
 	}
-	return podList
 }
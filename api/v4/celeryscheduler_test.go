@@ -0,0 +1,38 @@
+package v4
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestScheduleAffinity(t *testing.T) {
+	scheduler := &CeleryScheduler{
+		ObjectMeta: metav1.ObjectMeta{Name: "celery-scheduler", Namespace: "default"},
+		Spec: CelerySchedulerSpec{
+			Image:       "celery:4",
+			AppName:     "app",
+			Replicas:    2,
+			Persistence: &SchedulePersistence{},
+		},
+	}
+	if errs := validateSchedulerSpec(&scheduler.Spec, field.NewPath("spec")); len(errs) != 0 {
+		t.Errorf("expected the standbys to share the volume on one node, got %v", errs)
+	}
+	// The standbys and the new pod of a rollout should be on the node the volume is attached to
+	pod := scheduler.generatePod()
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.PodAffinity == nil {
+		t.Fatalf("expected the pods to be kept on the node of the volume")
+	}
+	terms := pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(terms) != 1 || terms[0].TopologyKey != "kubernetes.io/hostname" || terms[0].LabelSelector.MatchLabels["celery-app"] != "celery-scheduler" {
+		t.Errorf("unexpected affinity %v", terms)
+	}
+
+	scheduler.Spec.Persistence.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}
+	if pod := scheduler.generatePod(); pod.Spec.Affinity != nil {
+		t.Errorf("expected no affinity for the shared volume, got %v", pod.Spec.Affinity)
+	}
+}
@@ -18,6 +18,8 @@ package v4
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -31,19 +33,69 @@ type CelerySchedulerSpec struct {
 	SchedulerClass string `json:"schedulerClass,omitempty"`
 	// AppName defines the target app instance to use
 	AppName string `json:"appName,omitempty"`
-	// DesiredNumber defines the number of worker if autoscaling is disabled
+	// Replicas defines the number of scheduler pods. Only one of them runs beat at a time
+	// and the others are the warm standbys taking over on failure
 	Replicas int `json:"replicas,omitempty"`
 	// Resources defines the resources specification for these workers
-	Resources     corev1.ResourceRequirements `json:"resources,omitempty"`
-	BrokerAddress string                      `json:"brokerAddress,omitempty"`
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// BrokerAddress defines the broker url. It is passed to the pods through the secret <name>-broker-url
+	BrokerAddress string `json:"brokerAddress,omitempty"`
+	// PodTemplate defines the pod template of the schedulers, e.g. env, volumes, tolerations and sidecars.
+	// The container celery-scheduler is merged with the image, command and resources generated by the operator
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// CeleryVersion defines the celery version in the image, e.g. 4 or 5.2.
+	// Celery 5 requires the global options before the subcommand. Defaults to 4
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)*$`
+	CeleryVersion string `json:"celeryVersion,omitempty"`
+	// Persistence defines the volume keeping the schedule state of the default PersistentScheduler,
+	// so the last run times survive restarts and upgrades. It is ignored by the other scheduler classes.
+	// The volume is shared by the standbys. Unless it is ReadWriteMany, all the pods are kept on the node
+	// the volume is attached to, so the standbys and the new pods of a rollout can mount it
+	Persistence *SchedulePersistence `json:"persistence,omitempty"`
+	// BrokerAddressSecretRef refers to the secret keeping the broker url.
+	// It takes precedence over BrokerAddress
+	BrokerAddressSecretRef *corev1.SecretKeySelector `json:"brokerAddressSecretRef,omitempty"`
+	// BrokerAddressHash defines the hash of the broker url in the secret.
+	// The pods are rolled out when it is changed, so the rotated credentials are picked up
+	BrokerAddressHash string `json:"brokerAddressHash,omitempty"`
+	// BrokerTransportOptions defines the broker_transport_options, e.g. master_name for sentinel.
+	// They are applied to the app by the config module in <name>-config, and the ones of the same keys
+	// in config.broker_transport_options take precedence
+	BrokerTransportOptions map[string]string `json:"brokerTransportOptions,omitempty"`
+	// ResultBackend defines the result backend the task results are stored to
+	ResultBackend *ResultBackendReference `json:"resultBackend,omitempty"`
+	// Config defines the celery settings in lowercase, e.g. worker_prefetch_multiplier, task_acks_late,
+	// task_time_limit, timezone and task_routes. It is rendered into the config map <name>-config
+	// and applied on top of the config of the app, so the pods are rolled out after it is changed
+	Config map[string]apiextensionsv1.JSON `json:"config,omitempty"`
+}
+
+// SchedulePersistence defines the volume claim of the beat schedule
+type SchedulePersistence struct {
+	// StorageClassName defines the storage class of the volume.
+	// The default storage class will be used if it is not set
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Size defines the size of the volume. Defaults to 1Gi
+	Size *resource.Quantity `json:"size,omitempty"`
+	// AccessModes defines the access modes of the volume. Defaults to ReadWriteOnce
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
 }
 
 // CelerySchedulerStatus defines the observed state of CeleryScheduler
 type CelerySchedulerStatus struct {
+	ReplicaStatus `json:",inline"`
+	// ActivePod defines the name of the only pod running beat.
+	// It holds the lease <name>-beat in the same namespace
+	ActivePod string `json:"activePod,omitempty"`
+	// BeatScheduleHash defines the hash of the periodic tasks rendered into the config map <name>-beat-schedule.
+	// It is empty if no CeleryPeriodicTask targets the scheduler. The pods are generated with the hash recorded
+	// in the annotation celery.celeryproject.org/beat-schedule-hash of the scheduler instead
+	BeatScheduleHash string `json:"beatScheduleHash,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 
 // CeleryScheduler is the Schema for the celeryschedulers API
 type CeleryScheduler struct {
@@ -0,0 +1,86 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var celeryschedulerlog = logf.Log.WithName("celeryscheduler-resource")
+
+func (r *CeleryScheduler) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-celery-celeryproject-org-v4-celeryscheduler,mutating=true,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeryschedulers,verbs=create;update,versions=v4,name=mceleryscheduler.kb.io
+
+var _ webhook.Defaulter = &CeleryScheduler{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// The replicas are only defaulted on creation, so the schedulers can still be scaled to zero.
+// The schedulers of a Celery have been defaulted through their pools.
+func (r *CeleryScheduler) Default() {
+	celeryschedulerlog.Info("default", "name", r.Name)
+
+	if r.ResourceVersion == "" && metav1.GetControllerOf(r) == nil && r.Spec.Replicas == 0 {
+		r.Spec.Replicas = 1
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-celery-celeryproject-org-v4-celeryscheduler,mutating=false,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeryschedulers,versions=v4,name=vceleryscheduler.kb.io
+
+var _ webhook.Validator = &CeleryScheduler{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryScheduler) ValidateCreate() error {
+	celeryschedulerlog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryScheduler) ValidateUpdate(old runtime.Object) error {
+	celeryschedulerlog.Info("validate update", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryScheduler) ValidateDelete() error {
+	return nil
+}
+
+func (r *CeleryScheduler) validate() error {
+	specPath := field.NewPath("spec")
+	allErrs := validateSchedulerSpec(&r.Spec, specPath)
+	if r.Spec.Image == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("image"), "the image of celery beat is required"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("CeleryScheduler").GroupKind(), r.Name, allErrs)
+}
@@ -1,71 +1,419 @@
 package v4
 
 import (
-	"reflect"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/rand"
 )
 
+// DrainStartedAnnotation records when the worker stopped consuming the queues before it is deleted
+const DrainStartedAnnotation = "celery.celeryproject.org/drain-started"
+
+// terminationGracePeriodMargin is given to the worker on top of the max task duration to shut down
+const terminationGracePeriodMargin = 30 * time.Second
+
 func (cwr *CeleryWorker) getCommand() []string {
-	command := []string{"celery", "worker", "-A", cwr.Spec.AppName, "-b", cwr.Spec.BrokerAddress}
+	args := []string{}
 	if len(cwr.Spec.TargetQueues) > 0 {
-		command = append(command, []string{
+		args = append(args, []string{
 			"--queues",
 			strings.Join(cwr.Spec.TargetQueues, ","),
 		}...)
 	}
+	if cwr.Spec.Pool != "" {
+		args = append(args, "--pool", string(cwr.Spec.Pool))
+	}
+	if concurrency := cwr.GetConcurrency(); concurrency > 0 {
+		args = append(args, "--concurrency", strconv.Itoa(int(concurrency)))
+	}
+	if autoscale := cwr.Spec.Autoscale; autoscale != nil {
+		args = append(args, "--autoscale", fmt.Sprintf("%d,%d", autoscale.MaxConcurrency, autoscale.MinConcurrency))
+	}
+	if cwr.Spec.MaxTasksPerChild != nil {
+		args = append(args, "--max-tasks-per-child", strconv.Itoa(int(*cwr.Spec.MaxTasksPerChild)))
+	}
+	if maxMemory := cwr.GetMaxMemoryPerChild(); maxMemory > 0 {
+		args = append(args, "--max-memory-per-child", strconv.FormatInt(maxMemory, 10))
+	}
+	if cwr.Spec.PrefetchMultiplier != nil {
+		args = append(args, "--prefetch-multiplier", strconv.Itoa(int(*cwr.Spec.PrefetchMultiplier)))
+	}
+	if cwr.Spec.LogLevel != "" {
+		args = append(args, "--loglevel", string(cwr.Spec.LogLevel))
+	}
+	appConfig := cwr.getAppConfig()
+	command := buildCeleryCommand(cwr.Spec.CeleryVersion, "worker", []string{"-A", getConfigApp(cwr.Spec.AppName, appConfig)}, args)
+	if len(appConfig) > 0 {
+		command = append([]string{"sh", "-c", pythonPathScript(configDir), "celery-config"}, command...)
+	}
 	return command
 }
 
+// GetDrainTimeout returns how long the workers are drained before deletion, or 0 if draining is disabled
+func (cwr *CeleryWorker) GetDrainTimeout() time.Duration {
+	if cwr.Spec.DrainTimeout != nil {
+		return cwr.Spec.DrainTimeout.Duration
+	}
+	if cwr.Spec.MaxTaskDuration != nil {
+		return cwr.Spec.MaxTaskDuration.Duration
+	}
+	return 0
+}
+
+// GetWorkerNodeName returns the node name of the worker in the pod, which is celery@ with the hostname by default
+func GetWorkerNodeName(pod *corev1.Pod) string {
+	hostname := pod.Spec.Hostname
+	if hostname == "" {
+		hostname = pod.Name
+	}
+	return "celery@" + hostname
+}
+
+// IsPoolResizable checks whether the pool is resized live by pool_grow and pool_shrink instead of restarting the workers.
+// Only the prefork pool without autoscale, which is resized by celery itself, is supported.
+func (cwr *CeleryWorker) IsPoolResizable() bool {
+	return cwr.GetPool() == PreforkPool && cwr.Spec.Autoscale == nil
+}
+
+// GetPool returns the execution pool of the workers. Defaults to prefork
+func (cwr *CeleryWorker) GetPool() WorkerPoolType {
+	if cwr.Spec.Pool == "" {
+		return PreforkPool
+	}
+	return cwr.Spec.Pool
+}
+
+// GetConcurrency returns the concurrency of each worker, or 0 if it is decided by celery.
+// It follows the cpu limit, or the cpu request, for the pools running in parallel.
+// The green threads are bound by io, so their concurrency is not derived from the cpu.
+func (cwr *CeleryWorker) GetConcurrency() int32 {
+	if cwr.Spec.Concurrency != nil {
+		return *cwr.Spec.Concurrency
+	}
+	if cwr.Spec.Autoscale != nil {
+		return 0
+	}
+	if pool := cwr.GetPool(); pool != PreforkPool && pool != ThreadsPool {
+		return 0
+	}
+	return cwr.getCPUConcurrency()
+}
+
+// getCPUConcurrency returns a process per cpu of the limit, or of the request, or 0 if there is no cpu
+func (cwr *CeleryWorker) getCPUConcurrency() int32 {
+	cpu := cwr.Spec.Resources.Limits.Cpu()
+	if cpu.IsZero() {
+		cpu = cwr.Spec.Resources.Requests.Cpu()
+	}
+	if cpu.IsZero() {
+		return 0
+	}
+	// Round up the fraction of cpu, e.g. 1500m runs two processes
+	return int32((cpu.MilliValue() + 999) / 1000)
+}
+
+// maxMemoryPerChildRatio is the share of the memory limit used by the child processes.
+// The rest is left to the main process of the worker, so it is not killed before its children are replaced.
+const maxMemoryPerChildRatio = 0.75
+
+// GetMaxMemoryPerChild returns the max memory per child in KiB, or 0 if there is no limit.
+// It is only derived from the memory limit for the prefork pool, as the other pools have no child process.
+// The limit is shared by a child per cpu, or by the max concurrency of autoscale, rather than the concurrency,
+// so it is kept as the pool is resized live.
+func (cwr *CeleryWorker) GetMaxMemoryPerChild() int64 {
+	if cwr.Spec.MaxMemoryPerChild != nil {
+		return cwr.Spec.MaxMemoryPerChild.Value() / 1024
+	}
+	if cwr.GetPool() != PreforkPool {
+		return 0
+	}
+	memory := cwr.Spec.Resources.Limits.Memory()
+	if memory.IsZero() {
+		return 0
+	}
+	children := int64(cwr.getCPUConcurrency())
+	if cwr.Spec.Autoscale != nil {
+		children = int64(cwr.Spec.Autoscale.MaxConcurrency)
+	}
+	if children < 1 {
+		return 0
+	}
+	return int64(float64(memory.Value())*maxMemoryPerChildRatio) / children / 1024
+}
+
+// GetConfigMapName returns the name of the config map keeping the rendered celery config
+func (cwr *CeleryWorker) GetConfigMapName() string {
+	return cwr.GetName() + "-config"
+}
+
+// getAppConfig returns the settings applied to the app of the workers
+func (cwr *CeleryWorker) getAppConfig() map[string]apiextensionsv1.JSON {
+	return buildAppConfig(cwr.Spec.Config, cwr.Spec.BrokerTransportOptions, cwr.Spec.ResultBackend)
+}
+
+// GenerateConfigMap renders the celery config of the workers. It returns nil if there is no setting to apply
+func (cwr *CeleryWorker) GenerateConfigMap() (*corev1.ConfigMap, error) {
+	appConfig := cwr.getAppConfig()
+	if len(appConfig) == 0 {
+		return nil, nil
+	}
+	return generateConfigMap(cwr.GetConfigMapName(), cwr.GetNamespace(), cwr.GetPodLabels(), appConfig)
+}
+
+// GetTargetQueues returns the queues consumed by the workers.
+// Celery consumes the default queue if no queue is given.
+func (cwr *CeleryWorker) GetTargetQueues() []string {
+	if len(cwr.Spec.TargetQueues) == 0 {
+		return []string{getDefaultQueue(cwr.Spec.Config)}
+	}
+	return cwr.Spec.TargetQueues
+}
+
+// GetDesiredReplicas returns the number of workers decided by the autoscaler
+// if autoscaling is enabled. Otherwise, it returns the replicas in spec.
+func (cwr *CeleryWorker) GetDesiredReplicas() int {
+	if cwr.Spec.Autoscaling == nil {
+		return cwr.Spec.Replicas
+	}
+	if cwr.Status.Autoscaling != nil {
+		return cwr.Status.Autoscaling.DesiredReplicas
+	}
+	return cwr.Spec.Autoscaling.ClampReplicas(cwr.Spec.Replicas)
+}
+
+// ClampReplicas limits the replicas within the min and max replicas
+func (cwa *CeleryWorkerAutoscaling) ClampReplicas(replicas int) int {
+	minReplicas := 1
+	if cwa.MinReplicas != nil {
+		minReplicas = *cwa.MinReplicas
+	}
+	if replicas < minReplicas {
+		return minReplicas
+	}
+	if replicas > cwa.MaxReplicas {
+		return cwa.MaxReplicas
+	}
+	return replicas
+}
+
+// GetScaleUpCooldown returns the minimum interval between two scaling up
+func (cwa *CeleryWorkerAutoscaling) GetScaleUpCooldown() time.Duration {
+	if cwa.ScaleUpCooldownSeconds == nil {
+		return 30 * time.Second
+	}
+	return time.Duration(*cwa.ScaleUpCooldownSeconds) * time.Second
+}
+
+// GetScaleDownCooldown returns the minimum interval between two scaling down
+func (cwa *CeleryWorkerAutoscaling) GetScaleDownCooldown() time.Duration {
+	if cwa.ScaleDownCooldownSeconds == nil {
+		return 300 * time.Second
+	}
+	return time.Duration(*cwa.ScaleDownCooldownSeconds) * time.Second
+}
+
 func (cwr *CeleryWorker) IsUpToDate(podList []corev1.Pod) bool {
 	for _, pod := range podList {
-		if len(pod.Spec.Containers) != 1 ||
-			pod.Spec.Containers[0].Image != cwr.Spec.Image ||
-			strings.Join(pod.Spec.Containers[0].Command, "") != strings.Join(cwr.getCommand(), "") ||
-			!reflect.DeepEqual(pod.Spec.Containers[0].Resources, cwr.Spec.Resources) {
+		if !cwr.IsPodUpToDate(&pod) {
 			return false
 		}
 	}
 	return true
 }
 
+// IsPodUpToDate checks whether the pod matches the current spec of the worker
+func (cwr *CeleryWorker) IsPodUpToDate(pod *corev1.Pod) bool {
+	return isPodUpToDate(cwr.Spec.CeleryVersion, cwr.generatePod(), pod)
+}
+
+// GetPodLabels returns the labels selecting the pods of the worker
+func (cwr *CeleryWorker) GetPodLabels() map[string]string {
+	return map[string]string{
+		"celery-app": cwr.Name,
+		"type":       "worker",
+	}
+}
+
+// GetSpecHash returns the spec hash of the pods generated from the current spec
+func (cwr *CeleryWorker) GetSpecHash() string {
+	return cwr.generatePod().Annotations[SpecHashAnnotation]
+}
+
+// setWarmShutdown lets the running tasks finish before the worker is killed. Celery runs as PID 1,
+// as the python path wrapper execs it, so the SIGTERM of kubelet starts the warm shutdown by itself
+func setWarmShutdown(template *corev1.PodTemplateSpec, maxTaskDuration time.Duration) {
+	gracePeriod := int64((maxTaskDuration + terminationGracePeriodMargin + time.Second - 1) / time.Second)
+	template.Spec.TerminationGracePeriodSeconds = &gracePeriod
+}
+
+// generateBrokerAnnotations records the broker and result backend url hashes, so the pods are replaced after rotation
+func generateBrokerAnnotations(hash string, resultBackend *ResultBackendReference) map[string]string {
+	annotations := map[string]string{}
+	if hash != "" {
+		annotations[BrokerAddressHashAnnotation] = hash
+	}
+	if resultBackend != nil && resultBackend.AddressHash != "" {
+		annotations[ResultBackendHashAnnotation] = resultBackend.AddressHash
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// generateBrokerEnv passes the broker url to celery from the secret, so it is not exposed in the pod spec.
+// The transport options are applied by the config shim.
+func generateBrokerEnv(secretRef *corev1.SecretKeySelector) []corev1.EnvVar {
+	if secretRef == nil {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name: "CELERY_BROKER_URL",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: secretRef,
+			},
+		},
+	}
+}
+
+// brokerURLSecretName returns the name of the secret minted for the plain broker address of a worker or scheduler
+func brokerURLSecretName(name string) string {
+	return name + "-broker-url"
+}
+
+// resolveBrokerSecretRef returns the secret keeping the broker url of the pods and the hash of the url.
+// A plain address is kept in the secret <name>-broker-url minted by the controller, and its hash rolls out the pods
+// when it is changed like the rotated secrets.
+func resolveBrokerSecretRef(name string, address string, secretRef *corev1.SecretKeySelector, hash string) (*corev1.SecretKeySelector, string) {
+	if secretRef != nil || address == "" {
+		return secretRef, hash
+	}
+	return &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: brokerURLSecretName(name)},
+		Key:                  BrokerURLKey,
+	}, HashBrokerAddress(address)
+}
+
+// generateBrokerURLSecret keeps the plain broker address in a secret.
+// It returns nil if the address is read from the given secret.
+func generateBrokerURLSecret(name string, namespace string, labels map[string]string, address string, secretRef *corev1.SecretKeySelector) *corev1.Secret {
+	if secretRef != nil || address == "" {
+		return nil
+	}
+	return newBrokerURLSecret(brokerURLSecretName(name), namespace, labels, address)
+}
+
+// GetBrokerURLSecretName returns the name of the secret keeping the plain broker address of the workers
+func (cwr *CeleryWorker) GetBrokerURLSecretName() string {
+	return brokerURLSecretName(cwr.GetName())
+}
+
+// GenerateBrokerURLSecret keeps the plain broker address of the workers in a secret.
+// It returns nil if the address is read from the secret given in the spec.
+func (cwr *CeleryWorker) GenerateBrokerURLSecret() *corev1.Secret {
+	return generateBrokerURLSecret(cwr.GetName(), cwr.GetNamespace(), cwr.GetPodLabels(), cwr.Spec.BrokerAddress, cwr.Spec.BrokerAddressSecretRef)
+}
+
+// GetRollingUpdateLimits resolves the max surge and max unavailable pods
+// for the desired replicas. The defaults follow the ones of Deployment.
+func (cwr *CeleryWorker) GetRollingUpdateLimits() (int, int, error) {
+	defaultLimit := intstr.FromString("25%")
+	maxSurge, maxUnavailable := &defaultLimit, &defaultLimit
+	if cwr.Spec.RollingUpdate != nil {
+		if cwr.Spec.RollingUpdate.MaxSurge != nil {
+			maxSurge = cwr.Spec.RollingUpdate.MaxSurge
+		}
+		if cwr.Spec.RollingUpdate.MaxUnavailable != nil {
+			maxUnavailable = cwr.Spec.RollingUpdate.MaxUnavailable
+		}
+	}
+	surge, err := intstr.GetValueFromIntOrPercent(maxSurge, cwr.GetDesiredReplicas(), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	unavailable, err := intstr.GetValueFromIntOrPercent(maxUnavailable, cwr.GetDesiredReplicas(), false)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The rollout cannot proceed if both of them are zero
+	if surge == 0 && unavailable == 0 {
+		unavailable = 1
+	}
+	return surge, unavailable, nil
+}
+
 // Generate will create the pod spec of the worker.
 func (cwr *CeleryWorker) Generate(count ...int) []*corev1.Pod {
 	var targetNumber int
 	if len(count) == 0 {
-		targetNumber = cwr.Spec.Replicas
+		targetNumber = cwr.GetDesiredReplicas()
 	} else {
 		targetNumber = count[0]
 	}
 
-	labels := map[string]string{
-		"celery-app": cwr.Name,
-		"type":       "worker",
-	}
-
 	podList := make([]*corev1.Pod, 0)
 	for i := 0; i < targetNumber; i++ {
-		pod := &corev1.Pod{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      cwr.GetName() + "-" + rand.String(5),
-				Namespace: cwr.GetNamespace(),
-				Labels:    labels,
-			},
-			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{
-					{
-						Name:      "celery-worker",
-						Image:     cwr.Spec.Image,
-						Resources: cwr.Spec.Resources,
-						Command:   cwr.getCommand(),
-					},
-				},
-			},
-		}
+		pod := cwr.generatePod()
+		pod.Name = cwr.GetName() + "-" + rand.String(5)
 		podList = append(podList, pod)
 	}
 	return podList
 }
+
+// generatePod merges the pod template with the worker container
+func (cwr *CeleryWorker) generatePod() *corev1.Pod {
+	brokerSecretRef, brokerHash := resolveBrokerSecretRef(cwr.GetName(), cwr.Spec.BrokerAddress, cwr.Spec.BrokerAddressSecretRef, cwr.Spec.BrokerAddressHash)
+	template := applyPodTemplate(cwr.Spec.PodTemplate, &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      cwr.GetPodLabels(),
+			Annotations: generateBrokerAnnotations(brokerHash, cwr.Spec.ResultBackend),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:      "celery-worker",
+					Image:     cwr.Spec.Image,
+					Resources: cwr.Spec.Resources,
+					Command:   cwr.getCommand(),
+					Env: append(generateBrokerEnv(brokerSecretRef),
+						generateResultBackendEnv(cwr.Spec.ResultBackend)...),
+				},
+			},
+		},
+	})
+	if cwr.Spec.MaxTaskDuration != nil {
+		setWarmShutdown(template, cwr.Spec.MaxTaskDuration.Duration)
+	}
+	if appConfig := cwr.getAppConfig(); len(appConfig) > 0 {
+		addConfigVolume(template, "celery-worker", cwr.GetConfigMapName(), appConfig, cwr.Spec.AppName)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   cwr.GetNamespace(),
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+		},
+		Spec: template.Spec,
+	}
+	if !cwr.IsPoolResizable() {
+		setSpecHash(pod)
+		return pod
+	}
+	// The concurrency is left out of the hash, so only the new pods are started with it
+	hashed := pod.DeepCopy()
+	hashed.Spec.Containers[0].Command = removeCommandOptions(hashed.Spec.Containers[0].Command, "--concurrency")
+	setSpecHash(hashed)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[SpecHashAnnotation] = hashed.Annotations[SpecHashAnnotation]
+	return pod
+}
@@ -0,0 +1,237 @@
+package v4
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func newResources(cpu string, memory string) corev1.ResourceRequirements {
+	limits := corev1.ResourceList{}
+	if cpu != "" {
+		limits[corev1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		limits[corev1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return corev1.ResourceRequirements{Limits: limits}
+}
+
+func TestWorkerPoolCommand(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+	maxMemory := resource.MustParse("256Mi")
+	cases := map[string]struct {
+		spec     CeleryWorkerSpec
+		expected []string
+	}{
+		"no resources": {
+			spec:     CeleryWorkerSpec{},
+			expected: []string{},
+		},
+		"derived from the limits": {
+			spec:     CeleryWorkerSpec{Resources: newResources("1500m", "2Gi")},
+			expected: []string{"--concurrency", "2", "--max-memory-per-child", "786432"},
+		},
+		"derived from the cpu request": {
+			spec: CeleryWorkerSpec{Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+			}},
+			expected: []string{"--concurrency", "1"},
+		},
+		"unknown number of children": {
+			spec:     CeleryWorkerSpec{Resources: newResources("", "1Gi")},
+			expected: []string{},
+		},
+		"max memory per child not following concurrency": {
+			spec:     CeleryWorkerSpec{Resources: newResources("2", "1Gi"), Concurrency: int32Ptr(8)},
+			expected: []string{"--concurrency", "8", "--max-memory-per-child", "393216"},
+		},
+		"green threads": {
+			spec:     CeleryWorkerSpec{Pool: GeventPool, Resources: newResources("2", "1Gi")},
+			expected: []string{"--pool", "gevent"},
+		},
+		"autoscale": {
+			spec: CeleryWorkerSpec{
+				Resources: newResources("4", "1Gi"),
+				Autoscale: &WorkerPoolAutoscale{MinConcurrency: 2, MaxConcurrency: 8},
+			},
+			expected: []string{"--autoscale", "8,2", "--max-memory-per-child", "98304"},
+		},
+		"explicit": {
+			spec: CeleryWorkerSpec{
+				Pool:               PreforkPool,
+				Resources:          newResources("4", "1Gi"),
+				Concurrency:        int32Ptr(3),
+				MaxTasksPerChild:   int32Ptr(100),
+				MaxMemoryPerChild:  &maxMemory,
+				PrefetchMultiplier: int32Ptr(1),
+				LogLevel:           "INFO",
+			},
+			expected: []string{
+				"--pool", "prefork",
+				"--concurrency", "3",
+				"--max-tasks-per-child", "100",
+				"--max-memory-per-child", "262144",
+				"--prefetch-multiplier", "1",
+				"--loglevel", "INFO",
+			},
+		},
+	}
+	for name, c := range cases {
+		c.spec.AppName = "app"
+		worker := &CeleryWorker{Spec: c.spec}
+		actual := worker.getCommand()[4:]
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, actual)
+		}
+	}
+}
+
+func TestValidateWorkerPool(t *testing.T) {
+	maxMemory := resource.MustParse("512")
+	spec := &CeleryWorkerSpec{
+		Pool:              SoloPool,
+		Autoscale:         &WorkerPoolAutoscale{MinConcurrency: 4, MaxConcurrency: 2},
+		MaxMemoryPerChild: &maxMemory,
+	}
+	errs := validateWorkerPool(spec, field.NewPath("spec"))
+	if len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+}
+
+func TestWarmShutdown(t *testing.T) {
+	worker := &CeleryWorker{Spec: CeleryWorkerSpec{AppName: "app"}}
+	pod := worker.generatePod()
+	if pod.Spec.TerminationGracePeriodSeconds != nil || pod.Spec.Containers[0].Lifecycle != nil {
+		t.Errorf("expected the default shutdown without max task duration")
+	}
+	if worker.GetDrainTimeout() != 0 {
+		t.Errorf("expected draining to be disabled, got %v", worker.GetDrainTimeout())
+	}
+
+	worker.Spec.MaxTaskDuration = &metav1.Duration{Duration: 10 * time.Minute}
+	pod = worker.generatePod()
+	if pod.Spec.TerminationGracePeriodSeconds == nil || *pod.Spec.TerminationGracePeriodSeconds != 630 {
+		t.Errorf("expected the grace period of 630s, got %v", pod.Spec.TerminationGracePeriodSeconds)
+	}
+	// The warm shutdown is started by the SIGTERM of kubelet to celery
+	if lifecycle := pod.Spec.Containers[0].Lifecycle; lifecycle != nil {
+		t.Errorf("expected no hook to signal celery again, got %v", lifecycle)
+	}
+	worker.Spec.Config = map[string]apiextensionsv1.JSON{"task_acks_late": {Raw: []byte(`true`)}}
+	command := worker.generatePod().Spec.Containers[0].Command
+	if len(command) < 3 || command[0] != "sh" || !strings.HasSuffix(command[2], `exec "$@"`) {
+		t.Errorf("expected celery to be exec'd as PID 1, got %v", command)
+	}
+	if worker.GetDrainTimeout() != 10*time.Minute {
+		t.Errorf("expected the drain timeout to follow max task duration, got %v", worker.GetDrainTimeout())
+	}
+}
+
+func TestGetWorkerNodeName(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "celery-worker-abcde"}}
+	if name := GetWorkerNodeName(pod); name != "celery@celery-worker-abcde" {
+		t.Errorf("unexpected node name %q", name)
+	}
+	pod.Spec.Hostname = "worker"
+	if name := GetWorkerNodeName(pod); name != "celery@worker" {
+		t.Errorf("unexpected node name %q", name)
+	}
+}
+
+func TestConcurrencyLeftOutOfSpecHash(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+	maxMemory := resource.MustParse("256Mi")
+	cases := map[string]struct {
+		spec       CeleryWorkerSpec
+		keepsPods  bool
+		resizeable bool
+	}{
+		"prefork": {
+			spec:       CeleryWorkerSpec{Resources: newResources("2", "")},
+			keepsPods:  true,
+			resizeable: true,
+		},
+		"prefork with max memory per child": {
+			spec:       CeleryWorkerSpec{Resources: newResources("2", "1Gi"), MaxMemoryPerChild: &maxMemory},
+			keepsPods:  true,
+			resizeable: true,
+		},
+		"prefork with derived max memory per child": {
+			spec:       CeleryWorkerSpec{Resources: newResources("2", "1Gi")},
+			keepsPods:  true,
+			resizeable: true,
+		},
+		"threads": {
+			spec: CeleryWorkerSpec{Pool: ThreadsPool, Resources: newResources("2", "1Gi")},
+		},
+		"autoscale": {
+			spec: CeleryWorkerSpec{
+				Resources: newResources("2", "1Gi"),
+				Autoscale: &WorkerPoolAutoscale{MinConcurrency: 1, MaxConcurrency: 4},
+			},
+		},
+	}
+	for name, c := range cases {
+		c.spec.AppName = "app"
+		worker := &CeleryWorker{Spec: c.spec}
+		if worker.IsPoolResizable() != c.resizeable {
+			t.Errorf("%s: expected the pool resizable to be %v", name, c.resizeable)
+		}
+		hash := worker.GetSpecHash()
+		worker.Spec.Concurrency = int32Ptr(8)
+		if keepsPods := worker.GetSpecHash() == hash; keepsPods != c.keepsPods {
+			t.Errorf("%s: expected the pods kept to be %v after the concurrency is changed", name, c.keepsPods)
+		}
+	}
+}
+
+func TestRemoveCommandOptions(t *testing.T) {
+	command := []string{"celery", "worker", "--concurrency", "2", "--max-memory-per-child", "1024", "--loglevel", "INFO"}
+	actual := removeCommandOptions(command, "--concurrency", "--max-memory-per-child")
+	expected := []string{"celery", "worker", "--loglevel", "INFO"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestBrokerURLSecret(t *testing.T) {
+	worker := &CeleryWorker{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "default"},
+		Spec: CeleryWorkerSpec{
+			AppName:       "app",
+			BrokerAddress: "redis://:password@redis:6379/0",
+		},
+	}
+	secret := worker.GenerateBrokerURLSecret()
+	if secret == nil || secret.Name != "worker-broker-url" || string(secret.Data[BrokerURLKey]) != worker.Spec.BrokerAddress {
+		t.Fatalf("expected the plain address to be kept in worker-broker-url, got %v", secret)
+	}
+	pod := worker.generatePod()
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Value != "" || env[0].ValueFrom == nil || env[0].ValueFrom.SecretKeyRef.Name != "worker-broker-url" {
+		t.Errorf("expected the broker url to be read from the secret, got %v", env)
+	}
+	if pod.Annotations[BrokerAddressHashAnnotation] != HashBrokerAddress(worker.Spec.BrokerAddress) {
+		t.Errorf("expected the hash of the address to roll out the pods, got %v", pod.Annotations)
+	}
+
+	worker.Spec.BrokerAddressSecretRef = &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "broker"},
+		Key:                  "url",
+	}
+	if secret := worker.GenerateBrokerURLSecret(); secret != nil {
+		t.Errorf("expected no secret if the address is read from a secret, got %v", secret)
+	}
+	if env := worker.generatePod().Spec.Containers[0].Env; env[0].ValueFrom.SecretKeyRef.Name != "broker" {
+		t.Errorf("expected the broker url to be read from the given secret, got %v", env)
+	}
+}
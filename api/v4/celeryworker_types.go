@@ -18,7 +18,10 @@ package v4
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -26,24 +29,187 @@ import (
 
 // CeleryWorkerSpec defines the desired state of CeleryWorker
 type CeleryWorkerSpec struct {
-	// DesiredNumber defines the number of worker if autoscaling is disabled
+	// DesiredNumber defines the number of worker if autoscaling is disabled.
+	// It can be changed through the scale subresource, e.g. kubectl scale
 	Replicas int `json:"replicas,omitempty"`
 	// Target Queues defines the target queues these workers will handle
 	TargetQueues []string `json:"targetQueues,omitempty"`
-	// Resources defines the resources specification for these workers
+	// Resources defines the resources specification for these workers.
+	// The concurrency and max memory per child are derived from the limits if they are not set
 	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Pool defines the execution pool of the workers. Defaults to prefork
+	Pool WorkerPoolType `json:"pool,omitempty"`
+	// Concurrency defines the number of child processes or threads of each worker.
+	// Defaults to the cpu limit, or the cpu request if there is no limit, for the prefork and threads pools.
+	// The prefork pools without autoscale are resized live, so the running workers are not restarted,
+	// unless the max memory per child is derived from the memory limit and changes with the concurrency
+	// +kubebuilder:validation:Minimum=1
+	Concurrency *int32 `json:"concurrency,omitempty"`
+	// Autoscale defines the range the worker grows and shrinks its pool in. It takes precedence over concurrency.
+	// It is different from Autoscaling, which changes the number of workers
+	Autoscale *WorkerPoolAutoscale `json:"autoscale,omitempty"`
+	// MaxTasksPerChild defines the number of tasks a child process executes before it is replaced
+	// +kubebuilder:validation:Minimum=1
+	MaxTasksPerChild *int32 `json:"maxTasksPerChild,omitempty"`
+	// MaxMemoryPerChild defines the resident memory a child process can use before it is replaced, e.g. 512Mi.
+	// Defaults to 75% of the memory limit of the prefork pool shared by a child per cpu, or by the max concurrency
+	// of autoscale. It does not follow the concurrency, so it should be set if the concurrency exceeds the cpus
+	MaxMemoryPerChild *resource.Quantity `json:"maxMemoryPerChild,omitempty"`
+	// PrefetchMultiplier defines the number of messages prefetched by each process. 0 means unlimited
+	// +kubebuilder:validation:Minimum=0
+	PrefetchMultiplier *int32 `json:"prefetchMultiplier,omitempty"`
+	// LogLevel defines the log level of the workers
+	LogLevel LogLevel `json:"logLevel,omitempty"`
 	// AppName defines the target app instance to use
-	AppName       string `json:"appName,omitempty"`
+	AppName string `json:"appName,omitempty"`
+	// BrokerAddress defines the broker url. It is passed to the pods through the secret <name>-broker-url
 	BrokerAddress string `json:"brokerAddress,omitempty"`
 	Image         string `json:"image,omitempty"`
+	// PodTemplate defines the pod template of the workers, e.g. env, volumes, tolerations and sidecars.
+	// The container celery-worker is merged with the image, command and resources generated by the operator
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// CeleryVersion defines the celery version in the image, e.g. 4 or 5.2.
+	// Celery 5 requires the global options before the subcommand. Defaults to 4
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)*$`
+	CeleryVersion string `json:"celeryVersion,omitempty"`
+	// BrokerAddressSecretRef refers to the secret keeping the broker url.
+	// It takes precedence over BrokerAddress
+	BrokerAddressSecretRef *corev1.SecretKeySelector `json:"brokerAddressSecretRef,omitempty"`
+	// BrokerAddressHash defines the hash of the broker url in the secret.
+	// The pods are rolled out when it is changed, so the rotated credentials are picked up
+	BrokerAddressHash string `json:"brokerAddressHash,omitempty"`
+	// BrokerTransportOptions defines the broker_transport_options, e.g. master_name for sentinel.
+	// They are applied to the app by the config module in <name>-config, and the ones of the same keys
+	// in config.broker_transport_options take precedence
+	BrokerTransportOptions map[string]string `json:"brokerTransportOptions,omitempty"`
+	// ResultBackend defines the result backend the task results are stored to
+	ResultBackend *ResultBackendReference `json:"resultBackend,omitempty"`
+	// Config defines the celery settings in lowercase, e.g. worker_prefetch_multiplier, task_acks_late,
+	// task_time_limit, timezone and task_routes. It is rendered into the config map <name>-config
+	// and applied on top of the config of the app, so the pods are rolled out after it is changed
+	Config map[string]apiextensionsv1.JSON `json:"config,omitempty"`
+	// MaxTaskDuration defines the longest time a task runs. The workers are drained before scaling down
+	// and rollout, and the pods are given the time to finish their tasks in the warm shutdown
+	MaxTaskDuration *metav1.Duration `json:"maxTaskDuration,omitempty"`
+	// DrainTimeout defines how long the workers are drained before they are deleted. Defaults to MaxTaskDuration.
+	// The drained workers stop consuming the queues and are deleted once they have no task left
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+	// RollingUpdate defines how the outdated workers are replaced after a spec update
+	RollingUpdate *RollingUpdateStrategy `json:"rollingUpdate,omitempty"`
+	// Autoscaling defines the scaling of workers based on the queue depth in broker.
+	// Replicas will be ignored if it is set
+	Autoscaling *CeleryWorkerAutoscaling `json:"autoscaling,omitempty"`
+}
+
+// CeleryWorkerAutoscaling defines the scaling policy based on the pending messages
+type CeleryWorkerAutoscaling struct {
+	// MinReplicas defines the lower limit of the number of workers. Defaults to 1
+	// +kubebuilder:validation:Minimum=0
+	MinReplicas *int `json:"minReplicas,omitempty"`
+	// MaxReplicas defines the upper limit of the number of workers
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int `json:"maxReplicas"`
+	// TargetMessagesPerWorker defines the number of pending messages each worker should handle.
+	// The messages waiting in the target queues and the ones prefetched or executed by the workers are counted.
+	// The workers not replying to the inspection, e.g. the ones blocked by a task in the solo pool, are not counted
+	// +kubebuilder:validation:Minimum=1
+	TargetMessagesPerWorker int `json:"targetMessagesPerWorker"`
+	// ScaleUpCooldownSeconds defines the minimum seconds between two scaling up. Defaults to 30
+	ScaleUpCooldownSeconds *int `json:"scaleUpCooldownSeconds,omitempty"`
+	// ScaleDownCooldownSeconds defines the minimum seconds between two scaling down. Defaults to 300
+	ScaleDownCooldownSeconds *int `json:"scaleDownCooldownSeconds,omitempty"`
+}
+
+// WorkerPoolType is the execution pool of the celery worker
+// +kubebuilder:validation:Enum=prefork;eventlet;gevent;solo;threads
+type WorkerPoolType string
+
+const (
+	// PreforkPool runs the tasks in child processes
+	PreforkPool WorkerPoolType = "prefork"
+	// EventletPool runs the tasks in green threads of eventlet
+	EventletPool WorkerPoolType = "eventlet"
+	// GeventPool runs the tasks in green threads of gevent
+	GeventPool WorkerPoolType = "gevent"
+	// SoloPool runs the tasks in the worker process one by one
+	SoloPool WorkerPoolType = "solo"
+	// ThreadsPool runs the tasks in a thread pool
+	ThreadsPool WorkerPoolType = "threads"
+)
+
+// LogLevel is the log level of celery
+// +kubebuilder:validation:Enum=DEBUG;INFO;WARNING;ERROR;CRITICAL
+type LogLevel string
+
+// WorkerPoolAutoscale defines the range of processes in the pool of each worker
+type WorkerPoolAutoscale struct {
+	// MinConcurrency defines the number of processes kept when the worker is idle
+	// +kubebuilder:validation:Minimum=0
+	MinConcurrency int32 `json:"minConcurrency,omitempty"`
+	// MaxConcurrency defines the upper limit of the processes
+	// +kubebuilder:validation:Minimum=1
+	MaxConcurrency int32 `json:"maxConcurrency"`
+}
+
+// RollingUpdateStrategy defines the limits of replacing the outdated pods
+type RollingUpdateStrategy struct {
+	// MaxUnavailable defines the maximum number of pods that can be unavailable during the update.
+	// The value can be an absolute number or a percentage of the desired pods. Defaults to 25%.
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// MaxSurge defines the maximum number of pods that can be created over the desired pods.
+	// The value can be an absolute number or a percentage of the desired pods. Defaults to 25%.
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
 }
 
 // CeleryWorkerStatus defines the observed state of CeleryWorker
 type CeleryWorkerStatus struct {
+	ReplicaStatus `json:",inline"`
+	// Autoscaling defines the latest observation and decision of the autoscaler
+	Autoscaling *CeleryWorkerAutoscalingStatus `json:"autoscaling,omitempty"`
+	// Concurrency defines the concurrency of the prefork pools, which are resized without restarting the workers
+	Concurrency *CeleryWorkerConcurrencyStatus `json:"concurrency,omitempty"`
+}
+
+// CeleryWorkerConcurrencyStatus defines the concurrency observed in the workers
+type CeleryWorkerConcurrencyStatus struct {
+	// Desired defines the concurrency the pools are resized to
+	Desired int32 `json:"desired"`
+	// Workers defines the effective concurrency reported by each worker
+	Workers []WorkerConcurrency `json:"workers,omitempty"`
+	// LastCheckTime defines the last time the workers have been inspected
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// WorkerConcurrency defines the number of processes in the pool of a worker
+type WorkerConcurrency struct {
+	// Pod defines the name of the worker pod
+	Pod string `json:"pod"`
+	// Concurrency defines the number of processes reported by the worker
+	Concurrency int32 `json:"concurrency"`
+	// Pending defines the concurrency the pool is being resized to. It is only reported in Concurrency
+	// after a later inspection of the worker confirms it
+	Pending int32 `json:"pending,omitempty"`
+}
+
+// CeleryWorkerAutoscalingStatus defines the observed state of the autoscaler
+type CeleryWorkerAutoscalingStatus struct {
+	// DesiredReplicas defines the number of workers decided by the autoscaler
+	DesiredReplicas int `json:"desiredReplicas"`
+	// QueueDepths defines the number of pending messages in each target queue
+	QueueDepths map[string]int64 `json:"queueDepths,omitempty"`
+	// UnackedMessages defines the number of messages prefetched or being executed by the workers
+	UnackedMessages int64 `json:"unackedMessages,omitempty"`
+	// LastCheckTime defines the last time the queue depths have been checked
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+	// LastScaleTime defines the last time the number of workers has been changed
+	LastScaleTime *metav1.Time `json:"lastScaleTime,omitempty"`
+	// Message defines the reason of the latest scaling decision
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 
 // CeleryWorker is the Schema for the celeryworkers API
 type CeleryWorker struct {
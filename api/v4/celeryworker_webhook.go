@@ -0,0 +1,86 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var celeryworkerlog = logf.Log.WithName("celeryworker-resource")
+
+func (r *CeleryWorker) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-celery-celeryproject-org-v4-celeryworker,mutating=true,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeryworkers,verbs=create;update,versions=v4,name=mceleryworker.kb.io
+
+var _ webhook.Defaulter = &CeleryWorker{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// The replicas are only defaulted on creation, so the workers can still be scaled to zero.
+// The workers of a Celery have been defaulted through their pools.
+func (r *CeleryWorker) Default() {
+	celeryworkerlog.Info("default", "name", r.Name)
+
+	if r.ResourceVersion == "" && metav1.GetControllerOf(r) == nil && r.Spec.Replicas == 0 {
+		r.Spec.Replicas = 1
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-celery-celeryproject-org-v4-celeryworker,mutating=false,failurePolicy=fail,groups=celery.celeryproject.org,resources=celeryworkers,versions=v4,name=vceleryworker.kb.io
+
+var _ webhook.Validator = &CeleryWorker{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryWorker) ValidateCreate() error {
+	celeryworkerlog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryWorker) ValidateUpdate(old runtime.Object) error {
+	celeryworkerlog.Info("validate update", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *CeleryWorker) ValidateDelete() error {
+	return nil
+}
+
+func (r *CeleryWorker) validate() error {
+	specPath := field.NewPath("spec")
+	allErrs := validateWorkerSpec(&r.Spec, specPath)
+	if r.Spec.Image == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("image"), "the image of celery worker is required"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("CeleryWorker").GroupKind(), r.Name, allErrs)
+}
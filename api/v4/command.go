@@ -0,0 +1,106 @@
+package v4
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// celeryGlobalOptions are the options taking a value which belong to the celery command
+// instead of the subcommand. Celery 5 only accepts them before the subcommand.
+var celeryGlobalOptions = map[string]bool{
+	"-A":               true,
+	"--app":            true,
+	"-b":               true,
+	"--broker":         true,
+	"--result-backend": true,
+	"--loader":         true,
+	"--config":         true,
+	"--workdir":        true,
+}
+
+// celeryCommand is the parsed command line of celery
+type celeryCommand struct {
+	global     []string
+	subcommand string
+	args       []string
+	// globalFirst is true if all global options are placed before the subcommand
+	globalFirst bool
+}
+
+// IsCelery5 checks whether the version uses the command line of celery 5 or above
+func IsCelery5(version string) bool {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return err == nil && major >= 5
+}
+
+// buildCeleryCommand generates the command line in the style of the celery version
+func buildCeleryCommand(version string, subcommand string, global []string, args []string) []string {
+	command := []string{"celery"}
+	if IsCelery5(version) {
+		command = append(command, global...)
+		command = append(command, subcommand)
+	} else {
+		command = append(command, subcommand)
+		command = append(command, global...)
+	}
+	return append(command, args...)
+}
+
+// removeCommandOptions drops the options and their values from the command line
+func removeCommandOptions(command []string, options ...string) []string {
+	removed := make(map[string]bool, len(options))
+	for _, option := range options {
+		removed[option] = true
+	}
+	result := make([]string, 0, len(command))
+	for i := 0; i < len(command); i++ {
+		if removed[command[i]] {
+			i++
+			continue
+		}
+		result = append(result, command[i])
+	}
+	return result
+}
+
+// parseCeleryCommand splits the command line into the global options, subcommand and its arguments
+func parseCeleryCommand(command []string) celeryCommand {
+	parsed := celeryCommand{globalFirst: true}
+	if len(command) == 0 || command[0] != "celery" {
+		parsed.args = command
+		return parsed
+	}
+	for i := 1; i < len(command); i++ {
+		arg := command[i]
+		name := strings.SplitN(arg, "=", 2)[0]
+		switch {
+		case celeryGlobalOptions[name]:
+			if parsed.subcommand != "" {
+				parsed.globalFirst = false
+			}
+			parsed.global = append(parsed.global, arg)
+			if name == arg && i+1 < len(command) {
+				i++
+				parsed.global = append(parsed.global, command[i])
+			}
+		case parsed.subcommand == "" && !strings.HasPrefix(arg, "-"):
+			parsed.subcommand = arg
+		default:
+			parsed.args = append(parsed.args, arg)
+		}
+	}
+	return parsed
+}
+
+// isCommandUpToDate compares the command lines regardless of their styles.
+// Celery 4 accepts both styles while celery 5 requires the global options first.
+func isCommandUpToDate(version string, actual []string, expected []string) bool {
+	actualCommand, expectedCommand := parseCeleryCommand(actual), parseCeleryCommand(expected)
+	if IsCelery5(version) && !actualCommand.globalFirst {
+		return false
+	}
+	return actualCommand.subcommand == expectedCommand.subcommand &&
+		reflect.DeepEqual(actualCommand.global, expectedCommand.global) &&
+		reflect.DeepEqual(actualCommand.args, expectedCommand.args)
+}
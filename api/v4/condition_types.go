@@ -0,0 +1,60 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType defines the type of a condition reported in the status
+type ConditionType string
+
+const (
+	// BrokerReady is true when the broker of a Celery stack can accept connections
+	BrokerReady ConditionType = "BrokerReady"
+	// ResultBackendReady is true when the result backend of a Celery stack is resolved and ready
+	ResultBackendReady ConditionType = "ResultBackendReady"
+	// WorkersAvailable is true when all the desired workers of a Celery stack are ready
+	WorkersAvailable ConditionType = "WorkersAvailable"
+	// SchedulersAvailable is true when all the desired schedulers of a Celery stack are ready
+	SchedulersAvailable ConditionType = "SchedulersAvailable"
+	// Scheduled is true when the periodic task is rendered into the beat schedule of its scheduler
+	Scheduled ConditionType = "Scheduled"
+	// Available is true when all the desired pods are ready
+	Available ConditionType = "Available"
+	// Progressing is true when the pods are being created, deleted or replaced
+	Progressing ConditionType = "Progressing"
+	// Degraded is true when some pods cannot run, e.g. CrashLoopBackOff or Unschedulable
+	Degraded ConditionType = "Degraded"
+	// ScalingActive is true when the autoscaler of the workers can read the queue depths from the broker
+	ScalingActive ConditionType = "ScalingActive"
+	// PoolResized is true when the pools of the running workers are resized to the desired concurrency
+	PoolResized ConditionType = "PoolResized"
+)
+
+// Condition defines an observation of the object state
+type Condition struct {
+	Type   ConditionType          `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// LastTransitionTime is the last time the status has been changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a one-word CamelCase reason of the last transition
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable message of the last transition
+	Message string `json:"message,omitempty"`
+}
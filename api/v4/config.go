@@ -0,0 +1,191 @@
+package v4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConfigHashAnnotation records the hash of the rendered celery config, so the pods are rolled out after it is changed
+const ConfigHashAnnotation = "celery.celeryproject.org/config-hash"
+
+// configDir is where the config map with the rendered celery config is mounted
+const configDir = "/etc/celery-config"
+
+// configModule wraps the app of the spec and applies the rendered config on top of its own config
+const configModule = "celery_operator_config"
+
+// configFile is the key of the rendered celery config in the config map
+const configFile = "celery_config.json"
+
+// configShim loads the app like -A does and updates its config, so the settings of the spec take precedence
+// over the ones of the app
+const configShim = `import json
+import os
+
+from celery.app.utils import find_app
+
+app = find_app(os.environ["CELERY_OPERATOR_APP"])
+
+with open(os.path.join(os.path.dirname(os.path.abspath(__file__)), "celery_config.json")) as f:
+    app.conf.update(json.load(f))
+`
+
+// MergeConfig returns the base config with the keys of the override replaced
+func MergeConfig(base map[string]apiextensionsv1.JSON, override map[string]apiextensionsv1.JSON) map[string]apiextensionsv1.JSON {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	merged := make(map[string]apiextensionsv1.JSON, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = *value.DeepCopy()
+	}
+	for key, value := range override {
+		merged[key] = *value.DeepCopy()
+	}
+	return merged
+}
+
+// buildAppConfig returns the settings applied to the app by the shim, which are the config, the transport options
+// and the result expiry. Celery does not read them from environment, e.g. master_name of sentinel,
+// so the shim is mounted for them even if the config is not set.
+func buildAppConfig(config map[string]apiextensionsv1.JSON, brokerTransportOptions map[string]string, resultBackend *ResultBackendReference) map[string]apiextensionsv1.JSON {
+	settings := map[string]apiextensionsv1.JSON{}
+	addTransportOptions(settings, config, "broker_transport_options", brokerTransportOptions)
+	if resultBackend != nil {
+		addTransportOptions(settings, config, "result_backend_transport_options", resultBackend.TransportOptions)
+		if _, ok := config["result_expires"]; !ok && resultBackend.Expires != nil {
+			settings["result_expires"] = apiextensionsv1.JSON{Raw: []byte(strconv.FormatInt(int64(resultBackend.Expires.Seconds()), 10))}
+		}
+	}
+	return MergeConfig(config, settings)
+}
+
+// addTransportOptions sets the transport options passed by the operator to the settings.
+// The options of the same setting in the config take precedence over them.
+func addTransportOptions(settings map[string]apiextensionsv1.JSON, config map[string]apiextensionsv1.JSON, key string, transportOptions map[string]string) {
+	if len(transportOptions) == 0 {
+		return
+	}
+	options := make(map[string]json.RawMessage, len(transportOptions))
+	for name, value := range transportOptions {
+		options[name], _ = json.Marshal(value)
+	}
+	if value, ok := config[key]; ok {
+		overrides := map[string]json.RawMessage{}
+		if err := json.Unmarshal(value.Raw, &overrides); err != nil {
+			// The setting of the config is kept as it is if it is not an object
+			return
+		}
+		for name, override := range overrides {
+			options[name] = override
+		}
+	}
+	data, _ := json.Marshal(options)
+	settings[key] = apiextensionsv1.JSON{Raw: data}
+}
+
+// getDefaultQueue returns the queue consumed by the workers without target queues, i.e. task_default_queue of the config
+func getDefaultQueue(config map[string]apiextensionsv1.JSON) string {
+	if value, ok := config["task_default_queue"]; ok {
+		var queue string
+		if err := json.Unmarshal(value.Raw, &queue); err == nil && queue != "" {
+			return queue
+		}
+	}
+	return "celery"
+}
+
+// renderConfig serializes the celery settings into a json object with the keys sorted
+func renderConfig(config map[string]apiextensionsv1.JSON) (string, error) {
+	settings := make(map[string]json.RawMessage, len(config))
+	for key, value := range config {
+		compacted := &bytes.Buffer{}
+		if err := json.Compact(compacted, value.Raw); err != nil {
+			return "", err
+		}
+		settings[key] = compacted.Bytes()
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// hashConfig returns the short hash of the rendered config and the shim
+func hashConfig(config map[string]apiextensionsv1.JSON) string {
+	data, _ := renderConfig(config)
+	hash := sha256.Sum256([]byte(data + configShim))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// generateConfigMap renders the celery settings and the shim applying them into a config map
+func generateConfigMap(name string, namespace string, labels map[string]string, config map[string]apiextensionsv1.JSON) (*corev1.ConfigMap, error) {
+	data, err := renderConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Data: map[string]string{
+			configFile:           data,
+			configModule + ".py": configShim,
+		},
+	}, nil
+}
+
+// getConfigApp returns the app passed to -A, which is the shim if the config is set
+func getConfigApp(appName string, config map[string]apiextensionsv1.JSON) string {
+	if len(config) == 0 {
+		return appName
+	}
+	return configModule + ":app"
+}
+
+// pythonPathScript adds the directories to the python path without dropping the one of the image
+func pythonPathScript(dirs ...string) string {
+	return `PYTHONPATH="` + strings.Join(dirs, ":") + `${PYTHONPATH:+:$PYTHONPATH}" exec "$@"`
+}
+
+// addConfigVolume mounts the rendered config to the celery container and passes the app wrapped by the shim
+func addConfigVolume(template *corev1.PodTemplateSpec, containerName string, configMapName string, config map[string]apiextensionsv1.JSON, appName string) {
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[ConfigHashAnnotation] = hashConfig(config)
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: "celery-config",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		},
+	})
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != containerName {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "celery-config",
+			MountPath: configDir,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "CELERY_OPERATOR_APP",
+			Value: appName,
+		})
+	}
+}
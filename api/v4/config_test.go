@@ -0,0 +1,162 @@
+package v4
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestMergeConfig(t *testing.T) {
+	base := map[string]apiextensionsv1.JSON{
+		"task_acks_late":             {Raw: []byte(`true`)},
+		"worker_prefetch_multiplier": {Raw: []byte(`4`)},
+	}
+	override := map[string]apiextensionsv1.JSON{
+		"worker_prefetch_multiplier": {Raw: []byte(`1`)},
+	}
+	merged := MergeConfig(base, override)
+	rendered, err := renderConfig(merged)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "{\n  \"task_acks_late\": true,\n  \"worker_prefetch_multiplier\": 1\n}"
+	if rendered != expected {
+		t.Errorf("expected %q, got %q", expected, rendered)
+	}
+	if string(base["worker_prefetch_multiplier"].Raw) != "4" {
+		t.Errorf("expected the base config to be kept, got %s", base["worker_prefetch_multiplier"].Raw)
+	}
+	if MergeConfig(nil, nil) != nil {
+		t.Errorf("expected no config without both base and override")
+	}
+}
+
+func TestWorkerConfig(t *testing.T) {
+	worker := &CeleryWorker{
+		ObjectMeta: metav1.ObjectMeta{Name: "celery-worker", Namespace: "default"},
+		Spec: CeleryWorkerSpec{
+			Image:   "celery:4",
+			AppName: "app",
+		},
+	}
+	unconfigured := worker.generatePod()
+	if _, ok := unconfigured.Annotations[ConfigHashAnnotation]; ok {
+		t.Errorf("expected no config hash without config, got %v", unconfigured.Annotations)
+	}
+	if configMap, _ := worker.GenerateConfigMap(); configMap != nil {
+		t.Errorf("expected no config map without config")
+	}
+
+	worker.Spec.Config = map[string]apiextensionsv1.JSON{"task_acks_late": {Raw: []byte(`true`)}}
+	pod := worker.generatePod()
+	command := strings.Join(pod.Spec.Containers[0].Command, " ")
+	if !strings.HasPrefix(command, "sh -c") || !strings.Contains(command, "-A "+configModule+":app") {
+		t.Errorf("expected the app to be wrapped by the config module, got %q", command)
+	}
+	hash := pod.Annotations[ConfigHashAnnotation]
+	if hash == "" {
+		t.Fatalf("expected the config hash on pod, got %v", pod.Annotations)
+	}
+	configMap, err := worker.GenerateConfigMap()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if configMap.Name != "celery-worker-config" || configMap.Data[configFile] != "{\n  \"task_acks_late\": true\n}" {
+		t.Errorf("unexpected config map %v", configMap)
+	}
+
+	worker.Spec.Config["task_acks_late"] = apiextensionsv1.JSON{Raw: []byte(`false`)}
+	if worker.generatePod().Annotations[ConfigHashAnnotation] == hash {
+		t.Errorf("expected the config hash to change with the config")
+	}
+}
+
+// getRenderedSetting returns the setting in the rendered config loaded by the shim
+func getRenderedSetting(t *testing.T, configMap *corev1.ConfigMap, key string) interface{} {
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(configMap.Data[configFile]), &settings); err != nil {
+		t.Fatalf("failed to parse the rendered config: %v", err)
+	}
+	return settings[key]
+}
+
+func TestBrokerTransportOptionsConfig(t *testing.T) {
+	worker := &CeleryWorker{
+		ObjectMeta: metav1.ObjectMeta{Name: "celery-worker", Namespace: "default"},
+		Spec: CeleryWorkerSpec{
+			Image:                  "celery:4",
+			AppName:                "app",
+			BrokerAddress:          "sentinel://celery-broker-sentinel:26379",
+			BrokerTransportOptions: map[string]string{"master_name": "mymaster"},
+		},
+	}
+	// Celery does not read the transport options from environment, so they are applied by the shim without config
+	pod := worker.generatePod()
+	container := pod.Spec.Containers[0]
+	command := strings.Join(container.Command, " ")
+	if !strings.HasPrefix(command, "sh -c") || !strings.Contains(command, "-A "+configModule+":app") {
+		t.Errorf("expected the app to be wrapped by the config module, got %q", command)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != configDir {
+		t.Errorf("expected the config module to be mounted, got %v", container.VolumeMounts)
+	}
+	for _, env := range container.Env {
+		if env.Name == "CELERY_BROKER_TRANSPORT_OPTIONS" {
+			t.Errorf("expected the transport options not to be passed in environment")
+		}
+	}
+	configMap, err := worker.GenerateConfigMap()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if configMap == nil {
+		t.Fatalf("expected the config map for the transport options")
+	}
+	expected := map[string]interface{}{"master_name": "mymaster"}
+	if options := getRenderedSetting(t, configMap, "broker_transport_options"); !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected the transport options %v, got %v", expected, options)
+	}
+
+	// The transport options of config are merged, and take precedence over the ones of operator
+	worker.Spec.Config = map[string]apiextensionsv1.JSON{
+		"broker_transport_options": {Raw: []byte(`{"visibility_timeout": 3600, "master_name": "other"}`)},
+	}
+	configMap, _ = worker.GenerateConfigMap()
+	expected = map[string]interface{}{"master_name": "other", "visibility_timeout": float64(3600)}
+	if options := getRenderedSetting(t, configMap, "broker_transport_options"); !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected the transport options %v, got %v", expected, options)
+	}
+
+	scheduler := &CeleryScheduler{
+		ObjectMeta: metav1.ObjectMeta{Name: "celery-scheduler", Namespace: "default"},
+		Spec: CelerySchedulerSpec{
+			Image:                  "celery:4",
+			AppName:                "app",
+			BrokerTransportOptions: map[string]string{"master_name": "mymaster"},
+		},
+	}
+	if configMap, _ := scheduler.GenerateConfigMap(); configMap == nil || !strings.Contains(configMap.Data[configFile], "mymaster") {
+		t.Errorf("expected the transport options in the config of scheduler, got %v", configMap)
+	}
+	if command := strings.Join(scheduler.getCommand(), " "); !strings.Contains(command, "-A "+configModule+":app") {
+		t.Errorf("expected the app of scheduler to be wrapped by the config module, got %q", command)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := map[string]apiextensionsv1.JSON{
+		"task_acks_late": {Raw: []byte(`true`)},
+		"BROKER_URL":     {Raw: []byte(`"redis://"`)},
+		"result_backend": {Raw: []byte(`"redis://"`)},
+	}
+	errs := validateConfig(config, field.NewPath("spec", "config"))
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+}
@@ -0,0 +1,163 @@
+package v4
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Crontab is a parsed cron expression. Each field keeps the set of the allowed values.
+// +kubebuilder:object:generate=false
+type Crontab struct {
+	Minute      string
+	Hour        string
+	DayOfMonth  string
+	MonthOfYear string
+	DayOfWeek   string
+
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+}
+
+type crontabField struct {
+	name string
+	min  int
+	max  int
+}
+
+var crontabFields = []crontabField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCrontab parses the expression "<minute> <hour> <day of month> <month> <day of week>".
+// The fields support *, lists, ranges and steps, e.g. "0,30 9-17 * * 1-5" or "*/15 * * * *".
+// Sunday can be written as 0 or 7.
+func ParseCrontab(expression string) (*Crontab, error) {
+	parts := strings.Fields(expression)
+	if len(parts) != len(crontabFields) {
+		return nil, fmt.Errorf("expected %d fields but got %d", len(crontabFields), len(parts))
+	}
+	sets := make([]map[int]bool, len(parts))
+	for i, part := range parts {
+		set, err := parseCrontabField(part, crontabFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+		delete(sets[4], 7)
+	}
+	return &Crontab{
+		Minute:      parts[0],
+		Hour:        parts[1],
+		DayOfMonth:  parts[2],
+		MonthOfYear: parts[3],
+		DayOfWeek:   parts[4],
+		minutes:     sets[0],
+		hours:       sets[1],
+		daysOfMonth: sets[2],
+		months:      sets[3],
+		daysOfWeek:  sets[4],
+	}, nil
+}
+
+func parseCrontabField(value string, field crontabField) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, item := range strings.Split(value, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			rangePart = item[:i]
+			parsed, err := strconv.Atoi(item[i+1:])
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid step %q in %s", item[i+1:], field.name)
+			}
+			step = parsed
+		}
+		start, end := field.min, field.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q in %s", bounds[0], field.name)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q in %s", bounds[1], field.name)
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end with the step of 15
+				end = field.max
+			}
+		}
+		if start < field.min || end > field.max || start > end {
+			return nil, fmt.Errorf("%s should be between %d and %d but got %q", field.name, field.min, field.max, item)
+		}
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matchesDay checks both the day of month and the day of week like celery crontab does
+func (c *Crontab) matchesDay(t time.Time) bool {
+	return c.months[int(t.Month())] && c.daysOfMonth[t.Day()] && c.daysOfWeek[int(t.Weekday())]
+}
+
+// crontabSearchLimit stops searching the schedules which never match, e.g. 30 February
+const crontabSearchLimit = 5 * 366 * 24 * time.Hour
+
+// Next returns the first time matching the crontab after t, or zero time if there is none
+func (c *Crontab) Next(t time.Time) time.Time {
+	limit := t.Add(crontabSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Prev returns the last time matching the crontab not after t, or zero time if there is none
+func (c *Crontab) Prev(t time.Time) time.Time {
+	limit := t.Add(-crontabSearchLimit)
+	t = t.Truncate(time.Minute)
+	for t.After(limit) {
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(-time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
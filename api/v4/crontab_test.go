@@ -0,0 +1,245 @@
+package v4
+
+import (
+	"testing"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCrontabRunTimes(t *testing.T) {
+	now := time.Date(2020, time.August, 14, 10, 7, 30, 0, time.UTC) // Friday
+	cases := []struct {
+		expression string
+		prev       time.Time
+		next       time.Time
+	}{
+		{"*/15 * * * *", time.Date(2020, 8, 14, 10, 0, 0, 0, time.UTC), time.Date(2020, 8, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2020, 8, 14, 10, 0, 0, 0, time.UTC), time.Date(2020, 8, 14, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2020, 8, 9, 2, 30, 0, 0, time.UTC), time.Date(2020, 8, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 1,7 *", time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		crontab, err := ParseCrontab(c.expression)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", c.expression, err)
+		}
+		if prev := crontab.Prev(now); !prev.Equal(c.prev) {
+			t.Errorf("%q: expected previous run %v, got %v", c.expression, c.prev, prev)
+		}
+		if next := crontab.Next(now); !next.Equal(c.next) {
+			t.Errorf("%q: expected next run %v, got %v", c.expression, c.next, next)
+		}
+	}
+
+	crontab, _ := ParseCrontab("0 0 30 2 *")
+	if next := crontab.Next(now); !next.IsZero() {
+		t.Errorf("expected no run on 30 February, got %v", next)
+	}
+}
+
+func TestParseCrontabErrors(t *testing.T) {
+	for _, expression := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "* * 0 * *"} {
+		if _, err := ParseCrontab(expression); err == nil {
+			t.Errorf("%q: expected error", expression)
+		}
+	}
+}
+
+func TestPeriodicTaskIntervalDueTimes(t *testing.T) {
+	created := time.Date(2020, time.August, 14, 10, 0, 0, 0, time.UTC)
+	task := &CeleryPeriodicTask{
+		ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)},
+		Spec: CeleryPeriodicTaskSpec{
+			Task:     "proj.tasks.add",
+			Interval: &metav1.Duration{Duration: 10 * time.Minute},
+		},
+	}
+	// The runs of interval are not derived from the creation of the task
+	last, next, err := task.GetDueTimes(created.Add(25*time.Minute), time.UTC)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !last.IsZero() || !next.IsZero() {
+		t.Errorf("expected no due time of interval, got %v and %v", last, next)
+	}
+	task.Spec.Interval = &metav1.Duration{}
+	if _, _, err := task.GetDueTimes(created, time.UTC); err == nil {
+		t.Errorf("expected error without a positive interval")
+	}
+}
+
+func TestPeriodicTaskCrontabDueTimes(t *testing.T) {
+	task := &CeleryPeriodicTask{
+		Spec: CeleryPeriodicTaskSpec{
+			Task:    "proj.tasks.add",
+			Crontab: "0 9 * * *",
+		},
+	}
+	now := time.Date(2020, time.August, 14, 10, 0, 0, 0, time.UTC)
+	last, next, err := task.GetDueTimes(now, time.UTC)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !last.Equal(time.Date(2020, 8, 14, 9, 0, 0, 0, time.UTC)) || !next.Equal(time.Date(2020, 8, 15, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the runs at 9:00 UTC, got %v and %v", last, next)
+	}
+
+	scheduler := &CeleryScheduler{
+		Spec: CelerySchedulerSpec{
+			Config: map[string]apiextensionsv1.JSON{"timezone": {Raw: []byte(`"Asia/Hong_Kong"`)}},
+		},
+	}
+	location, err := scheduler.GetTimezone()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// 10:00 UTC is 18:00 in Hong Kong, so 9:00 was at 1:00 UTC
+	last, next, _ = task.GetDueTimes(now, location)
+	if !last.Equal(time.Date(2020, 8, 14, 1, 0, 0, 0, time.UTC)) || !next.Equal(time.Date(2020, 8, 15, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the runs at 9:00 in Hong Kong, got %v and %v", last, next)
+	}
+	if last.Location() != time.UTC {
+		t.Errorf("expected the due times in UTC, got %v", last.Location())
+	}
+}
+
+func TestSchedulerTimezone(t *testing.T) {
+	cases := []struct {
+		config   map[string]apiextensionsv1.JSON
+		expected string
+		invalid  bool
+	}{
+		{nil, "UTC", false},
+		{map[string]apiextensionsv1.JSON{"timezone": {Raw: []byte(`""`)}}, "UTC", false},
+		{map[string]apiextensionsv1.JSON{"timezone": {Raw: []byte(`"Europe/London"`)}}, "Europe/London", false},
+		{map[string]apiextensionsv1.JSON{"timezone": {Raw: []byte(`"Mars/Olympus"`)}}, "", true},
+		{map[string]apiextensionsv1.JSON{"timezone": {Raw: []byte(`8`)}}, "", true},
+	}
+	for _, c := range cases {
+		scheduler := &CeleryScheduler{Spec: CelerySchedulerSpec{Config: c.config}}
+		location, err := scheduler.GetTimezone()
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%v: expected error", c.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", c.config, err)
+		} else if location.String() != c.expected {
+			t.Errorf("%v: expected timezone %s, got %s", c.config, c.expected, location)
+		}
+	}
+}
+
+func TestPeriodicTaskValidate(t *testing.T) {
+	task := &CeleryPeriodicTask{
+		ObjectMeta: metav1.ObjectMeta{Name: "add", Namespace: "default"},
+		Spec: CeleryPeriodicTaskSpec{
+			Task:    "proj.tasks.add",
+			Args:    []apiextensionsv1.JSON{{Raw: []byte("1")}, {Raw: []byte(`"a"`)}},
+			Crontab: "*/5 * * * *",
+			Target:  PeriodicTaskTarget{Kind: CeleryTarget, Name: "celery", Pool: "1"},
+		},
+	}
+	if err := task.ValidateCreate(); err != nil {
+		t.Errorf("expected valid task, got %v", err)
+	}
+
+	invalid := task.DeepCopy()
+	invalid.Spec.Interval = &metav1.Duration{Duration: time.Minute}
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for both crontab and interval")
+	}
+	invalid = task.DeepCopy()
+	invalid.Spec.Crontab = "* * *"
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for invalid crontab")
+	}
+	invalid = task.DeepCopy()
+	invalid.Spec.Target.Kind = SchedulerTarget
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for pool of CeleryScheduler target")
+	}
+}
+
+func TestGenerateBeatSchedule(t *testing.T) {
+	scheduler := &CeleryScheduler{
+		ObjectMeta: metav1.ObjectMeta{Name: "beat", Namespace: "default"},
+		Spec:       CelerySchedulerSpec{Image: "celery:4", AppName: "app", SchedulerClass: "django_celery_beat.schedulers:DatabaseScheduler"},
+	}
+	expires := int32(60)
+	tasks := []CeleryPeriodicTask{{
+		ObjectMeta: metav1.ObjectMeta{Name: "add"},
+		Spec: CeleryPeriodicTaskSpec{
+			Task:           "proj.tasks.add",
+			Args:           []apiextensionsv1.JSON{{Raw: []byte("1")}, {Raw: []byte("2")}},
+			Kwargs:         map[string]apiextensionsv1.JSON{"retry": {Raw: []byte("true")}},
+			Interval:       &metav1.Duration{Duration: 30 * time.Second},
+			Queue:          "math",
+			ExpiresSeconds: &expires,
+		},
+	}}
+	configMap, hash, err := scheduler.GenerateBeatSchedule(tasks)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := `{
+  "add": {
+    "task": "proj.tasks.add",
+    "schedule": {
+      "interval": 30
+    },
+    "args": [
+      1,
+      2
+    ],
+    "kwargs": {
+      "retry": true
+    },
+    "options": {
+      "expires": 60,
+      "queue": "math"
+    }
+  }
+}`
+	if configMap.Data["beat_schedule.json"] != expected {
+		t.Errorf("unexpected beat schedule %s", configMap.Data["beat_schedule.json"])
+	}
+	if hash == "" {
+		t.Fatalf("expected the hash of beat schedule")
+	}
+
+	scheduler.SetBeatScheduleHash(hash)
+	pod := scheduler.generatePod()
+	if pod.Annotations[BeatScheduleHashAnnotation] != hash {
+		t.Errorf("expected the hash annotation on pod")
+	}
+	container := pod.Spec.Containers[0]
+	args := container.Args
+	if len(args) < 5 || args[0] != "sh" || args[4] != "celery" {
+		t.Fatalf("expected the python path to be set before celery, got %v", args)
+	}
+	found := false
+	for i, arg := range args {
+		if arg == "--scheduler" {
+			found = args[i+1] == "celery_operator_beat:Scheduler"
+		}
+	}
+	if !found {
+		t.Errorf("expected the shim scheduler, got %v", args)
+	}
+	if len(container.Env) == 0 || container.Env[len(container.Env)-1].Value != scheduler.Spec.SchedulerClass {
+		t.Errorf("expected the base scheduler in env, got %v", container.Env)
+	}
+
+	// The pods only depend on the annotation, not on the reported status
+	scheduler.SetBeatScheduleHash("")
+	scheduler.Status.BeatScheduleHash = hash
+	if _, ok := scheduler.generatePod().Annotations[BeatScheduleHashAnnotation]; ok {
+		t.Errorf("expected no beat schedule without the annotation")
+	}
+}
@@ -0,0 +1,159 @@
+package v4
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// MergePodTemplates merges the override into the base template like kubectl apply.
+// The lists with merge keys, e.g. containers, volumes and env, are merged by their names,
+// and the fields set in the override take precedence over the ones in the base.
+func MergePodTemplates(base *corev1.PodTemplateSpec, override *corev1.PodTemplateSpec) *corev1.PodTemplateSpec {
+	if base == nil {
+		return override.DeepCopy()
+	}
+	if override == nil {
+		return base.DeepCopy()
+	}
+	baseJSON, err := json.Marshal(base)
+	if err != nil {
+		return override.DeepCopy()
+	}
+	overridePatch, err := toMergePatch(override)
+	if err != nil {
+		return override.DeepCopy()
+	}
+	mergedJSON, err := strategicpatch.StrategicMergePatch(baseJSON, overridePatch, &corev1.PodTemplateSpec{})
+	if err != nil {
+		return override.DeepCopy()
+	}
+	merged := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(mergedJSON, merged); err != nil {
+		return override.DeepCopy()
+	}
+	return merged
+}
+
+// toMergePatch serializes the template as a patch. The null values are dropped
+// as they would delete the fields in the base instead of keeping them.
+func toMergePatch(template *corev1.PodTemplateSpec) ([]byte, error) {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	return json.Marshal(dropNullValues(patch))
+}
+
+func dropNullValues(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			if item == nil {
+				delete(typed, key)
+				continue
+			}
+			typed[key] = dropNullValues(item)
+		}
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = dropNullValues(item)
+		}
+	}
+	return value
+}
+
+// applyPodTemplate merges the essential pod generated by the operator into the user template.
+// The essential container is kept as the first container, so it is the default one of kubectl.
+func applyPodTemplate(template *corev1.PodTemplateSpec, essential *corev1.PodTemplateSpec) *corev1.PodTemplateSpec {
+	merged := MergePodTemplates(template, essential)
+	if len(essential.Spec.Containers) == 0 {
+		return merged
+	}
+	name := essential.Spec.Containers[0].Name
+	for i, container := range merged.Spec.Containers {
+		if container.Name == name && i > 0 {
+			containers := []corev1.Container{container}
+			containers = append(containers, merged.Spec.Containers[:i]...)
+			merged.Spec.Containers = append(containers, merged.Spec.Containers[i+1:]...)
+			break
+		}
+	}
+	return merged
+}
+
+// SpecHashAnnotation keeps the hash of the pod generated by the operator
+const SpecHashAnnotation = "celery.celeryproject.org/spec-hash"
+
+// setSpecHash stamps the pod with the hash of its generated labels, annotations and spec
+func setSpecHash(pod *corev1.Pod) {
+	data, _ := json.Marshal(struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+		Spec        corev1.PodSpec    `json:"spec"`
+	}{pod.Labels, pod.Annotations, pod.Spec})
+	hash := sha256.Sum256(data)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[SpecHashAnnotation] = hex.EncodeToString(hash[:])[:16]
+}
+
+// isPodUpToDate compares the pod with the expected one by the spec hash.
+// The labels, annotations and images, which can be edited in place, are checked as well.
+// The pods created by the previous versions of operator have no hash, so they are compared field by field.
+func isPodUpToDate(celeryVersion string, expected *corev1.Pod, pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[SpecHashAnnotation]; !ok {
+		return isLegacyPodUpToDate(celeryVersion, expected, pod)
+	}
+	if len(expected.Spec.Containers) != len(pod.Spec.Containers) {
+		return false
+	}
+	for i := range expected.Spec.Containers {
+		if expected.Spec.Containers[i].Image != pod.Spec.Containers[i].Image {
+			return false
+		}
+	}
+	return isSubset(expected.Labels, pod.Labels) && isSubset(expected.Annotations, pod.Annotations)
+}
+
+// isLegacyPodUpToDate checks whether the pod without the spec hash is generated from the expected pod
+func isLegacyPodUpToDate(celeryVersion string, expected *corev1.Pod, pod *corev1.Pod) bool {
+	expected = expected.DeepCopy()
+	delete(expected.Annotations, SpecHashAnnotation)
+	if pod.Annotations[BrokerAddressHashAnnotation] != expected.Annotations[BrokerAddressHashAnnotation] ||
+		len(pod.Spec.Containers) == 0 || len(expected.Spec.Containers) == 0 {
+		return false
+	}
+	// Celery 4 accepts the command lines in both styles
+	if isCommandUpToDate(celeryVersion, pod.Spec.Containers[0].Command, expected.Spec.Containers[0].Command) {
+		expected.Spec.Containers[0].Command = pod.Spec.Containers[0].Command
+	}
+	return isPodDerivedFrom(expected, pod)
+}
+
+func isSubset(expected map[string]string, actual map[string]string) bool {
+	for key, value := range expected {
+		if actual[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// isPodDerivedFrom checks whether the pod is generated from the expected pod.
+// The fields defaulted by the api server are ignored.
+func isPodDerivedFrom(expected *corev1.Pod, pod *corev1.Pod) bool {
+	return isSubset(expected.Labels, pod.Labels) &&
+		isSubset(expected.Annotations, pod.Annotations) &&
+		len(expected.Spec.Containers) == len(pod.Spec.Containers) &&
+		equality.Semantic.DeepDerivative(expected.Spec, pod.Spec)
+}
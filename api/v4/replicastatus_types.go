@@ -0,0 +1,33 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+// ReplicaStatus defines the observed pods of the workers or schedulers
+type ReplicaStatus struct {
+	// Replicas defines the number of pods which are not being terminated
+	Replicas int `json:"replicas"`
+	// ReadyReplicas defines the number of pods passing the readiness check
+	ReadyReplicas int `json:"readyReplicas"`
+	// UpdatedReplicas defines the number of pods generated from the current spec
+	UpdatedReplicas int `json:"updatedReplicas"`
+	// ObservedGeneration defines the generation of the spec observed by the operator
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Selector defines the label selector of the pods in string form for the scale subresource
+	Selector string `json:"selector,omitempty"`
+	// Conditions defines the latest observations of the pods, i.e. Available, Progressing and Degraded
+	Conditions []Condition `json:"conditions,omitempty"`
+}
@@ -0,0 +1,147 @@
+package v4
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ResultBackendHashAnnotation keeps the hash of the result backend url used by the pod
+const ResultBackendHashAnnotation = "celery.celeryproject.org/result-backend-hash"
+
+// defaultResultBackendDatabase keeps the results apart from the queues in database 0 of the broker
+const defaultResultBackendDatabase = 1
+
+// GetType returns the type of the result backend. Defaults to broker
+func (rbs *ResultBackendSpec) GetType() ResultBackendType {
+	if rbs.Type == "" {
+		return BrokerResultBackend
+	}
+	return rbs.Type
+}
+
+// GetDatabase returns the redis database of the results in the managed redis broker
+func (rbs *ResultBackendSpec) GetDatabase() int32 {
+	if rbs.Database == nil {
+		return defaultResultBackendDatabase
+	}
+	return *rbs.Database
+}
+
+// GenerateResultBackend defines the dedicated redis of the results.
+// It is managed as a CeleryBroker, so it shares the persistence and high availability settings of the redis broker.
+func (cr *Celery) GenerateResultBackend() *CeleryBroker {
+	labels := map[string]string{
+		"celery-app": cr.Name,
+		"type":       "result-backend",
+	}
+
+	return &CeleryBroker{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.GetName() + "-result-backend",
+			Namespace: cr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: CeleryBrokerSpec{
+			Type:  RedisBroker,
+			Redis: cr.Spec.ResultBackend.Redis,
+		},
+	}
+}
+
+// GenerateResultBackendSecret will create the secret keeping the url of the result backend in the managed redis broker
+func (cr *Celery) GenerateResultBackendSecret(addr string) *corev1.Secret {
+	labels := map[string]string{
+		"celery-app": cr.Name,
+		"type":       "result-backend",
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.GetName() + "-result-backend-url",
+			Namespace: cr.GetNamespace(),
+			Labels:    labels,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			BrokerURLKey: []byte(addr),
+		},
+	}
+}
+
+// GetBackendCleanupTaskName returns the name of the periodic task deleting the expired results
+func (cr *Celery) GetBackendCleanupTaskName() string {
+	return cr.GetName() + "-backend-cleanup"
+}
+
+// GenerateBackendCleanupTask defines the periodic task running celery.backend_cleanup in the first scheduler pool
+func (cr *Celery) GenerateBackendCleanupTask() *CeleryPeriodicTask {
+	labels := map[string]string{
+		"celery-app": cr.Name,
+		"type":       "result-backend",
+	}
+
+	return &CeleryPeriodicTask{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.GetBackendCleanupTaskName(),
+			Namespace: cr.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: CeleryPeriodicTaskSpec{
+			Task:    "celery.backend_cleanup",
+			Crontab: cr.Spec.ResultBackend.CleanupCrontab,
+			Target: PeriodicTaskTarget{
+				Kind: CeleryTarget,
+				Name: cr.GetName(),
+			},
+		},
+	}
+}
+
+// getResultBackend returns the resolved result backend with the expiry in spec.
+// It returns nil unless the result backend is reported ready, so a stale one is never passed to the pools.
+func (cr *Celery) getResultBackend() *ResultBackendReference {
+	if cr.Spec.ResultBackend == nil || cr.Status.ResultBackend == nil {
+		return nil
+	}
+	condition := FindCondition(cr.Status.Conditions, ResultBackendReady)
+	if condition == nil || condition.Status != corev1.ConditionTrue {
+		return nil
+	}
+	resultBackend := cr.Status.ResultBackend.DeepCopy()
+	resultBackend.Expires = cr.Spec.ResultBackend.Expires
+	return resultBackend
+}
+
+// WithRedisDatabase selects the database in every redis or sentinel url of the address
+func WithRedisDatabase(addr string, database int32) (string, error) {
+	parts := strings.Split(addr, ";")
+	for i, part := range parts {
+		redisURL, err := url.Parse(part)
+		if err != nil {
+			return "", err
+		}
+		redisURL.Path = "/" + strconv.Itoa(int(database))
+		parts[i] = redisURL.String()
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// generateResultBackendEnv passes the result backend url to celery, which reads CELERY_RESULT_BACKEND by itself.
+// The transport options and expiry are applied by the config shim like the broker options.
+func generateResultBackendEnv(resultBackend *ResultBackendReference) []corev1.EnvVar {
+	if resultBackend == nil || resultBackend.AddressSecretRef == nil {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name: "CELERY_RESULT_BACKEND",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: resultBackend.AddressSecretRef,
+			},
+		},
+	}
+}
@@ -0,0 +1,133 @@
+package v4
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWithRedisDatabase(t *testing.T) {
+	cases := map[string]string{
+		"redis://:pass@broker.default":                    "redis://:pass@broker.default/1",
+		"redis://:pass@broker.default:6379/0":             "redis://:pass@broker.default:6379/1",
+		"sentinel://:p@s-0:26379;sentinel://:p@s-1:26379": "sentinel://:p@s-0:26379/1;sentinel://:p@s-1:26379/1",
+	}
+	for addr, expected := range cases {
+		actual, err := WithRedisDatabase(addr, 1)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", addr, err)
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %q, got %q", addr, expected, actual)
+		}
+	}
+}
+
+func TestResultBackendEnv(t *testing.T) {
+	worker := &CeleryWorker{
+		Spec: CeleryWorkerSpec{
+			Image:   "celery:4",
+			AppName: "app",
+			ResultBackend: &ResultBackendReference{
+				AddressSecretRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "celery-result-backend-url"},
+					Key:                  BrokerURLKey,
+				},
+				AddressHash:      "abc",
+				TransportOptions: map[string]string{"master_name": "mymaster"},
+				Expires:          &metav1.Duration{Duration: 2 * time.Hour},
+			},
+		},
+	}
+	pod := worker.generatePod()
+	if pod.Annotations[ResultBackendHashAnnotation] != "abc" {
+		t.Errorf("expected the result backend hash on pod, got %v", pod.Annotations)
+	}
+	env := map[string]corev1.EnvVar{}
+	for _, item := range pod.Spec.Containers[0].Env {
+		env[item.Name] = item
+	}
+	if ref := env["CELERY_RESULT_BACKEND"].ValueFrom; ref == nil || ref.SecretKeyRef.Name != "celery-result-backend-url" {
+		t.Errorf("expected CELERY_RESULT_BACKEND from secret, got %v", env["CELERY_RESULT_BACKEND"])
+	}
+
+	// Celery does not read the options and expiry from environment, so they are applied by the shim
+	configMap, err := worker.GenerateConfigMap()
+	if err != nil || configMap == nil {
+		t.Fatalf("expected the config map for the result backend, got %v and %v", configMap, err)
+	}
+	expected := map[string]interface{}{"master_name": "mymaster"}
+	if options := getRenderedSetting(t, configMap, "result_backend_transport_options"); !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected the transport options %v, got %v", expected, options)
+	}
+	if expires := getRenderedSetting(t, configMap, "result_expires"); expires != float64(7200) {
+		t.Errorf("expected the expiry in seconds, got %v", expires)
+	}
+	if command := strings.Join(pod.Spec.Containers[0].Command, " "); !strings.Contains(command, "-A "+configModule+":app") {
+		t.Errorf("expected the app to be wrapped by the config module, got %q", command)
+	}
+
+	// The result expiry of config takes precedence
+	worker.Spec.Config = map[string]apiextensionsv1.JSON{"result_expires": {Raw: []byte(`60`)}}
+	configMap, _ = worker.GenerateConfigMap()
+	if expires := getRenderedSetting(t, configMap, "result_expires"); expires != float64(60) {
+		t.Errorf("expected the expiry of config, got %v", expires)
+	}
+}
+
+func TestValidateResultBackend(t *testing.T) {
+	celery := newValidCelery()
+	celery.Spec.ResultBackend = &ResultBackendSpec{CleanupCrontab: "0 4 * * *"}
+	celery.Default()
+	if celery.Spec.ResultBackend.Type != BrokerResultBackend {
+		t.Errorf("expected result backend type broker, got %q", celery.Spec.ResultBackend.Type)
+	}
+	if err := celery.ValidateCreate(); err != nil {
+		t.Errorf("expected valid celery, got %v", err)
+	}
+
+	invalid := celery.DeepCopy()
+	invalid.Spec.Broker.Type = RabbitMQBroker
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for reusing rabbitmq as result backend")
+	}
+	invalid = celery.DeepCopy()
+	invalid.Spec.ResultBackend.Type = ExternalResultBackend
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for external result backend without secret")
+	}
+	invalid = celery.DeepCopy()
+	invalid.Spec.Schedulers = nil
+	if err := invalid.ValidateCreate(); err == nil {
+		t.Errorf("expected error for cleanup without scheduler")
+	}
+}
+
+func TestResultBackendGatedOnReadiness(t *testing.T) {
+	celery := &Celery{
+		Spec: CelerySpec{
+			ResultBackend: &ResultBackendSpec{
+				Type:    BrokerResultBackend,
+				Expires: &metav1.Duration{Duration: time.Hour},
+			},
+		},
+		Status: CeleryStatus{
+			ResultBackend: &ResultBackendReference{AddressHash: "abc"},
+		},
+	}
+	// The reference is kept from the previous result backend until it is reported ready
+	SetCondition(&celery.Status.Conditions, Condition{Type: ResultBackendReady, Status: corev1.ConditionFalse})
+	if resultBackend := celery.getResultBackend(); resultBackend != nil {
+		t.Errorf("expected no result backend before it is ready, got %v", resultBackend)
+	}
+	SetCondition(&celery.Status.Conditions, Condition{Type: ResultBackendReady, Status: corev1.ConditionTrue})
+	resultBackend := celery.getResultBackend()
+	if resultBackend == nil || resultBackend.AddressHash != "abc" || resultBackend.Expires.Duration != time.Hour {
+		t.Errorf("expected the ready result backend with the expiry, got %v", resultBackend)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v4
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ResultBackendType defines where the task results are stored
+// +kubebuilder:validation:Enum=broker;redis;external
+type ResultBackendType string
+
+const (
+	// BrokerResultBackend reuses the managed redis broker with a separate database
+	BrokerResultBackend ResultBackendType = "broker"
+	// RedisResultBackend creates a dedicated redis for the results
+	RedisResultBackend ResultBackendType = "redis"
+	// ExternalResultBackend uses the url in a secret, e.g. db+postgresql:// or rpc://
+	ExternalResultBackend ResultBackendType = "external"
+)
+
+// ResultBackendSpec defines the result backend of a Celery stack
+type ResultBackendSpec struct {
+	// Type defines where the task results are stored. Defaults to broker
+	Type ResultBackendType `json:"type,omitempty"`
+	// Database defines the redis database of the results if the managed redis broker is reused.
+	// Defaults to 1, so the results are kept apart from the queues in database 0
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=15
+	Database *int32 `json:"database,omitempty"`
+	// Redis defines the settings of the dedicated redis
+	// If it is not `redis` type, this item will be ignored
+	Redis *RedisBrokerSpec `json:"redis,omitempty"`
+	// AddressSecretRef refers to the secret keeping the url of the external result backend
+	// If it is not `external` type, this item will be ignored
+	AddressSecretRef *corev1.SecretKeySelector `json:"addressSecretRef,omitempty"`
+	// Expires defines how long the results are kept, i.e. result_expires. Defaults to 1 day by celery.
+	// It is applied to the app by the config module in <name>-config, and result_expires in config takes precedence
+	Expires *metav1.Duration `json:"expires,omitempty"`
+	// CleanupCrontab defines when beat runs celery.backend_cleanup to delete the expired results, e.g. "0 4 * * *".
+	// It is only needed by the backends without native expiry, e.g. database, and requires a scheduler pool
+	CleanupCrontab string `json:"cleanupCrontab,omitempty"`
+}
+
+// ResultBackendReference defines the result backend used by workers and schedulers
+type ResultBackendReference struct {
+	// AddressSecretRef refers to the secret keeping the url of the result backend.
+	// It is passed to the pods in CELERY_RESULT_BACKEND
+	AddressSecretRef *corev1.SecretKeySelector `json:"addressSecretRef,omitempty"`
+	// AddressHash defines the hash of the url in the secret.
+	// The pods are rolled out when it is changed, so the rotated credentials are picked up
+	AddressHash string `json:"addressHash,omitempty"`
+	// TransportOptions defines the result_backend_transport_options, e.g. master_name for sentinel.
+	// They are applied to the app by the config module like the broker transport options
+	TransportOptions map[string]string `json:"transportOptions,omitempty"`
+	// Expires defines how long the results are kept. It is applied to the app by the config module as seconds
+	Expires *metav1.Duration `json:"expires,omitempty"`
+}
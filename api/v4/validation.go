@@ -0,0 +1,254 @@
+package v4
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// brokerSchemes are the url schemes of the brokers supported by celery.
+// The value tells whether the host is required in the url.
+var brokerSchemes = map[string]bool{
+	"redis":       true,
+	"rediss":      true,
+	"sentinel":    true,
+	"amqp":        true,
+	"amqps":       true,
+	"pyamqp":      true,
+	"librabbitmq": true,
+	"sqs":         false,
+	"memory":      false,
+	"filesystem":  false,
+}
+
+// validateBrokerAddress checks the scheme and host of the broker url.
+// The sentinel urls are separated by semicolons.
+func validateBrokerAddress(address string, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for _, part := range strings.Split(address, ";") {
+		parsed, err := url.Parse(part)
+		if err != nil {
+			return append(allErrs, field.Invalid(path, RedactBrokerAddress(address), err.Error()))
+		}
+		if parsed.Scheme == "" {
+			return append(allErrs, field.Invalid(path, RedactBrokerAddress(address), "scheme is required, e.g. redis://"))
+		}
+		hostRequired, ok := brokerSchemes[parsed.Scheme]
+		if !ok {
+			return append(allErrs, field.Invalid(path, RedactBrokerAddress(address), "unsupported scheme "+parsed.Scheme))
+		}
+		if hostRequired && parsed.Host == "" {
+			return append(allErrs, field.Invalid(path, RedactBrokerAddress(address), "host is required"))
+		}
+	}
+	return allErrs
+}
+
+// validateBrokerSpec checks the broker type and the address of external broker
+func validateBrokerSpec(spec *CeleryBrokerSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch spec.Type {
+	case RedisBroker, RabbitMQBroker:
+	case ExternalBroker:
+		if spec.BrokerAddress == "" && spec.BrokerAddressSecretRef == nil {
+			allErrs = append(allErrs, field.Required(path.Child("brokerAddress"), "external broker requires brokerAddress or brokerAddressSecretRef"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("type"), spec.Type,
+			[]string{string(RedisBroker), string(RabbitMQBroker), string(ExternalBroker)}))
+	}
+	if spec.BrokerAddress != "" {
+		allErrs = append(allErrs, validateBrokerAddress(spec.BrokerAddress, path.Child("brokerAddress"))...)
+	}
+	if ref := spec.BrokerAddressSecretRef; ref != nil && ref.Key == "" && ref.HostKey == "" {
+		allErrs = append(allErrs, field.Required(path.Child("brokerAddressSecretRef"), "either key or hostKey is required"))
+	}
+	return allErrs
+}
+
+// validateResultBackendSpec checks the result backend against the broker it may reuse.
+// The cleanup is run by beat, so it requires a scheduler pool.
+func validateResultBackendSpec(spec *ResultBackendSpec, broker *CeleryBrokerSpec, hasScheduler bool, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch spec.GetType() {
+	case BrokerResultBackend:
+		if broker.Type != "" && broker.Type != RedisBroker {
+			allErrs = append(allErrs, field.Invalid(path.Child("type"), spec.Type, "only the managed redis broker can be reused as result backend"))
+		}
+	case RedisResultBackend:
+	case ExternalResultBackend:
+		if spec.AddressSecretRef == nil {
+			allErrs = append(allErrs, field.Required(path.Child("addressSecretRef"), "external result backend requires addressSecretRef"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("type"), spec.Type,
+			[]string{string(BrokerResultBackend), string(RedisResultBackend), string(ExternalResultBackend)}))
+	}
+	if spec.Expires != nil && spec.Expires.Duration < time.Second {
+		allErrs = append(allErrs, field.Invalid(path.Child("expires"), spec.Expires.Duration.String(), "must be at least 1s"))
+	}
+	if spec.CleanupCrontab != "" {
+		if _, err := ParseCrontab(spec.CleanupCrontab); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("cleanupCrontab"), spec.CleanupCrontab, err.Error()))
+		} else if !hasScheduler {
+			allErrs = append(allErrs, field.Invalid(path.Child("cleanupCrontab"), spec.CleanupCrontab, "the cleanup is run by beat, so a scheduler pool is required"))
+		}
+	}
+	return allErrs
+}
+
+// configKeyPattern matches the lowercase setting names of celery
+var configKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// forbiddenConfigKeys are the settings carrying the credentials, which should be passed by the secrets instead
+var forbiddenConfigKeys = map[string]string{
+	"broker_url":     "the broker is configured by brokerAddress or the managed broker",
+	"result_backend": "the result backend is configured by resultBackend",
+}
+
+// validateConfig checks the celery settings rendered into the config module
+func validateConfig(config map[string]apiextensionsv1.JSON, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for key, value := range config {
+		if !configKeyPattern.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(path.Key(key), key, "must be a lowercase celery setting, e.g. task_acks_late"))
+		}
+		if reason, ok := forbiddenConfigKeys[key]; ok {
+			allErrs = append(allErrs, field.Forbidden(path.Key(key), reason))
+		}
+		if !json.Valid(value.Raw) {
+			allErrs = append(allErrs, field.Invalid(path.Key(key), string(value.Raw), "must be valid json"))
+		}
+	}
+	return allErrs
+}
+
+// validateWorkerSpec checks the fields shared by CeleryWorker and the worker pools of Celery
+func validateWorkerSpec(spec *CeleryWorkerSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if spec.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("replicas"), spec.Replicas, "must be greater than or equal to 0"))
+	}
+	if spec.AppName == "" {
+		allErrs = append(allErrs, field.Required(path.Child("appName"), "the app instance is required by celery worker"))
+	}
+	if spec.BrokerAddress != "" {
+		allErrs = append(allErrs, validateBrokerAddress(spec.BrokerAddress, path.Child("brokerAddress"))...)
+	}
+	seen := make(map[string]bool)
+	for i, queue := range spec.TargetQueues {
+		if seen[queue] {
+			allErrs = append(allErrs, field.Duplicate(path.Child("targetQueues").Index(i), queue))
+		}
+		seen[queue] = true
+	}
+	if autoscaling := spec.Autoscaling; autoscaling != nil && autoscaling.MinReplicas != nil &&
+		*autoscaling.MinReplicas > autoscaling.MaxReplicas {
+		allErrs = append(allErrs, field.Invalid(path.Child("autoscaling", "minReplicas"), *autoscaling.MinReplicas, "must not be greater than maxReplicas"))
+	}
+	allErrs = append(allErrs, validateWorkerPool(spec, path)...)
+	if spec.MaxTaskDuration != nil && spec.MaxTaskDuration.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxTaskDuration"), spec.MaxTaskDuration.Duration.String(), "must be positive"))
+	}
+	if spec.DrainTimeout != nil && spec.DrainTimeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("drainTimeout"), spec.DrainTimeout.Duration.String(), "must be positive"))
+	}
+	allErrs = append(allErrs, validateConfig(spec.Config, path.Child("config"))...)
+	return allErrs
+}
+
+// validateWorkerPool checks the options of the execution pool are supported by the pool
+func validateWorkerPool(spec *CeleryWorkerSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	pool := spec.Pool
+	if pool == "" {
+		pool = PreforkPool
+	}
+	if autoscale := spec.Autoscale; autoscale != nil {
+		if autoscale.MinConcurrency > autoscale.MaxConcurrency {
+			allErrs = append(allErrs, field.Invalid(path.Child("autoscale", "minConcurrency"), autoscale.MinConcurrency, "must not be greater than maxConcurrency"))
+		}
+		if pool == SoloPool {
+			allErrs = append(allErrs, field.Forbidden(path.Child("autoscale"), "the solo pool cannot be resized"))
+		}
+	}
+	if pool != PreforkPool {
+		if spec.MaxTasksPerChild != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("maxTasksPerChild"), "only supported by the prefork pool"))
+		}
+		if spec.MaxMemoryPerChild != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("maxMemoryPerChild"), "only supported by the prefork pool"))
+		}
+	}
+	if spec.MaxMemoryPerChild != nil && spec.MaxMemoryPerChild.Value() < 1024 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxMemoryPerChild"), spec.MaxMemoryPerChild.String(), "must be at least 1Ki"))
+	}
+	return allErrs
+}
+
+// validateSchedulerSpec checks the fields shared by CeleryScheduler and the scheduler pools of Celery
+func validateSchedulerSpec(spec *CelerySchedulerSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if spec.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("replicas"), spec.Replicas, "must be greater than or equal to 0"))
+	}
+	if spec.AppName == "" {
+		allErrs = append(allErrs, field.Required(path.Child("appName"), "the app instance is required by celery beat"))
+	}
+	if spec.BrokerAddress != "" {
+		allErrs = append(allErrs, validateBrokerAddress(spec.BrokerAddress, path.Child("brokerAddress"))...)
+	}
+	allErrs = append(allErrs, validateConfig(spec.Config, path.Child("config"))...)
+	return allErrs
+}
+
+// validatePeriodicTaskSpec checks the schedule, arguments and target of CeleryPeriodicTask
+func validatePeriodicTaskSpec(spec *CeleryPeriodicTaskSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if spec.Task == "" {
+		allErrs = append(allErrs, field.Required(path.Child("task"), "the registered name of the task is required"))
+	}
+	switch {
+	case spec.Crontab != "" && spec.Interval != nil:
+		allErrs = append(allErrs, field.Forbidden(path.Child("interval"), "only one of crontab and interval can be set"))
+	case spec.Crontab != "":
+		if _, err := ParseCrontab(spec.Crontab); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("crontab"), spec.Crontab, err.Error()))
+		}
+	case spec.Interval != nil:
+		if spec.Interval.Duration <= 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("interval"), spec.Interval.Duration.String(), "must be positive"))
+		}
+	default:
+		allErrs = append(allErrs, field.Required(path.Child("crontab"), "either crontab or interval is required"))
+	}
+	for i, arg := range spec.Args {
+		if !json.Valid(arg.Raw) {
+			allErrs = append(allErrs, field.Invalid(path.Child("args").Index(i), string(arg.Raw), "must be valid json"))
+		}
+	}
+	for key, value := range spec.Kwargs {
+		if !json.Valid(value.Raw) {
+			allErrs = append(allErrs, field.Invalid(path.Child("kwargs").Key(key), string(value.Raw), "must be valid json"))
+		}
+	}
+	targetPath := path.Child("target")
+	switch spec.Target.Kind {
+	case SchedulerTarget:
+		if spec.Target.Pool != "" {
+			allErrs = append(allErrs, field.Forbidden(targetPath.Child("pool"), "pool is only supported by the Celery target"))
+		}
+	case CeleryTarget:
+	default:
+		allErrs = append(allErrs, field.NotSupported(targetPath.Child("kind"), spec.Target.Kind, []string{SchedulerTarget, CeleryTarget}))
+	}
+	if spec.Target.Name == "" {
+		allErrs = append(allErrs, field.Required(targetPath.Child("name"), "the name of the target is required"))
+	}
+	return allErrs
+}
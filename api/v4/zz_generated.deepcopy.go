@@ -21,16 +21,60 @@ limitations under the License.
 package v4
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BrokerAddressSecretReference) DeepCopyInto(out *BrokerAddressSecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BrokerAddressSecretReference.
+func (in *BrokerAddressSecretReference) DeepCopy() *BrokerAddressSecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(BrokerAddressSecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BrokerPersistence) DeepCopyInto(out *BrokerPersistence) {
+	*out = *in
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BrokerPersistence.
+func (in *BrokerPersistence) DeepCopy() *BrokerPersistence {
+	if in == nil {
+		return nil
+	}
+	out := new(BrokerPersistence)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Celery) DeepCopyInto(out *Celery) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Celery.
@@ -56,8 +100,8 @@ func (in *CeleryBroker) DeepCopyInto(out *CeleryBroker) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryBroker.
@@ -113,6 +157,26 @@ func (in *CeleryBrokerList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryBrokerSpec) DeepCopyInto(out *CeleryBrokerSpec) {
 	*out = *in
+	if in.BrokerAddressSecretRef != nil {
+		in, out := &in.BrokerAddressSecretRef, &out.BrokerAddressSecretRef
+		*out = new(BrokerAddressSecretReference)
+		**out = **in
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(v1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisBrokerSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RabbitMQ != nil {
+		in, out := &in.RabbitMQ, &out.RabbitMQ
+		*out = new(RabbitMQBrokerSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryBrokerSpec.
@@ -128,6 +192,18 @@ func (in *CeleryBrokerSpec) DeepCopy() *CeleryBrokerSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryBrokerStatus) DeepCopyInto(out *CeleryBrokerStatus) {
 	*out = *in
+	if in.BrokerAddressSecretRef != nil {
+		in, out := &in.BrokerAddressSecretRef, &out.BrokerAddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TransportOptions != nil {
+		in, out := &in.TransportOptions, &out.TransportOptions
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryBrokerStatus.
@@ -172,13 +248,157 @@ func (in *CeleryList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryPeriodicTask) DeepCopyInto(out *CeleryPeriodicTask) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryPeriodicTask.
+func (in *CeleryPeriodicTask) DeepCopy() *CeleryPeriodicTask {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryPeriodicTask)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CeleryPeriodicTask) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryPeriodicTaskList) DeepCopyInto(out *CeleryPeriodicTaskList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CeleryPeriodicTask, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryPeriodicTaskList.
+func (in *CeleryPeriodicTaskList) DeepCopy() *CeleryPeriodicTaskList {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryPeriodicTaskList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CeleryPeriodicTaskList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryPeriodicTaskSpec) DeepCopyInto(out *CeleryPeriodicTaskSpec) {
+	*out = *in
+	if in.Args != nil {
+		in, out := &in.Args, &out.Args
+		*out = make([]apiextensionsv1.JSON, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Kwargs != nil {
+		in, out := &in.Kwargs, &out.Kwargs
+		*out = make(map[string]apiextensionsv1.JSON, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.ExpiresSeconds != nil {
+		in, out := &in.ExpiresSeconds, &out.ExpiresSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	out.Target = in.Target
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryPeriodicTaskSpec.
+func (in *CeleryPeriodicTaskSpec) DeepCopy() *CeleryPeriodicTaskSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryPeriodicTaskSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryPeriodicTaskStatus) DeepCopyInto(out *CeleryPeriodicTaskStatus) {
+	*out = *in
+	if in.LastDueTime != nil {
+		in, out := &in.LastDueTime, &out.LastDueTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextDueTime != nil {
+		in, out := &in.NextDueTime, &out.NextDueTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryPeriodicTaskStatus.
+func (in *CeleryPeriodicTaskStatus) DeepCopy() *CeleryPeriodicTaskStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryPeriodicTaskStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryPoolStatus) DeepCopyInto(out *CeleryPoolStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryPoolStatus.
+func (in *CeleryPoolStatus) DeepCopy() *CeleryPoolStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryPoolStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryScheduler) DeepCopyInto(out *CeleryScheduler) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryScheduler.
@@ -231,10 +451,60 @@ func (in *CelerySchedulerList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CelerySchedulerPool) DeepCopyInto(out *CelerySchedulerPool) {
+	*out = *in
+	in.CelerySchedulerSpec.DeepCopyInto(&out.CelerySchedulerSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CelerySchedulerPool.
+func (in *CelerySchedulerPool) DeepCopy() *CelerySchedulerPool {
+	if in == nil {
+		return nil
+	}
+	out := new(CelerySchedulerPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CelerySchedulerSpec) DeepCopyInto(out *CelerySchedulerSpec) {
 	*out = *in
 	in.Resources.DeepCopyInto(&out.Resources)
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(v1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Persistence != nil {
+		in, out := &in.Persistence, &out.Persistence
+		*out = new(SchedulePersistence)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BrokerAddressSecretRef != nil {
+		in, out := &in.BrokerAddressSecretRef, &out.BrokerAddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BrokerTransportOptions != nil {
+		in, out := &in.BrokerTransportOptions, &out.BrokerTransportOptions
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ResultBackend != nil {
+		in, out := &in.ResultBackend, &out.ResultBackend
+		*out = new(ResultBackendReference)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]apiextensionsv1.JSON, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CelerySchedulerSpec.
@@ -250,6 +520,7 @@ func (in *CelerySchedulerSpec) DeepCopy() *CelerySchedulerSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CelerySchedulerStatus) DeepCopyInto(out *CelerySchedulerStatus) {
 	*out = *in
+	in.ReplicaStatus.DeepCopyInto(&out.ReplicaStatus)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CelerySchedulerStatus.
@@ -265,21 +536,38 @@ func (in *CelerySchedulerStatus) DeepCopy() *CelerySchedulerStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CelerySpec) DeepCopyInto(out *CelerySpec) {
 	*out = *in
-	out.Broker = in.Broker
+	in.Broker.DeepCopyInto(&out.Broker)
+	if in.ResultBackend != nil {
+		in, out := &in.ResultBackend, &out.ResultBackend
+		*out = new(ResultBackendSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Workers != nil {
 		in, out := &in.Workers, &out.Workers
-		*out = make([]CeleryWorkerSpec, len(*in))
+		*out = make([]CeleryWorkerPool, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 	if in.Schedulers != nil {
 		in, out := &in.Schedulers, &out.Schedulers
-		*out = make([]CelerySchedulerSpec, len(*in))
+		*out = make([]CelerySchedulerPool, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(v1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]apiextensionsv1.JSON, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CelerySpec.
@@ -295,6 +583,40 @@ func (in *CelerySpec) DeepCopy() *CelerySpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryStatus) DeepCopyInto(out *CeleryStatus) {
 	*out = *in
+	if in.BrokerAddressSecretRef != nil {
+		in, out := &in.BrokerAddressSecretRef, &out.BrokerAddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BrokerTransportOptions != nil {
+		in, out := &in.BrokerTransportOptions, &out.BrokerTransportOptions
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ResultBackend != nil {
+		in, out := &in.ResultBackend, &out.ResultBackend
+		*out = new(ResultBackendReference)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.WorkerPools != nil {
+		in, out := &in.WorkerPools, &out.WorkerPools
+		*out = make([]CeleryPoolStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.SchedulerPools != nil {
+		in, out := &in.SchedulerPools, &out.SchedulerPools
+		*out = make([]CeleryPoolStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryStatus.
@@ -313,7 +635,7 @@ func (in *CeleryWorker) DeepCopyInto(out *CeleryWorker) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorker.
@@ -334,6 +656,90 @@ func (in *CeleryWorker) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryWorkerAutoscaling) DeepCopyInto(out *CeleryWorkerAutoscaling) {
+	*out = *in
+	if in.MinReplicas != nil {
+		in, out := &in.MinReplicas, &out.MinReplicas
+		*out = new(int)
+		**out = **in
+	}
+	if in.ScaleUpCooldownSeconds != nil {
+		in, out := &in.ScaleUpCooldownSeconds, &out.ScaleUpCooldownSeconds
+		*out = new(int)
+		**out = **in
+	}
+	if in.ScaleDownCooldownSeconds != nil {
+		in, out := &in.ScaleDownCooldownSeconds, &out.ScaleDownCooldownSeconds
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerAutoscaling.
+func (in *CeleryWorkerAutoscaling) DeepCopy() *CeleryWorkerAutoscaling {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryWorkerAutoscaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryWorkerAutoscalingStatus) DeepCopyInto(out *CeleryWorkerAutoscalingStatus) {
+	*out = *in
+	if in.QueueDepths != nil {
+		in, out := &in.QueueDepths, &out.QueueDepths
+		*out = make(map[string]int64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerAutoscalingStatus.
+func (in *CeleryWorkerAutoscalingStatus) DeepCopy() *CeleryWorkerAutoscalingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryWorkerAutoscalingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryWorkerConcurrencyStatus) DeepCopyInto(out *CeleryWorkerConcurrencyStatus) {
+	*out = *in
+	if in.Workers != nil {
+		in, out := &in.Workers, &out.Workers
+		*out = make([]WorkerConcurrency, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerConcurrencyStatus.
+func (in *CeleryWorkerConcurrencyStatus) DeepCopy() *CeleryWorkerConcurrencyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryWorkerConcurrencyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryWorkerList) DeepCopyInto(out *CeleryWorkerList) {
 	*out = *in
@@ -366,6 +772,22 @@ func (in *CeleryWorkerList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CeleryWorkerPool) DeepCopyInto(out *CeleryWorkerPool) {
+	*out = *in
+	in.CeleryWorkerSpec.DeepCopyInto(&out.CeleryWorkerSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerPool.
+func (in *CeleryWorkerPool) DeepCopy() *CeleryWorkerPool {
+	if in == nil {
+		return nil
+	}
+	out := new(CeleryWorkerPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryWorkerSpec) DeepCopyInto(out *CeleryWorkerSpec) {
 	*out = *in
@@ -375,6 +797,80 @@ func (in *CeleryWorkerSpec) DeepCopyInto(out *CeleryWorkerSpec) {
 		copy(*out, *in)
 	}
 	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Concurrency != nil {
+		in, out := &in.Concurrency, &out.Concurrency
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Autoscale != nil {
+		in, out := &in.Autoscale, &out.Autoscale
+		*out = new(WorkerPoolAutoscale)
+		**out = **in
+	}
+	if in.MaxTasksPerChild != nil {
+		in, out := &in.MaxTasksPerChild, &out.MaxTasksPerChild
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxMemoryPerChild != nil {
+		in, out := &in.MaxMemoryPerChild, &out.MaxMemoryPerChild
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.PrefetchMultiplier != nil {
+		in, out := &in.PrefetchMultiplier, &out.PrefetchMultiplier
+		*out = new(int32)
+		**out = **in
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(v1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BrokerAddressSecretRef != nil {
+		in, out := &in.BrokerAddressSecretRef, &out.BrokerAddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BrokerTransportOptions != nil {
+		in, out := &in.BrokerTransportOptions, &out.BrokerTransportOptions
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ResultBackend != nil {
+		in, out := &in.ResultBackend, &out.ResultBackend
+		*out = new(ResultBackendReference)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]apiextensionsv1.JSON, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.MaxTaskDuration != nil {
+		in, out := &in.MaxTaskDuration, &out.MaxTaskDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.DrainTimeout != nil {
+		in, out := &in.DrainTimeout, &out.DrainTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.RollingUpdate != nil {
+		in, out := &in.RollingUpdate, &out.RollingUpdate
+		*out = new(RollingUpdateStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(CeleryWorkerAutoscaling)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerSpec.
@@ -390,6 +886,17 @@ func (in *CeleryWorkerSpec) DeepCopy() *CeleryWorkerSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CeleryWorkerStatus) DeepCopyInto(out *CeleryWorkerStatus) {
 	*out = *in
+	in.ReplicaStatus.DeepCopyInto(&out.ReplicaStatus)
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(CeleryWorkerAutoscalingStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Concurrency != nil {
+		in, out := &in.Concurrency, &out.Concurrency
+		*out = new(CeleryWorkerConcurrencyStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CeleryWorkerStatus.
@@ -401,3 +908,283 @@ func (in *CeleryWorkerStatus) DeepCopy() *CeleryWorkerStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PeriodicTaskTarget) DeepCopyInto(out *PeriodicTaskTarget) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PeriodicTaskTarget.
+func (in *PeriodicTaskTarget) DeepCopy() *PeriodicTaskTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(PeriodicTaskTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RabbitMQBrokerSpec) DeepCopyInto(out *RabbitMQBrokerSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RabbitMQBrokerSpec.
+func (in *RabbitMQBrokerSpec) DeepCopy() *RabbitMQBrokerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RabbitMQBrokerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RedisBrokerSpec) DeepCopyInto(out *RedisBrokerSpec) {
+	*out = *in
+	if in.Persistence != nil {
+		in, out := &in.Persistence, &out.Persistence
+		*out = new(BrokerPersistence)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Save != nil {
+		in, out := &in.Save, &out.Save
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.HighAvailability != nil {
+		in, out := &in.HighAvailability, &out.HighAvailability
+		*out = new(RedisHighAvailability)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RedisBrokerSpec.
+func (in *RedisBrokerSpec) DeepCopy() *RedisBrokerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RedisBrokerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RedisHighAvailability) DeepCopyInto(out *RedisHighAvailability) {
+	*out = *in
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Sentinels != nil {
+		in, out := &in.Sentinels, &out.Sentinels
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Quorum != nil {
+		in, out := &in.Quorum, &out.Quorum
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RedisHighAvailability.
+func (in *RedisHighAvailability) DeepCopy() *RedisHighAvailability {
+	if in == nil {
+		return nil
+	}
+	out := new(RedisHighAvailability)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReplicaStatus) DeepCopyInto(out *ReplicaStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReplicaStatus.
+func (in *ReplicaStatus) DeepCopy() *ReplicaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ReplicaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResultBackendReference) DeepCopyInto(out *ResultBackendReference) {
+	*out = *in
+	if in.AddressSecretRef != nil {
+		in, out := &in.AddressSecretRef, &out.AddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TransportOptions != nil {
+		in, out := &in.TransportOptions, &out.TransportOptions
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Expires != nil {
+		in, out := &in.Expires, &out.Expires
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResultBackendReference.
+func (in *ResultBackendReference) DeepCopy() *ResultBackendReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ResultBackendReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResultBackendSpec) DeepCopyInto(out *ResultBackendSpec) {
+	*out = *in
+	if in.Database != nil {
+		in, out := &in.Database, &out.Database
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisBrokerSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AddressSecretRef != nil {
+		in, out := &in.AddressSecretRef, &out.AddressSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Expires != nil {
+		in, out := &in.Expires, &out.Expires
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResultBackendSpec.
+func (in *ResultBackendSpec) DeepCopy() *ResultBackendSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ResultBackendSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RollingUpdateStrategy) DeepCopyInto(out *RollingUpdateStrategy) {
+	*out = *in
+	if in.MaxUnavailable != nil {
+		in, out := &in.MaxUnavailable, &out.MaxUnavailable
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+	if in.MaxSurge != nil {
+		in, out := &in.MaxSurge, &out.MaxSurge
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RollingUpdateStrategy.
+func (in *RollingUpdateStrategy) DeepCopy() *RollingUpdateStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RollingUpdateStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SchedulePersistence) DeepCopyInto(out *SchedulePersistence) {
+	*out = *in
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.AccessModes != nil {
+		in, out := &in.AccessModes, &out.AccessModes
+		*out = make([]v1.PersistentVolumeAccessMode, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SchedulePersistence.
+func (in *SchedulePersistence) DeepCopy() *SchedulePersistence {
+	if in == nil {
+		return nil
+	}
+	out := new(SchedulePersistence)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerConcurrency) DeepCopyInto(out *WorkerConcurrency) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerConcurrency.
+func (in *WorkerConcurrency) DeepCopy() *WorkerConcurrency {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerConcurrency)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerPoolAutoscale) DeepCopyInto(out *WorkerPoolAutoscale) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerPoolAutoscale.
+func (in *WorkerPoolAutoscale) DeepCopy() *WorkerPoolAutoscale {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerPoolAutoscale)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -18,12 +18,19 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
 )
@@ -33,6 +40,9 @@ type CeleryReconciler Reconciler
 
 // +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeries,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeries/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celerybrokers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryperiodictasks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CeleryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -53,6 +63,7 @@ func (r *CeleryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
 	}
+	previousStatus := instance.Status.DeepCopy()
 
 	//
 	// Handle Broker object
@@ -68,6 +79,9 @@ func (r *CeleryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		if err := r.Client.Create(ctx, broker); err != nil {
 			return ctrl.Result{}, err
 		}
+		existingBroker = broker
+	} else if err != nil {
+		return ctrl.Result{}, err
 	} else {
 		if !existingBroker.Equal(broker) {
 			reqLogger.Info("Updating CeleryBroker",
@@ -85,62 +99,102 @@ func (r *CeleryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
+	//
+	// Propagate the broker status and wait for the broker
+	//
+	instance.Status.BrokerAddress = existingBroker.Status.BrokerAddress
+	instance.Status.BrokerAddressSecretRef = existingBroker.Status.BrokerAddressSecretRef
+	instance.Status.BrokerAddressHash = existingBroker.Status.BrokerAddressHash
+	instance.Status.BrokerTransportOptions = existingBroker.Status.TransportOptions
+	instance.Status.BrokerPrimary = existingBroker.Status.Primary
+	brokerCondition := celeryv4.Condition{
+		Type:    celeryv4.BrokerReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  "BrokerReady",
+		Message: "The broker is ready to accept connections",
+	}
+	if !existingBroker.Status.Ready {
+		brokerCondition.Status = corev1.ConditionFalse
+		brokerCondition.Reason = "BrokerNotReady"
+		brokerCondition.Message = "Waiting for the broker to be ready"
+	}
+	celeryv4.SetCondition(&instance.Status.Conditions, brokerCondition)
+	instance.Status.BrokerType = existingBroker.GetType()
+	instance.Status.BrokerReady = existingBroker.Status.Ready
+
+	//
+	// Resolve the result backend
+	//
+	resultBackendReady, resultBackendErr := r.reconcileResultBackend(ctx, instance, existingBroker)
+	instance.Status.Phase = getCeleryPhase(&instance.Status)
+	if err := r.updateStatus(ctx, instance, previousStatus); err != nil {
+		return ctrl.Result{}, err
+	}
+	previousStatus = instance.Status.DeepCopy()
+	if resultBackendErr != nil {
+		return ctrl.Result{}, resultBackendErr
+	}
+	if !existingBroker.Status.Ready {
+		reqLogger.Info("The broker is not ready yet...Skipping workers and schedulers", "CeleryBroker.Namespace", existingBroker.Namespace, "CeleryBroker.Name", existingBroker.Name)
+		return ctrl.Result{}, nil
+	}
+	if !resultBackendReady {
+		reqLogger.Info("The result backend is not ready yet...Skipping workers and schedulers")
+		return ctrl.Result{}, nil
+	}
+
 	//
 	// Handle Schedulers object
 	//
 	schedulers := instance.GenerateSchedulers()
 	existingSchedulers := &celeryv4.CelerySchedulerList{}
-	err = r.Client.List(ctx, existingSchedulers, client.MatchingLabels{
+	err = r.Client.List(ctx, existingSchedulers, client.InNamespace(instance.Namespace), client.MatchingLabels{
 		"celery-app": instance.Name,
 		"type":       "scheduler",
 	})
 	if err != nil {
 		return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
 	}
-	existing := len(existingSchedulers.Items)
-	reqLogger.Info("Checking the difference in schedulers", "existing", existing, "target", len(schedulers))
-	if existing > len(schedulers) {
-		schedulersToBeDeleted := existingSchedulers.Items[:existing-len(schedulers)]
-		for _, s := range schedulersToBeDeleted {
-			reqLogger.Info("Deleteing the scheduler", "CeleryScheduler.Namespace", s.Namespace, "CeleryScheduler.Name", s.Name)
-			err = r.Client.Delete(ctx, &s)
-			if err != nil {
-				return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
-			}
+	reqLogger.Info("Checking the difference in schedulers", "existing", len(existingSchedulers.Items), "target", len(schedulers))
+	desiredSchedulers := make(map[string]bool)
+	for _, scheduler := range schedulers {
+		desiredSchedulers[scheduler.Name] = true
+	}
+	observedSchedulers := make([]celeryv4.CeleryScheduler, 0, len(existingSchedulers.Items))
+	for i := range existingSchedulers.Items {
+		s := &existingSchedulers.Items[i]
+		if desiredSchedulers[s.Name] {
+			observedSchedulers = append(observedSchedulers, *s)
+			continue
+		}
+		// The ones labelled by others are kept
+		if !metav1.IsControlledBy(s, instance) {
+			continue
+		}
+		reqLogger.Info("Deleteing the scheduler", "CeleryScheduler.Namespace", s.Namespace, "CeleryScheduler.Name", s.Name)
+		if err := r.Client.Delete(ctx, s); err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
 		}
 	}
-	err = r.Client.List(ctx, existingSchedulers, client.MatchingLabels{
-		"celery-app": instance.Name,
-		"type":       "scheduler",
-	})
-	for i, scheduler := range schedulers {
+	for _, scheduler := range schedulers {
 		found := &celeryv4.CeleryScheduler{}
 		err = r.Client.Get(ctx, types.NamespacedName{Name: scheduler.Name, Namespace: scheduler.Namespace}, found)
-		if i < existing {
-			if err != nil && errors.IsNotFound(err) {
-				if err := controllerutil.SetControllerReference(instance, scheduler, r.Scheme); err != nil {
-					return ctrl.Result{}, err
-				}
-				reqLogger.Info("Creating a new CeleryScheduler", "CeleryScheduler.Namespace", scheduler.Namespace, "CeleryScheduler.Name", scheduler.Name)
-				if err := r.Client.Create(ctx, scheduler); err != nil {
-					return ctrl.Result{}, err
-				}
-			} else {
-				reqLogger.Info("Going to patch with name spec", "CeleryScheduler.Namespace", scheduler.Namespace, "CeleryScheduler.Name", scheduler.Name, "CeleryScheduler.Spec", scheduler.Spec)
-				existingSchedulers.Items[i].Spec = scheduler.Spec
-				if err := r.Client.Update(ctx, &existingSchedulers.Items[i]); err != nil {
-					return ctrl.Result{Requeue: true}, err
-				}
+		if err != nil && errors.IsNotFound(err) {
+			if err := controllerutil.SetControllerReference(instance, scheduler, r.Scheme); err != nil {
+				return ctrl.Result{}, err
 			}
-		} else {
-			if err != nil && errors.IsNotFound(err) {
-				if err := controllerutil.SetControllerReference(instance, scheduler, r.Scheme); err != nil {
-					return ctrl.Result{}, err
-				}
-				reqLogger.Info("Creating a new CeleryScheduler", "CeleryScheduler.Namespace", scheduler.Namespace, "CeleryScheduler.Name", scheduler.Name)
-				if err := r.Client.Create(ctx, scheduler); err != nil {
-					return ctrl.Result{}, err
-				}
+			reqLogger.Info("Creating a new CeleryScheduler", "CeleryScheduler.Namespace", scheduler.Namespace, "CeleryScheduler.Name", scheduler.Name)
+			if err := r.Client.Create(ctx, scheduler); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if err != nil {
+			return ctrl.Result{}, err
+		} else if !equality.Semantic.DeepEqual(found.Spec, scheduler.Spec) || !equality.Semantic.DeepEqual(found.Labels, scheduler.Labels) {
+			reqLogger.Info("Going to patch with name spec", "CeleryScheduler.Namespace", scheduler.Namespace, "CeleryScheduler.Name", scheduler.Name, "CeleryScheduler.Spec", scheduler.Spec)
+			found.Labels = scheduler.Labels
+			found.Spec = scheduler.Spec
+			if err := r.Client.Update(ctx, found); err != nil {
+				return ctrl.Result{Requeue: true}, err
 			}
 		}
 	}
@@ -148,71 +202,188 @@ func (r *CeleryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	//
 	// Handle workers
 	//
+	workers := instance.GenerateWorkers()
 	existingWorkers := &celeryv4.CeleryWorkerList{}
-	err = r.Client.List(ctx, existingWorkers, client.MatchingLabels{
+	err = r.Client.List(ctx, existingWorkers, client.InNamespace(instance.Namespace), client.MatchingLabels{
 		"celery-app": instance.Name,
 		"type":       "worker",
 	})
 	if err != nil {
 		return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
 	}
-	existing = len(existingWorkers.Items)
-	workers := instance.GenerateWorkers()
-	reqLogger.Info("Checking the difference in workers", "existing", existing, "target", len(workers))
-	if existing > len(workers) {
-		workersToBeDeleted := existingWorkers.Items[:existing-len(workers)]
-		for _, s := range workersToBeDeleted {
-			reqLogger.Info("Deleteing the worker", "CeleryWorker.Namespace", s.Namespace, "CeleryWorker.Name", s.Name)
-			err = r.Client.Delete(ctx, &s)
-			if err != nil {
-				return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
-			}
+	reqLogger.Info("Checking the difference in workers", "existing", len(existingWorkers.Items), "target", len(workers))
+	desiredWorkers := make(map[string]bool)
+	for _, worker := range workers {
+		desiredWorkers[worker.Name] = true
+	}
+	observedWorkers := make([]celeryv4.CeleryWorker, 0, len(existingWorkers.Items))
+	for i := range existingWorkers.Items {
+		s := &existingWorkers.Items[i]
+		if desiredWorkers[s.Name] {
+			observedWorkers = append(observedWorkers, *s)
+			continue
+		}
+		// The ones labelled by others are kept
+		if !metav1.IsControlledBy(s, instance) {
+			continue
+		}
+		reqLogger.Info("Deleteing the worker", "CeleryWorker.Namespace", s.Namespace, "CeleryWorker.Name", s.Name)
+		if err := r.Client.Delete(ctx, s); err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{Requeue: true, RequeueAfter: REQUEUE_TIMEOUT}, err
 		}
 	}
-	err = r.Client.List(ctx, existingWorkers, client.MatchingLabels{
-		"celery-app": instance.Name,
-		"type":       "worker",
-	})
-	for i, worker := range workers {
+	for _, worker := range workers {
 		found := &celeryv4.CeleryWorker{}
 		err = r.Client.Get(ctx, types.NamespacedName{Name: worker.Name, Namespace: worker.Namespace}, found)
-		if i < existing {
-			if err != nil && errors.IsNotFound(err) {
-				if err := controllerutil.SetControllerReference(instance, worker, r.Scheme); err != nil {
-					return ctrl.Result{}, err
-				}
-				reqLogger.Info("Creating a new CeleryWorker", "CeleryWorker.Namespace", worker.Namespace, "CeleryWorker.Name", worker.Name)
-				if err := r.Client.Create(ctx, worker); err != nil {
-					return ctrl.Result{}, err
-				}
-			} else {
-				reqLogger.Info("Going to patch with name spec", "CeleryWorker.Namespace", worker.Namespace, "CeleryWorker.Name", worker.Name, "CeleryWorker.Spec", worker.Spec)
-				existingWorkers.Items[i].Spec = worker.Spec
-				if err := r.Client.Update(ctx, &existingWorkers.Items[i]); err != nil {
-					return ctrl.Result{Requeue: true}, err
-				}
+		if err != nil && errors.IsNotFound(err) {
+			if err := controllerutil.SetControllerReference(instance, worker, r.Scheme); err != nil {
+				return ctrl.Result{}, err
+			}
+			reqLogger.Info("Creating a new CeleryWorker", "CeleryWorker.Namespace", worker.Namespace, "CeleryWorker.Name", worker.Name)
+			if err := r.Client.Create(ctx, worker); err != nil {
+				return ctrl.Result{}, err
 			}
-		} else {
-			if err != nil && errors.IsNotFound(err) {
-				if err := controllerutil.SetControllerReference(instance, worker, r.Scheme); err != nil {
-					return ctrl.Result{}, err
-				}
-				reqLogger.Info("Creating a new CeleryWorker", "CeleryWorker.Namespace", worker.Namespace, "CeleryWorker.Name", worker.Name)
-				if err := r.Client.Create(ctx, worker); err != nil {
-					return ctrl.Result{}, err
-				}
+		} else if err != nil {
+			return ctrl.Result{}, err
+		} else if !equality.Semantic.DeepEqual(found.Spec, worker.Spec) || !equality.Semantic.DeepEqual(found.Labels, worker.Labels) {
+			reqLogger.Info("Going to patch with name spec", "CeleryWorker.Namespace", worker.Namespace, "CeleryWorker.Name", worker.Name, "CeleryWorker.Spec", worker.Spec)
+			found.Labels = worker.Labels
+			found.Spec = worker.Spec
+			if err := r.Client.Update(ctx, found); err != nil {
+				return ctrl.Result{Requeue: true}, err
 			}
 		}
 	}
 
+	//
+	// Aggregate the status of pools
+	//
+	observePools(&instance.Status, observedSchedulers, observedWorkers)
+	instance.Status.Phase = getCeleryPhase(&instance.Status)
+	if err := r.updateStatus(ctx, instance, previousStatus); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// updateStatus skips the update if nothing is changed, so it will not trigger another reconciliation
+func (r *CeleryReconciler) updateStatus(ctx context.Context, instance *celeryv4.Celery, previousStatus *celeryv4.CeleryStatus) error {
+	if equality.Semantic.DeepEqual(previousStatus, &instance.Status) {
+		return nil
+	}
+	return r.Client.Status().Update(ctx, instance)
+}
+
+// observePools summarizes the schedulers and workers into the pool status and conditions
+func observePools(status *celeryv4.CeleryStatus, schedulers []celeryv4.CeleryScheduler, workers []celeryv4.CeleryWorker) {
+	status.SchedulerPools = make([]celeryv4.CeleryPoolStatus, 0, len(schedulers))
+	for i := range schedulers {
+		s := &schedulers[i]
+		status.SchedulerPools = append(status.SchedulerPools, newPoolStatus(s.Labels["pool"], s.Spec.Replicas, &s.Status.ReplicaStatus))
+	}
+	status.WorkerPools = make([]celeryv4.CeleryPoolStatus, 0, len(workers))
+	for i := range workers {
+		w := &workers[i]
+		status.WorkerPools = append(status.WorkerPools, newPoolStatus(w.Labels["pool"], w.GetDesiredReplicas(), &w.Status.ReplicaStatus))
+	}
+	// The order of the listed objects is not guaranteed
+	sort.Slice(status.SchedulerPools, func(i, j int) bool {
+		return status.SchedulerPools[i].Name < status.SchedulerPools[j].Name
+	})
+	sort.Slice(status.WorkerPools, func(i, j int) bool {
+		return status.WorkerPools[i].Name < status.WorkerPools[j].Name
+	})
+
+	readyWorkers, desiredWorkers := 0, 0
+	for _, pool := range status.WorkerPools {
+		readyWorkers += pool.ReadyReplicas
+		desiredWorkers += pool.DesiredReplicas
+	}
+	status.WorkersReady = fmt.Sprintf("%d/%d", readyWorkers, desiredWorkers)
+
+	celeryv4.SetCondition(&status.Conditions, getPoolsCondition(celeryv4.SchedulersAvailable, "schedulers", status.SchedulerPools))
+	celeryv4.SetCondition(&status.Conditions, getPoolsCondition(celeryv4.WorkersAvailable, "workers", status.WorkerPools))
+	degraded := celeryv4.Condition{
+		Type:   celeryv4.Degraded,
+		Status: corev1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	for _, pools := range []struct {
+		kind  string
+		items []celeryv4.CeleryPoolStatus
+	}{{"Scheduler", status.SchedulerPools}, {"Worker", status.WorkerPools}} {
+		for _, pool := range pools.items {
+			if pool.Reason != "" && degraded.Status == corev1.ConditionFalse {
+				degraded.Status = corev1.ConditionTrue
+				degraded.Reason = pool.Reason
+				degraded.Message = fmt.Sprintf("%s pool %s is in %s", pools.kind, pool.Name, pool.Reason)
+			}
+		}
+	}
+	celeryv4.SetCondition(&status.Conditions, degraded)
+}
+
+// newPoolStatus summarizes the replica status of a worker or scheduler
+func newPoolStatus(name string, desired int, replicaStatus *celeryv4.ReplicaStatus) celeryv4.CeleryPoolStatus {
+	pool := celeryv4.CeleryPoolStatus{
+		Name:            name,
+		DesiredReplicas: desired,
+		ReadyReplicas:   replicaStatus.ReadyReplicas,
+		UpdatedReplicas: replicaStatus.UpdatedReplicas,
+	}
+	if degraded := celeryv4.FindCondition(replicaStatus.Conditions, celeryv4.Degraded); degraded != nil && degraded.Status == corev1.ConditionTrue {
+		pool.Reason = degraded.Reason
+	}
+	return pool
+}
+
+// getPoolsCondition checks whether all the desired pods of the pools are ready
+func getPoolsCondition(conditionType celeryv4.ConditionType, kind string, pools []celeryv4.CeleryPoolStatus) celeryv4.Condition {
+	condition := celeryv4.Condition{
+		Type:    conditionType,
+		Status:  corev1.ConditionTrue,
+		Reason:  "MinimumReplicasAvailable",
+		Message: fmt.Sprintf("All the %s are ready", kind),
+	}
+	for _, pool := range pools {
+		if pool.ReadyReplicas < pool.DesiredReplicas {
+			condition.Status = corev1.ConditionFalse
+			condition.Reason = "MinimumReplicasUnavailable"
+			condition.Message = fmt.Sprintf("%d of %d %s in pool %s are ready", pool.ReadyReplicas, pool.DesiredReplicas, kind, pool.Name)
+			break
+		}
+	}
+	return condition
+}
+
+// getCeleryPhase decides the phase from the conditions of broker and pools
+func getCeleryPhase(status *celeryv4.CeleryStatus) celeryv4.CeleryPhase {
+	isTrue := func(conditionType celeryv4.ConditionType) bool {
+		condition := celeryv4.FindCondition(status.Conditions, conditionType)
+		return condition != nil && condition.Status == corev1.ConditionTrue
+	}
+	switch {
+	case isTrue(celeryv4.Degraded):
+		return celeryv4.CeleryDegraded
+	case isTrue(celeryv4.BrokerReady) && isTrue(celeryv4.SchedulersAvailable) && isTrue(celeryv4.WorkersAvailable) &&
+		(celeryv4.FindCondition(status.Conditions, celeryv4.ResultBackendReady) == nil || isTrue(celeryv4.ResultBackendReady)):
+		return celeryv4.CeleryRunning
+	default:
+		return celeryv4.CeleryPending
+	}
+}
+
 func (r *CeleryReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&celeryv4.Celery{}).
 		Owns(&celeryv4.CeleryWorker{}).
 		Owns(&celeryv4.CeleryScheduler{}).
 		Owns(&celeryv4.CeleryBroker{}).
+		Owns(&celeryv4.CeleryPeriodicTask{}).
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.mapSecretToCeleries),
+		}).
 		Complete(r)
 }
@@ -3,10 +3,14 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -57,6 +61,14 @@ var _ = Describe("Celery CRUD", func() {
 		}
 	}
 
+	// The controller keeps updating the status, so fetch the latest version before updating
+	var refreshTemplate = func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+	}
+
 	var ensureBrokerCreated = ensureObjectCreatedGenerator(&celeryv4.CeleryBroker{}, "broker")
 	var ensureWorkersCreated = ensureObjectCreatedGenerator(&celeryv4.CeleryWorker{}, "worker", 2)
 	var ensureSchedulersCreated = ensureObjectCreatedGenerator(&celeryv4.CeleryScheduler{}, "scheduler", 2)
@@ -77,6 +89,11 @@ var _ = Describe("Celery CRUD", func() {
 				Name:      uniqueName,
 			}, &celeryv4.Celery{})
 		}).Should(BeNil())
+
+		// Workers and schedulers are only created after the broker is ready
+		Eventually(func() error {
+			return markStatefulSetReady(fmt.Sprintf("%s-broker-broker-redis", uniqueName))
+		}, 2, 0.01).Should(BeNil())
 	})
 
 	AfterEach(func() {
@@ -90,6 +107,69 @@ var _ = Describe("Celery CRUD", func() {
 		ensureSchedulersCreated()
 	})
 
+	It("should publish the broker address and readiness", func() {
+		ensureBrokerCreated()
+		Eventually(func() string {
+			celery := &celeryv4.Celery{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: "default",
+					Name:      uniqueName,
+				}, celery)
+			}).Should(BeNil())
+			return celery.Status.BrokerAddress
+		}, 2, 0.1).Should(Equal(fmt.Sprintf("redis://:xxxxx@%s-broker-broker-service.default", uniqueName)))
+		Eventually(func() corev1.ConditionStatus {
+			celery := &celeryv4.Celery{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: "default",
+					Name:      uniqueName,
+				}, celery)
+			}).Should(BeNil())
+			condition := celeryv4.FindCondition(celery.Status.Conditions, celeryv4.BrokerReady)
+			if condition == nil {
+				return corev1.ConditionUnknown
+			}
+			return condition.Status
+		}, 2, 0.1).Should(Equal(corev1.ConditionTrue))
+	})
+
+	It("should aggregate the pools into status", func() {
+		ensureWorkersCreated()
+		ensureSchedulersCreated()
+		Eventually(func() string {
+			refreshTemplate()
+			return template.Status.WorkersReady
+		}, 2, 0.1).Should(Equal("0/2"))
+		Expect(template.Status.BrokerType).To(Equal(celeryv4.RedisBroker))
+		Expect(template.Status.BrokerReady).To(BeTrue())
+		Expect(template.Status.Phase).To(Equal(celeryv4.CeleryPending))
+		Expect(template.Status.WorkerPools).To(HaveLen(2))
+		Expect(template.Status.WorkerPools[0].Name).To(Equal("1"))
+		Expect(template.Status.WorkerPools[0].DesiredReplicas).To(Equal(1))
+		Expect(template.Status.SchedulerPools).To(HaveLen(2))
+
+		// Simulate the kubelet for all the pods of the stack
+		for _, name := range []string{"worker-1", "worker-2", "scheduler-1", "scheduler-2"} {
+			Eventually(func() int {
+				podList := &corev1.PodList{}
+				Expect(k8sClient.List(ctx, podList, client.MatchingLabels{
+					"celery-app": fmt.Sprintf("%s-%s", uniqueName, name),
+				})).Should(Succeed())
+				for _, pod := range podList.Items {
+					Expect(markPodReady(pod.Name)).Should(Succeed())
+				}
+				return len(podList.Items)
+			}, 2, 0.1).Should(Equal(1))
+		}
+		Eventually(func() celeryv4.CeleryPhase {
+			refreshTemplate()
+			return template.Status.Phase
+		}, 2, 0.1).Should(Equal(celeryv4.CeleryRunning))
+		Expect(template.Status.WorkersReady).To(Equal("2/2"))
+	})
+
 	It("should recreate the CRDs", func() {
 		// Delete all brokers and wait for respawning
 		ensureBrokerCreated()
@@ -137,8 +217,8 @@ var _ = Describe("Celery CRUD", func() {
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
-				Name:      fmt.Sprintf("%s-broker-broker", uniqueName),
-			}, &corev1.Pod{})
+				Name:      fmt.Sprintf("%s-broker-broker-redis", uniqueName),
+			}, &appsv1.StatefulSet{})
 		}).Should(BeNil())
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
@@ -147,6 +227,7 @@ var _ = Describe("Celery CRUD", func() {
 			}, &corev1.Service{})
 		}).Should(BeNil())
 
+		refreshTemplate()
 		template.Spec.Broker.Type = celeryv4.ExternalBroker
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -166,10 +247,14 @@ var _ = Describe("Celery CRUD", func() {
 	It("should increase and decrease the scheduler properly", func() {
 		// Delete all schedulers and wait for respawning
 		ensureSchedulersCreated()
-		template.Spec.Schedulers = append(template.Spec.Schedulers, celeryv4.CelerySchedulerSpec{
-			SchedulerClass: "a.b.c",
-			AppName:        "appName2",
-			Replicas:       1,
+		refreshTemplate()
+		template.Spec.Schedulers = append(template.Spec.Schedulers, celeryv4.CelerySchedulerPool{
+			Name: "3",
+			CelerySchedulerSpec: celeryv4.CelerySchedulerSpec{
+				SchedulerClass: "a.b.c",
+				AppName:        "appName2",
+				Replicas:       1,
+			},
 		})
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -187,6 +272,7 @@ var _ = Describe("Celery CRUD", func() {
 
 		// Delete all schedulers and wait for respawning
 		ensureSchedulersCreated()
+		refreshTemplate()
 		template.Spec.Schedulers = template.Spec.Schedulers[:1]
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -206,11 +292,15 @@ var _ = Describe("Celery CRUD", func() {
 	It("should update the scheduler correctly", func() {
 		// Delete all schedulers and wait for respawning
 		ensureSchedulersCreated()
+		refreshTemplate()
 		template.Spec.Schedulers[0].AppName = "updatedAppName"
-		template.Spec.Schedulers = append(template.Spec.Schedulers, celeryv4.CelerySchedulerSpec{
-			SchedulerClass: "a.b.c",
-			AppName:        "appName2",
-			Replicas:       1,
+		template.Spec.Schedulers = append(template.Spec.Schedulers, celeryv4.CelerySchedulerPool{
+			Name: "3",
+			CelerySchedulerSpec: celeryv4.CelerySchedulerSpec{
+				SchedulerClass: "a.b.c",
+				AppName:        "appName2",
+				Replicas:       1,
+			},
 		})
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -246,9 +336,19 @@ var _ = Describe("Celery CRUD", func() {
 			"worker",
 			"-A",
 			"test1",
-			"-b",
-			"", // FIXME The broker is not set
 		}))
+		Expect(podList.Items[0].Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{
+			{
+				Name: "CELERY_BROKER_URL",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: uniqueName + "-broker-broker-url"},
+						Key:                  celeryv4.BrokerURLKey,
+					},
+				},
+			},
+		}))
+		refreshTemplate()
 		template.Spec.Workers[0].AppName = "newAppName"
 		err = k8sClient.Update(ctx, template)
 		Eventually(func() []string {
@@ -267,16 +367,18 @@ var _ = Describe("Celery CRUD", func() {
 			"worker",
 			"-A",
 			"newAppName",
-			"-b",
-			"", // FIXME The broker is not set
 		}))
 	})
 
 	It("should increase and decrease the worker properly", func() {
 		ensureWorkersCreated()
-		template.Spec.Workers = append(template.Spec.Workers, celeryv4.CeleryWorkerSpec{
-			AppName:  "appName2",
-			Replicas: 1,
+		refreshTemplate()
+		template.Spec.Workers = append(template.Spec.Workers, celeryv4.CeleryWorkerPool{
+			Name: "3",
+			CeleryWorkerSpec: celeryv4.CeleryWorkerSpec{
+				AppName:  "appName2",
+				Replicas: 1,
+			},
 		})
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -292,6 +394,7 @@ var _ = Describe("Celery CRUD", func() {
 			return len(list.Items)
 		}, 2, 0.1).Should(BeNumerically("==", 3))
 
+		refreshTemplate()
 		template.Spec.Workers = template.Spec.Workers[:1]
 		err = k8sClient.Update(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
@@ -307,4 +410,258 @@ var _ = Describe("Celery CRUD", func() {
 			return len(list.Items)
 		}, 2, 0.1).Should(BeNumerically("==", 1))
 	})
+
+	It("should only delete the removed worker pool", func() {
+		ensureWorkersCreated()
+		remaining := &celeryv4.CeleryWorker{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      fmt.Sprintf("%s-worker-2", uniqueName),
+		}, remaining)).Should(Succeed())
+
+		refreshTemplate()
+		template.Spec.Workers = template.Spec.Workers[1:]
+		err = k8sClient.Update(ctx, template)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-worker-1", uniqueName),
+			}, &celeryv4.CeleryWorker{})
+			return errors.IsNotFound(err)
+		}, 2, 0.1).Should(BeTrue())
+
+		worker := &celeryv4.CeleryWorker{}
+		Consistently(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-worker-2", uniqueName),
+			}, worker)
+		}, 1, 0.1).Should(BeNil())
+		Expect(worker.UID).To(Equal(remaining.UID))
+		Expect(worker.Spec.AppName).To(Equal("test2"))
+	})
+
+	It("should keep the labelled workers not created by the celery", func() {
+		ensureWorkersCreated()
+		manual := &celeryv4.CeleryWorker{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-manual", uniqueName),
+				Namespace: "default",
+				Labels: map[string]string{
+					"celery-app": uniqueName,
+					"type":       "worker",
+				},
+			},
+			Spec: celeryv4.CeleryWorkerSpec{
+				AppName:  "manual",
+				Replicas: 1,
+			},
+		}
+		Expect(k8sClient.Create(ctx, manual)).Should(Succeed())
+		defer k8sClient.Delete(ctx, manual)
+
+		// Trigger a reconciliation of the celery
+		refreshTemplate()
+		template.Spec.Workers[0].Replicas++
+		Expect(k8sClient.Update(ctx, template)).Should(Succeed())
+		Consistently(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      manual.Name,
+			}, &celeryv4.CeleryWorker{})
+		}, 1, 0.1).Should(BeNil())
+	})
+
+	It("should not touch the workers after reordering the pools", func() {
+		ensureWorkersCreated()
+		before := &celeryv4.CeleryWorker{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      fmt.Sprintf("%s-worker-1", uniqueName),
+		}, before)).Should(Succeed())
+
+		refreshTemplate()
+		template.Spec.Workers[0], template.Spec.Workers[1] = template.Spec.Workers[1], template.Spec.Workers[0]
+		err = k8sClient.Update(ctx, template)
+		Expect(err).NotTo(HaveOccurred())
+
+		Consistently(func() string {
+			after := &celeryv4.CeleryWorker{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-worker-1", uniqueName),
+			}, after)).Should(Succeed())
+			return after.ResourceVersion
+		}, 1, 0.1).Should(Equal(before.ResourceVersion))
+	})
+})
+
+var _ = Describe("Celery broker readiness", func() {
+	var template *celeryv4.Celery
+	var uniqueName string
+	var err error
+
+	BeforeEach(func() {
+		template = &celeryv4.Celery{}
+		err = getTemplateConfig("../tests/fixtures/celery.yaml", template)
+		Expect(err).NotTo(HaveOccurred())
+		uniqueName = template.Name + rand.String(5)
+		template.Name = uniqueName
+
+		err = k8sClient.Create(ctx, template)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		_ = k8sClient.Delete(ctx, template)
+	})
+
+	It("should not create workers and schedulers before the broker is ready", func() {
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-broker-broker-redis", uniqueName),
+			}, &appsv1.StatefulSet{})
+		}, 2, 0.01).Should(BeNil())
+		Consistently(func() int {
+			list := &celeryv4.CeleryWorkerList{}
+			Expect(k8sClient.List(ctx, list, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "worker",
+			})).Should(Succeed())
+			return len(list.Items)
+		}, 1, 0.1).Should(BeNumerically("==", 0))
+		Consistently(func() int {
+			list := &celeryv4.CelerySchedulerList{}
+			Expect(k8sClient.List(ctx, list, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "scheduler",
+			})).Should(Succeed())
+			return len(list.Items)
+		}, 1, 0.1).Should(BeNumerically("==", 0))
+
+		Expect(markStatefulSetReady(fmt.Sprintf("%s-broker-broker-redis", uniqueName))).Should(Succeed())
+		Eventually(func() int {
+			list := &celeryv4.CeleryWorkerList{}
+			Expect(k8sClient.List(ctx, list, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "worker",
+			})).Should(Succeed())
+			return len(list.Items)
+		}, 2, 0.1).Should(BeNumerically("==", 2))
+	})
+})
+
+var _ = Describe("Celery result backend", func() {
+	var template *celeryv4.Celery
+	var uniqueName string
+	var err error
+
+	BeforeEach(func() {
+		template = &celeryv4.Celery{}
+		err = getTemplateConfig("../tests/fixtures/celery.yaml", template)
+		Expect(err).NotTo(HaveOccurred())
+		uniqueName = template.Name + rand.String(5)
+		template.Name = uniqueName
+		database := int32(2)
+		template.Spec.ResultBackend = &celeryv4.ResultBackendSpec{
+			Type:     celeryv4.BrokerResultBackend,
+			Database: &database,
+			Expires:  &metav1.Duration{Duration: time.Hour},
+		}
+
+		err = k8sClient.Create(ctx, template)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() error {
+			return markStatefulSetReady(fmt.Sprintf("%s-broker-broker-redis", uniqueName))
+		}, 2, 0.01).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		_ = k8sClient.Delete(ctx, template)
+	})
+
+	It("should reuse the managed redis broker with another database", func() {
+		secret := &corev1.Secret{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-result-backend-url",
+			}, secret)
+		}, 2, 0.1).Should(Succeed())
+		Expect(string(secret.Data[celeryv4.BrokerURLKey])).To(HavePrefix("redis://:"))
+		Expect(string(secret.Data[celeryv4.BrokerURLKey])).To(HaveSuffix(fmt.Sprintf("@%s-broker-broker-service.default/2", uniqueName)))
+
+		Eventually(func() bool {
+			celery := &celeryv4.Celery{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, celery)).Should(Succeed())
+			condition := celeryv4.FindCondition(celery.Status.Conditions, celeryv4.ResultBackendReady)
+			return condition != nil && condition.Status == corev1.ConditionTrue &&
+				celery.Status.ResultBackendAddress == fmt.Sprintf("redis://:xxxxx@%s-broker-broker-service.default/2", uniqueName)
+		}, 2, 0.1).Should(BeTrue())
+
+		// The result backend is passed to every worker and scheduler
+		worker := &celeryv4.CeleryWorker{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-worker-1", uniqueName),
+			}, worker)
+		}, 2, 0.1).Should(Succeed())
+		Expect(worker.Spec.ResultBackend).NotTo(BeNil())
+		Expect(worker.Spec.ResultBackend.AddressSecretRef.Name).To(Equal(secret.Name))
+		Expect(worker.Spec.ResultBackend.Expires.Duration).To(Equal(time.Hour))
+		scheduler := &celeryv4.CeleryScheduler{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-scheduler-1", uniqueName),
+			}, scheduler)
+		}, 2, 0.1).Should(Succeed())
+		Expect(scheduler.Spec.ResultBackend).NotTo(BeNil())
+		Expect(scheduler.Spec.ResultBackend.AddressHash).To(Equal(worker.Spec.ResultBackend.AddressHash))
+	})
+
+	It("should clear the previous result backend after the type is changed", func() {
+		celery := &celeryv4.Celery{}
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, celery)).Should(Succeed())
+			return celery.Status.ResultBackend != nil
+		}, 2, 0.1).Should(BeTrue())
+		worker := &celeryv4.CeleryWorker{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      fmt.Sprintf("%s-worker-1", uniqueName),
+			}, worker)
+		}, 2, 0.1).Should(Succeed())
+
+		// The dedicated redis is not ready, so the reused broker should not be reported any more
+		celery.Spec.ResultBackend.Type = celeryv4.RedisResultBackend
+		Expect(k8sClient.Update(ctx, celery)).Should(Succeed())
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, celery)).Should(Succeed())
+			condition := celeryv4.FindCondition(celery.Status.Conditions, celeryv4.ResultBackendReady)
+			return condition != nil && condition.Reason == "ResultBackendNotReady" &&
+				celery.Status.ResultBackend == nil && celery.Status.ResultBackendAddress == ""
+		}, 2, 0.1).Should(BeTrue())
+
+		// The workers are left as they are until the new result backend is ready
+		updated := &celeryv4.CeleryWorker{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      worker.Name,
+		}, updated)).Should(Succeed())
+		Expect(updated.Spec.ResultBackend).To(Equal(worker.Spec.ResultBackend))
+	})
 })
@@ -0,0 +1,262 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+)
+
+// reconcileResultBackend resolves the url of the result backend for workers and schedulers
+// and publishes it in status with the ResultBackendReady condition.
+// The previous one is cleared while the result backend is failed or not ready, e.g. after its type is changed,
+// so the pools are never generated with a stale result backend. It returns false if the result backend is not ready yet.
+func (r *CeleryReconciler) reconcileResultBackend(ctx context.Context, instance *celeryv4.Celery, broker *celeryv4.CeleryBroker) (bool, error) {
+	spec := instance.Spec.ResultBackend
+	resultBackendType := celeryv4.ResultBackendType("")
+	if spec != nil {
+		resultBackendType = spec.GetType()
+	}
+	// Clean up the objects of the result backend types no longer used
+	if resultBackendType != celeryv4.RedisResultBackend {
+		if err := r.deleteIfControlled(ctx, instance, &celeryv4.CeleryBroker{}, instance.GetName()+"-result-backend"); err != nil {
+			return false, err
+		}
+	}
+	if resultBackendType != celeryv4.BrokerResultBackend {
+		if err := r.deleteIfControlled(ctx, instance, &corev1.Secret{}, instance.GetName()+"-result-backend-url"); err != nil {
+			return false, err
+		}
+	}
+	if spec == nil || spec.CleanupCrontab == "" || len(instance.Spec.Schedulers) == 0 {
+		if err := r.deleteIfControlled(ctx, instance, &celeryv4.CeleryPeriodicTask{}, instance.GetBackendCleanupTaskName()); err != nil {
+			return false, err
+		}
+	} else if err := r.reconcileBackendCleanupTask(ctx, instance); err != nil {
+		return false, err
+	}
+	if spec == nil {
+		instance.Status.ResultBackend = nil
+		instance.Status.ResultBackendAddress = ""
+		celeryv4.RemoveCondition(&instance.Status.Conditions, celeryv4.ResultBackendReady)
+		return true, nil
+	}
+
+	var resultBackend *celeryv4.ResultBackendReference
+	var addr string
+	var err error
+	switch resultBackendType {
+	case celeryv4.BrokerResultBackend:
+		resultBackend, addr, err = r.reuseBrokerAsResultBackend(ctx, instance, broker)
+	case celeryv4.RedisResultBackend:
+		resultBackend, addr, err = r.reconcileDedicatedResultBackend(ctx, instance)
+	case celeryv4.ExternalResultBackend:
+		if spec.AddressSecretRef == nil {
+			err = fmt.Errorf("external result backend requires addressSecretRef")
+			break
+		}
+		addr, err = getBrokerAddress(ctx, r.Client, instance.Namespace, "", spec.AddressSecretRef)
+		resultBackend = &celeryv4.ResultBackendReference{
+			AddressSecretRef: spec.AddressSecretRef,
+			AddressHash:      celeryv4.HashBrokerAddress(addr),
+		}
+	default:
+		err = fmt.Errorf("unsupported result backend type %s", resultBackendType)
+	}
+
+	condition := celeryv4.Condition{
+		Type:    celeryv4.ResultBackendReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  "ResultBackendReady",
+		Message: "The result backend is ready",
+	}
+	ready := err == nil && resultBackend != nil
+	switch {
+	case err != nil:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "InvalidResultBackend"
+		condition.Message = err.Error()
+	case resultBackend == nil:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "ResultBackendNotReady"
+		condition.Message = "Waiting for the result backend to be ready"
+	}
+	if ready {
+		instance.Status.ResultBackend = resultBackend
+		instance.Status.ResultBackendAddress = celeryv4.RedactBrokerAddress(addr)
+	} else {
+		instance.Status.ResultBackend = nil
+		instance.Status.ResultBackendAddress = ""
+	}
+	celeryv4.SetCondition(&instance.Status.Conditions, condition)
+	return ready, err
+}
+
+// reuseBrokerAsResultBackend stores the url of the managed redis broker with another database in a secret.
+// The transport options are shared as the result backend connects to the same sentinels.
+func (r *CeleryReconciler) reuseBrokerAsResultBackend(ctx context.Context, instance *celeryv4.Celery, broker *celeryv4.CeleryBroker) (*celeryv4.ResultBackendReference, string, error) {
+	if broker.GetType() != celeryv4.RedisBroker {
+		return nil, "", fmt.Errorf("only the managed redis broker can be reused as result backend, got %s", broker.GetType())
+	}
+	if broker.Status.BrokerAddressSecretRef == nil {
+		return nil, "", nil
+	}
+	brokerAddr, err := getBrokerAddress(ctx, r.Client, instance.Namespace, "", broker.Status.BrokerAddressSecretRef)
+	if err != nil {
+		return nil, "", err
+	}
+	addr, err := celeryv4.WithRedisDatabase(brokerAddr, instance.Spec.ResultBackend.GetDatabase())
+	if err != nil {
+		return nil, "", err
+	}
+	secret := instance.GenerateResultBackendSecret(addr)
+	found := &corev1.Secret{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, "", err
+	}
+	if err != nil {
+		if err := controllerutil.SetControllerReference(instance, secret, r.Scheme); err != nil {
+			return nil, "", err
+		}
+		r.Log.Info("Creating the result backend url secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		if err := r.Client.Create(ctx, secret); err != nil {
+			return nil, "", err
+		}
+	} else if !equality.Semantic.DeepEqual(found.Data, secret.Data) {
+		r.Log.Info("Updating the result backend url secret", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+		found.Data = secret.Data
+		if err := r.Client.Update(ctx, found); err != nil {
+			return nil, "", err
+		}
+	}
+	return &celeryv4.ResultBackendReference{
+		AddressSecretRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+			Key:                  celeryv4.BrokerURLKey,
+		},
+		AddressHash:      celeryv4.HashBrokerAddress(addr),
+		TransportOptions: broker.Status.TransportOptions,
+	}, addr, nil
+}
+
+// reconcileDedicatedResultBackend creates the dedicated redis as a CeleryBroker and waits for it
+func (r *CeleryReconciler) reconcileDedicatedResultBackend(ctx context.Context, instance *celeryv4.Celery) (*celeryv4.ResultBackendReference, string, error) {
+	backend := instance.GenerateResultBackend()
+	found := &celeryv4.CeleryBroker{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: backend.Name, Namespace: backend.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, "", err
+	}
+	if err != nil {
+		if err := controllerutil.SetControllerReference(instance, backend, r.Scheme); err != nil {
+			return nil, "", err
+		}
+		r.Log.Info("Creating the result backend", "CeleryBroker.Namespace", backend.Namespace, "CeleryBroker.Name", backend.Name)
+		return nil, "", r.Client.Create(ctx, backend)
+	}
+	if !found.Equal(backend) {
+		r.Log.Info("Updating the result backend", "CeleryBroker.Namespace", found.Namespace, "CeleryBroker.Name", found.Name)
+		found.Spec = backend.Spec
+		if err := r.Client.Update(ctx, found); err != nil {
+			return nil, "", err
+		}
+	}
+	if !found.Status.Ready || found.Status.BrokerAddressSecretRef == nil {
+		return nil, "", nil
+	}
+	return &celeryv4.ResultBackendReference{
+		AddressSecretRef: found.Status.BrokerAddressSecretRef,
+		AddressHash:      found.Status.BrokerAddressHash,
+		TransportOptions: found.Status.TransportOptions,
+	}, found.Status.BrokerAddress, nil
+}
+
+// reconcileBackendCleanupTask schedules celery.backend_cleanup in the first scheduler pool
+func (r *CeleryReconciler) reconcileBackendCleanupTask(ctx context.Context, instance *celeryv4.Celery) error {
+	task := instance.GenerateBackendCleanupTask()
+	found := &celeryv4.CeleryPeriodicTask{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: task.Name, Namespace: task.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err != nil {
+		if err := controllerutil.SetControllerReference(instance, task, r.Scheme); err != nil {
+			return err
+		}
+		r.Log.Info("Creating the result backend cleanup", "CeleryPeriodicTask.Namespace", task.Namespace, "CeleryPeriodicTask.Name", task.Name)
+		return r.Client.Create(ctx, task)
+	}
+	if !equality.Semantic.DeepEqual(found.Spec, task.Spec) {
+		found.Spec = task.Spec
+		return r.Client.Update(ctx, found)
+	}
+	return nil
+}
+
+// deleteIfControlled deletes the object only if it is created by the Celery
+func (r *CeleryReconciler) deleteIfControlled(ctx context.Context, instance *celeryv4.Celery, object runtime.Object, name string) error {
+	err := r.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, object)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta, ok := object.(metav1.Object)
+	if !ok || !metav1.IsControlledBy(meta, instance) {
+		return nil
+	}
+	if err := r.Client.Delete(ctx, object); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// mapSecretToCeleries finds the Celery stacks referring to the secret of external result backend,
+// so the rotated credentials are picked up
+func (r *CeleryReconciler) mapSecretToCeleries(object handler.MapObject) []reconcile.Request {
+	celeries := &celeryv4.CeleryList{}
+	if err := r.Client.List(context.Background(), celeries, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "Failed to list the celeries for secret", "Secret.Namespace", object.Meta.GetNamespace(), "Secret.Name", object.Meta.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, celery := range celeries.Items {
+		resultBackend := celery.Spec.ResultBackend
+		if resultBackend != nil && resultBackend.GetType() == celeryv4.ExternalResultBackend &&
+			resultBackend.AddressSecretRef != nil && resultBackend.AddressSecretRef.Name == object.Meta.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: celery.Name, Namespace: celery.Namespace},
+			})
+		}
+	}
+	return requests
+}
@@ -18,14 +18,25 @@ package controllers
 
 import (
 	"context"
+	"reflect"
+	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+	"github.com/RyanSiu1995/celery-operator/pkg/broker"
 )
 
 // CeleryBrokerReconciler reconciles a CeleryBroker object
@@ -37,6 +48,8 @@ type CeleryBrokerReconciler Reconciler
 // +kubebuilder:rbac:groups=core,resources=pod/status,verbs=get
 // +kubebuilder:rbac:groups=core,resources=service,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=service/status,verbs=get
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CeleryBrokerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -57,41 +70,40 @@ func (r *CeleryBrokerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 	}
 	reqLogger.Info("Getting the spec of broker", "Broker.Namespace", instance.Namespace, "Broker.Name", instance.Name, "Broker.Spec", instance.Spec)
 	// Handle the object creation
-	if instance.Spec.Type == celeryv4.ExternalBroker {
-		instance.Status.BrokerAddress = instance.Spec.BrokerAddress
-		pod, service, _ := instance.Generate()
-		found := &corev1.Pod{}
-		err = r.Client.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found)
-		if err == nil {
-			if err = r.Client.Delete(ctx, found); err != nil {
-				return ctrl.Result{}, err
-			}
-			if err := r.Client.Delete(ctx, service); err != nil {
-				return ctrl.Result{}, err
-			}
-		}
-	} else {
-		pod, service, addr := instance.Generate()
-		found := &corev1.Pod{}
-		err = r.Client.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found)
-		if err != nil && errors.IsNotFound(err) {
-			if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			if err := controllerutil.SetControllerReference(instance, service, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			reqLogger.Info("Creating a new Broker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-			if err := r.Client.Create(ctx, pod); err != nil {
-				return ctrl.Result{}, err
-			}
-
-			reqLogger.Info("Creating a new Broker service", "Service.Namespace", service.Namespace, "Service.Name", service.Name)
-			if err := r.Client.Create(ctx, service); err != nil {
-				return ctrl.Result{}, err
-			}
+	switch instance.Spec.Type {
+	case celeryv4.ExternalBroker:
+		addr, err := r.resolveExternalAddress(ctx, instance)
+		if err != nil {
+			// The broker will be reconciled again after the secret is updated
+			reqLogger.Error(err, "Failed to resolve the external broker address")
 		}
 		instance.Status.BrokerAddress = addr
+		instance.Status.Ready = addr != ""
+		instance.Status.TransportOptions = nil
+		instance.Status.Primary = ""
+		if err := r.cleanupRedis(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.cleanupRabbitMQ(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	case celeryv4.RabbitMQBroker:
+		if err := r.cleanupRedis(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileRabbitMQ(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	default:
+		if err := r.cleanupRabbitMQ(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileRedis(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if err := r.reconcileURLSecret(ctx, instance); err != nil {
+		return ctrl.Result{}, err
 	}
 	err = r.Client.Status().Update(ctx, instance)
 	if err != nil {
@@ -101,11 +113,313 @@ func (r *CeleryBrokerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 	return ctrl.Result{}, nil
 }
 
+// reconcileRedis creates the statefulset and service of the redis broker
+func (r *CeleryBrokerReconciler) reconcileRedis(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	// The redis broker was a bare pod in the previous versions
+	legacyPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + "-broker",
+			Namespace: instance.Namespace,
+		},
+	}
+	if err := r.deleteIfExists(ctx, legacyPod); err != nil {
+		return err
+	}
+
+	if instance.IsHighAvailability() {
+		return r.reconcileRedisHighAvailability(ctx, instance)
+	}
+	if err := r.cleanupRedisSentinel(ctx, instance); err != nil {
+		return err
+	}
+
+	credentials, err := r.reconcileCredentials(ctx, instance)
+	if err != nil {
+		return err
+	}
+	statefulSet, service, addr := instance.GenerateRedis(credentials)
+	if _, err := r.createIfNotFound(ctx, instance, service, &corev1.Service{}); err != nil {
+		return err
+	}
+	ready, err := r.reconcileStatefulSet(ctx, instance, statefulSet)
+	if err != nil {
+		return err
+	}
+	instance.Status.Ready = ready
+	instance.Status.BrokerAddress = addr
+	instance.Status.TransportOptions = nil
+	instance.Status.Primary = ""
+	return nil
+}
+
+// reconcileRedisHighAvailability creates the redis and sentinel statefulsets
+// and finds the current primary from the sentinels
+func (r *CeleryBrokerReconciler) reconcileRedisHighAvailability(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	reqLogger := r.Log.WithValues("celerybroker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	credentials, err := r.reconcileCredentials(ctx, instance)
+	if err != nil {
+		return err
+	}
+	// The single node service is not used by the sentinel address
+	_, service, _ := instance.GenerateRedis(credentials)
+	if err := r.deleteIfExists(ctx, service); err != nil {
+		return err
+	}
+
+	redis, sentinel, services, addr := instance.GenerateRedisHighAvailability(credentials)
+	for _, service := range services {
+		if _, err := r.createIfNotFound(ctx, instance, service, &corev1.Service{}); err != nil {
+			return err
+		}
+	}
+	redisReady, err := r.reconcileStatefulSet(ctx, instance, redis)
+	if err != nil {
+		return err
+	}
+	sentinelReady, err := r.reconcileStatefulSet(ctx, instance, sentinel)
+	if err != nil {
+		return err
+	}
+	instance.Status.Ready = redisReady && sentinelReady
+	instance.Status.BrokerAddress = addr
+	instance.Status.TransportOptions = instance.GetTransportOptions()
+	if !instance.Status.Ready {
+		instance.Status.Primary = ""
+		return nil
+	}
+
+	primary, err := broker.GetSentinelPrimary(addr, instance.Status.TransportOptions)
+	if err != nil {
+		// The broker is still usable and the primary will be found in the next round
+		reqLogger.Info("Failed to get the primary from sentinels", "Error", err.Error())
+		return nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.Client.List(ctx, pods, client.InNamespace(instance.Namespace), client.MatchingLabels(redis.Spec.Selector.MatchLabels)); err != nil {
+		return err
+	}
+	instance.Status.Primary = ""
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == primary || pod.Name == primary || strings.HasPrefix(primary, pod.Name+".") {
+			instance.Status.Primary = pod.Name
+			break
+		}
+	}
+	return nil
+}
+
+// reconcileRabbitMQ creates the credentials, statefulset and services of the rabbitmq broker
+func (r *CeleryBrokerReconciler) reconcileRabbitMQ(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	credentials, err := r.reconcileCredentials(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	statefulSet, services, addr := instance.GenerateRabbitMQ(credentials)
+	for _, service := range services {
+		if _, err := r.createIfNotFound(ctx, instance, service, &corev1.Service{}); err != nil {
+			return err
+		}
+	}
+	ready, err := r.reconcileStatefulSet(ctx, instance, statefulSet)
+	if err != nil {
+		return err
+	}
+	instance.Status.Ready = ready
+	instance.Status.BrokerAddress = addr
+	instance.Status.TransportOptions = nil
+	instance.Status.Primary = ""
+	return nil
+}
+
+// reconcileCredentials creates the secret with the generated password of the managed broker
+func (r *CeleryBrokerReconciler) reconcileCredentials(ctx context.Context, instance *celeryv4.CeleryBroker) (*corev1.Secret, error) {
+	credentials := &corev1.Secret{}
+	if _, err := r.createIfNotFound(ctx, instance, instance.GenerateCredentials(), credentials); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// resolveExternalAddress reads the external broker address from the secret if it is given
+func (r *CeleryBrokerReconciler) resolveExternalAddress(ctx context.Context, instance *celeryv4.CeleryBroker) (string, error) {
+	ref := instance.Spec.BrokerAddressSecretRef
+	if ref == nil {
+		return instance.Spec.BrokerAddress, nil
+	}
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: instance.Namespace}, secret); err != nil {
+		return "", err
+	}
+	return instance.ResolveExternalAddress(secret)
+}
+
+// reconcileURLSecret keeps the broker address in the secret consumed by workers and schedulers.
+// Only the redacted address is published in the status.
+func (r *CeleryBrokerReconciler) reconcileURLSecret(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	addr := instance.Status.BrokerAddress
+	if addr == "" {
+		instance.Status.BrokerAddressSecretRef = nil
+		instance.Status.BrokerAddressHash = ""
+		return nil
+	}
+	secret := instance.GenerateURLSecret(addr)
+	found := &corev1.Secret{}
+	created, err := r.createIfNotFound(ctx, instance, secret, found)
+	if err != nil {
+		return err
+	}
+	if !created && string(found.Data[celeryv4.BrokerURLKey]) != addr {
+		r.Log.Info("Updating the Broker url secret", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+		found.Data = secret.Data
+		if err := r.Client.Update(ctx, found); err != nil {
+			return err
+		}
+	}
+	instance.Status.BrokerAddress = celeryv4.RedactBrokerAddress(addr)
+	instance.Status.BrokerAddressHash = celeryv4.HashBrokerAddress(addr)
+	instance.Status.BrokerAddressSecretRef = &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+		Key:                  celeryv4.BrokerURLKey,
+	}
+	return nil
+}
+
+// reconcileStatefulSet creates or updates the statefulset of the broker and returns its readiness.
+// The volume claim templates cannot be updated, so the statefulset is recreated when they are changed.
+// The existing volume claims are kept and reused.
+func (r *CeleryBrokerReconciler) reconcileStatefulSet(ctx context.Context, instance *celeryv4.CeleryBroker, statefulSet *appsv1.StatefulSet) (bool, error) {
+	reqLogger := r.Log.WithValues("celerybroker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	found := &appsv1.StatefulSet{}
+	created, err := r.createIfNotFound(ctx, instance, statefulSet, found)
+	if err != nil || created {
+		return false, err
+	}
+	if len(statefulSet.Spec.VolumeClaimTemplates) != len(found.Spec.VolumeClaimTemplates) ||
+		!equality.Semantic.DeepDerivative(statefulSet.Spec.VolumeClaimTemplates, found.Spec.VolumeClaimTemplates) {
+		reqLogger.Info("Recreating the Broker statefulset for the new volumes", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+		return false, r.deleteIfExists(ctx, found)
+	}
+	if statefulSet.Spec.ServiceName != found.Spec.ServiceName {
+		reqLogger.Info("Recreating the Broker statefulset for the new service", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+		return false, r.deleteIfExists(ctx, found)
+	}
+	if !equality.Semantic.DeepDerivative(statefulSet.Spec.Template, found.Spec.Template) ||
+		!equality.Semantic.DeepEqual(statefulSet.Spec.Replicas, found.Spec.Replicas) {
+		reqLogger.Info("Updating the Broker statefulset", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+		found.Spec.Replicas = statefulSet.Spec.Replicas
+		found.Spec.Template = statefulSet.Spec.Template
+		if err := r.Client.Update(ctx, found); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return found.Status.ReadyReplicas > 0, nil
+}
+
+// cleanupRedis deletes the redis broker after switching to other broker types
+func (r *CeleryBrokerReconciler) cleanupRedis(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	statefulSet, service, _ := instance.GenerateRedis(instance.GenerateCredentials())
+	if err := r.deleteIfExists(ctx, statefulSet); err != nil {
+		return err
+	}
+	if err := r.deleteIfExists(ctx, service); err != nil {
+		return err
+	}
+	return r.cleanupRedisSentinel(ctx, instance)
+}
+
+// cleanupRedisSentinel deletes the sentinels and headless services after disabling high availability
+func (r *CeleryBrokerReconciler) cleanupRedisSentinel(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	_, sentinel, services, _ := instance.GenerateRedisHighAvailability(instance.GenerateCredentials())
+	if err := r.deleteIfExists(ctx, sentinel); err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := r.deleteIfExists(ctx, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupRabbitMQ deletes the rabbitmq broker after switching to other broker types
+func (r *CeleryBrokerReconciler) cleanupRabbitMQ(ctx context.Context, instance *celeryv4.CeleryBroker) error {
+	statefulSet, services, _ := instance.GenerateRabbitMQ(instance.GenerateCredentials())
+	if err := r.deleteIfExists(ctx, statefulSet); err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := r.deleteIfExists(ctx, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIfNotFound creates the object owned by the broker if it does not exist.
+// The existing or created object will be kept in found.
+func (r *CeleryBrokerReconciler) createIfNotFound(ctx context.Context, instance *celeryv4.CeleryBroker, object runtime.Object, found runtime.Object) (bool, error) {
+	key, err := client.ObjectKeyFromObject(object)
+	if err != nil {
+		return false, err
+	}
+	err = r.Client.Get(ctx, key, found)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+	if err := controllerutil.SetControllerReference(instance, object.(metav1.Object), r.Scheme); err != nil {
+		return false, err
+	}
+	r.Log.Info("Creating a new Broker object", "Kind", reflect.TypeOf(object).Elem().Name(), "Namespace", key.Namespace, "Name", key.Name)
+	if err := r.Client.Create(ctx, object); err != nil {
+		return false, err
+	}
+	reflect.ValueOf(found).Elem().Set(reflect.ValueOf(object).Elem())
+	return true, nil
+}
+
+// deleteIfExists deletes the object and ignores the not found error
+func (r *CeleryBrokerReconciler) deleteIfExists(ctx context.Context, object runtime.Object) error {
+	if err := r.Client.Delete(ctx, object); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// mapSecretToBrokers finds the external brokers referring to the secret, so the rotated credentials are picked up
+func (r *CeleryBrokerReconciler) mapSecretToBrokers(object handler.MapObject) []reconcile.Request {
+	brokers := &celeryv4.CeleryBrokerList{}
+	if err := r.Client.List(context.Background(), brokers, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "Failed to list the brokers for secret", "Secret.Namespace", object.Meta.GetNamespace(), "Secret.Name", object.Meta.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, broker := range brokers.Items {
+		ref := broker.Spec.BrokerAddressSecretRef
+		if ref != nil && ref.Name == object.Meta.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: broker.Name, Namespace: broker.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
 func (r *CeleryBrokerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&celeryv4.CeleryBroker{}).
 		Owns(&corev1.Service{}).
-		Owns(&corev1.Pod{}).
+		Owns(&corev1.Secret{}).
+		Owns(&appsv1.StatefulSet{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.mapSecretToBrokers),
+		}).
 		Complete(r)
 }
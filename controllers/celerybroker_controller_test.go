@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"fmt"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -38,12 +43,12 @@ var _ = Describe("CeleryBroker CRUD", func() {
 		_ = k8sClient.Delete(ctx, template)
 	})
 
-	It("should have a single broker pod and service", func() {
+	It("should have a single broker statefulset and service", func() {
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
-				Name:      uniqueName + "-broker",
-			}, &corev1.Pod{})
+				Name:      uniqueName + "-broker-redis",
+			}, &appsv1.StatefulSet{})
 		}).Should(BeNil())
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
@@ -53,6 +58,22 @@ var _ = Describe("CeleryBroker CRUD", func() {
 		}).Should(BeNil())
 	})
 
+	It("should report the broker as ready once the statefulset is ready", func() {
+		Eventually(func() error {
+			return markStatefulSetReady(uniqueName + "-broker-redis")
+		}, 2, 0.01).Should(BeNil())
+		Eventually(func() bool {
+			broker := &celeryv4.CeleryBroker{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: "default",
+					Name:      uniqueName,
+				}, broker)
+			}).Should(BeNil())
+			return broker.Status.Ready
+		}, 2, 0.1).Should(BeTrue())
+	})
+
 	It("should update the broker correctly", func() {
 		template.Spec.Type = celeryv4.ExternalBroker
 		err = k8sClient.Update(ctx, template)
@@ -71,18 +92,80 @@ var _ = Describe("CeleryBroker CRUD", func() {
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
-				Name:      uniqueName + "-broker",
-			}, &corev1.Pod{})
+				Name:      uniqueName + "-broker-redis",
+			}, &appsv1.StatefulSet{})
+		}, 2, 0.1).ShouldNot(BeNil())
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-service",
+			}, &corev1.Service{})
 		}, 2, 0.1).ShouldNot(BeNil())
+	})
+
+	It("should switch to rabbitmq with generated credentials", func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+		template.Spec.Type = celeryv4.RabbitMQBroker
+		err = k8sClient.Update(ctx, template)
+		Expect(err).To(BeNil())
+
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-rabbitmq",
+			}, &appsv1.StatefulSet{})
+		}, 2, 0.1).Should(BeNil())
+		for _, suffix := range []string{"-broker-amqp", "-broker-management"} {
+			Eventually(func() error {
+				return k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: "default",
+					Name:      uniqueName + suffix,
+				}, &corev1.Service{})
+			}, 2, 0.1).Should(BeNil())
+		}
+		secret := &corev1.Secret{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-credentials",
+			}, secret)
+		}, 2, 0.1).Should(BeNil())
+		Expect(secret.Data[celeryv4.BrokerPasswordKey]).NotTo(BeEmpty())
+
+		// The redis broker should be removed
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
 				Name:      uniqueName + "-broker-service",
 			}, &corev1.Service{})
 		}, 2, 0.1).ShouldNot(BeNil())
+
+		Eventually(func() string {
+			broker := &celeryv4.CeleryBroker{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, broker)).Should(Succeed())
+			return broker.Status.BrokerAddress
+		}, 2, 0.1).Should(Equal(fmt.Sprintf("amqp://celery:xxxxx@%s-broker-amqp.default:5672/%%2F", uniqueName)))
+
+		urlSecret := &corev1.Secret{}
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-url",
+			}, urlSecret)).Should(Succeed())
+			return string(urlSecret.Data[celeryv4.BrokerURLKey])
+		}, 2, 0.1).Should(Equal(fmt.Sprintf("amqp://celery:%s@%s-broker-amqp.default:5672/%%2F",
+			string(secret.Data[celeryv4.BrokerPasswordKey]),
+			uniqueName,
+		)))
 	})
 
-	It("should recreate the service and pod after deleting them", func() {
+	It("should recreate the service and statefulset after deleting them", func() {
 		// Not able to delete the service
 		Consistently(func() error {
 			return k8sClient.DeleteAllOf(ctx,
@@ -95,9 +178,9 @@ var _ = Describe("CeleryBroker CRUD", func() {
 			)
 		}).ShouldNot(BeNil())
 
-		// Delete pod
-		k8sClient.DeleteAllOf(ctx,
-			&corev1.Pod{},
+		// Delete statefulset
+		err = k8sClient.DeleteAllOf(ctx,
+			&appsv1.StatefulSet{},
 			client.InNamespace("default"),
 			client.MatchingLabels{
 				"celery-app": uniqueName,
@@ -108,8 +191,176 @@ var _ = Describe("CeleryBroker CRUD", func() {
 		Eventually(func() error {
 			return k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
-				Name:      uniqueName + "-broker",
-			}, &corev1.Pod{})
+				Name:      uniqueName + "-broker-redis",
+			}, &appsv1.StatefulSet{})
 		}).Should(BeNil())
 	})
+
+	It("should keep the redis data in a persistent volume", func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+		size := resource.MustParse("5Gi")
+		template.Spec.Redis = &celeryv4.RedisBrokerSpec{
+			Persistence: &celeryv4.BrokerPersistence{
+				Size: &size,
+			},
+			AppendOnly: true,
+			Save:       []string{"900 1"},
+		}
+		err = k8sClient.Update(ctx, template)
+		Expect(err).To(BeNil())
+
+		Eventually(func() []string {
+			statefulSet := &appsv1.StatefulSet{}
+			err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-redis",
+			}, statefulSet)
+			if err != nil || len(statefulSet.Spec.VolumeClaimTemplates) != 1 {
+				return nil
+			}
+			storage := statefulSet.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage]
+			Expect(storage.String()).To(Equal("5Gi"))
+			return statefulSet.Spec.Template.Spec.Containers[0].Command
+		}, 5, 0.1).Should(Equal([]string{
+			"redis-server",
+			"--dir",
+			"/data",
+			"--requirepass",
+			"$(REDIS_PASSWORD)",
+			"--appendonly",
+			"yes",
+			"--appendfsync",
+			"everysec",
+			"--save",
+			"900 1",
+		}))
+	})
+
+	It("should deploy redis with sentinels in high availability mode", func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+		replicas := int32(3)
+		template.Spec.Redis = &celeryv4.RedisBrokerSpec{
+			HighAvailability: &celeryv4.RedisHighAvailability{
+				Replicas: &replicas,
+			},
+		}
+		err = k8sClient.Update(ctx, template)
+		Expect(err).To(BeNil())
+
+		Eventually(func() string {
+			statefulSet := &appsv1.StatefulSet{}
+			err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-redis",
+			}, statefulSet)
+			if err != nil || *statefulSet.Spec.Replicas != replicas {
+				return ""
+			}
+			return statefulSet.Spec.ServiceName
+		}, 5, 0.1).Should(Equal(uniqueName + "-broker-redis-headless"))
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-sentinel",
+			}, &corev1.Service{})
+		}).Should(BeNil())
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-service",
+			}, &corev1.Service{})
+		}).ShouldNot(BeNil())
+
+		Eventually(func() error {
+			return markStatefulSetReady(uniqueName + "-broker-redis")
+		}, 2, 0.01).Should(BeNil())
+		Eventually(func() error {
+			return markStatefulSetReady(uniqueName + "-broker-sentinel")
+		}, 2, 0.01).Should(BeNil())
+		broker := &celeryv4.CeleryBroker{}
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, broker)).Should(Succeed())
+			return broker.Status.Ready
+		}, 10, 0.1).Should(BeTrue())
+		Expect(broker.Status.BrokerAddress).To(Equal(fmt.Sprintf(
+			"sentinel://:xxxxx@%[1]s-broker-sentinel-0.%[1]s-broker-sentinel.default:26379;"+
+				"sentinel://:xxxxx@%[1]s-broker-sentinel-1.%[1]s-broker-sentinel.default:26379;"+
+				"sentinel://:xxxxx@%[1]s-broker-sentinel-2.%[1]s-broker-sentinel.default:26379",
+			uniqueName,
+		)))
+		Expect(broker.Status.TransportOptions).To(Equal(map[string]string{"master_name": "mymaster"}))
+	})
+
+	It("should resolve the external broker address from the secret", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      uniqueName + "-external",
+				Namespace: "default",
+			},
+			StringData: map[string]string{
+				"host":     "redis://external-redis:6379/0",
+				"password": "secret1",
+			},
+		}
+		Expect(k8sClient.Create(ctx, secret)).Should(Succeed())
+		defer k8sClient.Delete(ctx, secret)
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+		template.Spec.Type = celeryv4.ExternalBroker
+		template.Spec.BrokerAddressSecretRef = &celeryv4.BrokerAddressSecretReference{
+			Name:        secret.Name,
+			HostKey:     "host",
+			PasswordKey: "password",
+		}
+		err = k8sClient.Update(ctx, template)
+		Expect(err).To(BeNil())
+
+		getURL := func() string {
+			urlSecret := &corev1.Secret{}
+			if err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-broker-url",
+			}, urlSecret); err != nil {
+				return ""
+			}
+			return string(urlSecret.Data[celeryv4.BrokerURLKey])
+		}
+		Eventually(getURL, 2, 0.1).Should(Equal("redis://:secret1@external-redis:6379/0"))
+		broker := &celeryv4.CeleryBroker{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, broker)).Should(Succeed())
+		Expect(broker.Status.BrokerAddress).To(Equal("redis://:xxxxx@external-redis:6379/0"))
+		Expect(broker.Status.Ready).To(BeTrue())
+		oldHash := broker.Status.BrokerAddressHash
+
+		// Rotate the password
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      secret.Name,
+		}, secret)).Should(Succeed())
+		secret.Data["password"] = []byte("secret2")
+		Expect(k8sClient.Update(ctx, secret)).Should(Succeed())
+		Eventually(getURL, 2, 0.1).Should(Equal("redis://:secret2@external-redis:6379/0"))
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, broker)).Should(Succeed())
+			return broker.Status.BrokerAddressHash
+		}, 2, 0.1).ShouldNot(Equal(oldHash))
+	})
 })
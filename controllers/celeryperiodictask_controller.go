@@ -0,0 +1,148 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+)
+
+// CeleryPeriodicTaskReconciler reconciles a CeleryPeriodicTask object.
+// The tasks are rendered into the beat schedule by the scheduler, so it only reports the due times.
+type CeleryPeriodicTaskReconciler Reconciler
+
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryperiodictasks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryperiodictasks/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeries,verbs=get;list;watch
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryschedulers,verbs=get;list;watch
+
+func (r *CeleryPeriodicTaskReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+
+	instance := &celeryv4.CeleryPeriodicTask{}
+	err := r.Client.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Return and don't requeue
+			return ctrl.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return ctrl.Result{}, err
+	}
+
+	status := instance.Status.DeepCopy()
+	result := ctrl.Result{}
+	scheduled := celeryv4.Condition{
+		Type:   celeryv4.Scheduled,
+		Status: corev1.ConditionFalse,
+	}
+	location := time.UTC
+	scheduler, err := resolvePeriodicTaskScheduler(ctx, r.Client, instance)
+	if err != nil {
+		scheduled.Reason = "TargetNotFound"
+		scheduled.Message = err.Error()
+	} else {
+		status.Scheduler = scheduler
+		found := &celeryv4.CeleryScheduler{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: scheduler, Namespace: instance.Namespace}, found)
+		if err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if err != nil {
+			scheduled.Reason = "SchedulerNotFound"
+			scheduled.Message = fmt.Sprintf("scheduler %s is not found", scheduler)
+		} else if location, err = found.GetTimezone(); err != nil {
+			location = time.UTC
+			scheduled.Reason = "InvalidTimezone"
+			scheduled.Message = err.Error()
+		} else {
+			scheduled.Status = corev1.ConditionTrue
+			scheduled.Reason = "Rendered"
+			scheduled.Message = fmt.Sprintf("The task is rendered into config map %s", found.GetBeatScheduleName())
+		}
+	}
+	// The crontab is evaluated in the timezone of the scheduler, which is UTC until the scheduler is found
+	now := metav1.Now().Time
+	last, next, scheduleErr := instance.GetDueTimes(now, location)
+	status.LastDueTime = toStatusTime(last)
+	status.NextDueTime = toStatusTime(next)
+	if scheduleErr != nil {
+		scheduled.Status = corev1.ConditionFalse
+		scheduled.Reason = "InvalidSchedule"
+		scheduled.Message = scheduleErr.Error()
+	}
+	if scheduled.Status != corev1.ConditionTrue {
+		// The target may be created later
+		result.RequeueAfter = time.Minute
+	}
+	if !next.IsZero() {
+		// Move the due times forward once the next run is due
+		if untilNext := next.Sub(now) + time.Second; result.RequeueAfter == 0 || untilNext < result.RequeueAfter {
+			result.RequeueAfter = untilNext
+		}
+	}
+	celeryv4.SetCondition(&status.Conditions, scheduled)
+	if equality.Semantic.DeepEqual(status, &instance.Status) {
+		return result, nil
+	}
+	instance.Status = *status
+	return result, r.Client.Status().Update(ctx, instance)
+}
+
+// toStatusTime drops the sub second part which is not kept by the api server, so the status can be compared
+func toStatusTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	statusTime := metav1.NewTime(t).Rfc3339Copy()
+	return &statusTime
+}
+
+// resolvePeriodicTaskScheduler returns the name of the CeleryScheduler running the task
+func resolvePeriodicTaskScheduler(ctx context.Context, c client.Client, task *celeryv4.CeleryPeriodicTask) (string, error) {
+	if task.Spec.Target.Kind != celeryv4.CeleryTarget {
+		return task.ResolveSchedulerName(nil)
+	}
+	celery := &celeryv4.Celery{}
+	err := c.Get(ctx, types.NamespacedName{Name: task.Spec.Target.Name, Namespace: task.Namespace}, celery)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	if err != nil {
+		return task.ResolveSchedulerName(nil)
+	}
+	return task.ResolveSchedulerName(celery)
+}
+
+func (r *CeleryPeriodicTaskReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&celeryv4.CeleryPeriodicTask{}).
+		Complete(r)
+}
@@ -18,13 +18,20 @@ package controllers
 
 import (
 	"context"
+	"sort"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
 )
@@ -36,6 +43,12 @@ type CelerySchedulerReconciler Reconciler
 // +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryschedulers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=pod,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=pod/status,verbs=get
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryperiodictasks,verbs=get;list;watch
+// +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeries,verbs=get;list;watch
 
 func (r *CelerySchedulerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -54,37 +67,67 @@ func (r *CelerySchedulerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
 	}
+	if err := r.reconcileScheduleClaim(ctx, instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	configMap, err := instance.GenerateConfigMap()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := reconcileConfigMap(ctx, (*Reconciler)(r), instance, instance.GetConfigMapName(), configMap); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := reconcileBrokerURLSecret(ctx, (*Reconciler)(r), instance, instance.GetBrokerURLSecretName(), instance.GenerateBrokerURLSecret()); err != nil {
+		return ctrl.Result{}, err
+	}
+	// The pods are generated with the hash of the periodic tasks, so they are restarted after the tasks change.
+	// It is recorded in the annotations along with the rendered schedule, so the pods never depend on the status
+	previousStatus := instance.Status.DeepCopy()
+	scheduleHash, err := r.reconcileBeatSchedule(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if instance.GetBeatScheduleHash() != scheduleHash {
+		instance.SetBeatScheduleHash(scheduleHash)
+		if err := r.Client.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	instance.Status.BeatScheduleHash = scheduleHash
+
 	// Handle the object creation
 	existingPodList := &corev1.PodList{}
-	err = r.Client.List(ctx, existingPodList, client.MatchingLabels{
-		"celery-app": instance.Name,
-		"type":       "scheduler",
-	})
-
-	if !instance.IsUpToDate(existingPodList.Items) {
-		reqLogger.Info("The spec has been updated...Recreating all the pods...")
-		for _, pod := range existingPodList.Items {
-			reqLogger.Info("Deleteing the old Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-			if err := r.Client.Delete(ctx, &pod); err != nil {
-				return ctrl.Result{}, err
-			}
-		}
-		podList := instance.Generate()
-		for _, pod := range podList {
-			reqLogger.Info("Creating a new Scheduler pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-			if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			if err := r.Client.Create(ctx, pod); err != nil {
-				return ctrl.Result{}, err
-			}
+	err = r.Client.List(ctx, existingPodList, client.InNamespace(instance.Namespace), client.MatchingLabels(instance.GetPodLabels()))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := adoptLegacyPods(ctx, r.Client, existingPodList.Items, instance.IsPodUpToDate, instance.GetSpecHash()); err != nil {
+		return ctrl.Result{}, err
+	}
+	// The terminating pods are only considered by the lease as they may still run beat
+	pods := filterActivePods(existingPodList.Items)
+	activePod, requeueAfter, err := r.reconcileBeatLease(ctx, instance, existingPodList.Items)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	result := ctrl.Result{RequeueAfter: requeueAfter}
+	if err := r.updateStatus(ctx, instance, previousStatus, pods, activePod); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !instance.IsUpToDate(pods) {
+		reqLogger.Info("The spec has been updated...Rolling out the new pods...")
+		rolloutAfter, err := r.rollout(ctx, instance, pods, activePod)
+		if err != nil {
+			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
+		requeueSooner(&result, rolloutAfter)
+		return result, nil
 	}
 
-	replicaDiff := instance.Spec.Replicas - len(existingPodList.Items)
+	replicaDiff := instance.Spec.Replicas - len(pods)
 	if replicaDiff >= 0 {
-		podList := instance.Generate(instance.Spec.Replicas - len(existingPodList.Items))
+		podList := instance.Generate(replicaDiff)
 		for _, pod := range podList {
 			found := &corev1.Pod{}
 			err = r.Client.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found)
@@ -99,7 +142,11 @@ func (r *CelerySchedulerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 			}
 		}
 	} else {
-		podList := existingPodList.Items[:(replicaDiff * -1)]
+		// Delete the standbys before the active beat
+		sort.SliceStable(pods, func(i, j int) bool {
+			return pods[i].Name != activePod && pods[j].Name == activePod
+		})
+		podList := pods[:(replicaDiff * -1)]
 		for _, pod := range podList {
 			found := &corev1.Pod{}
 			err = r.Client.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found)
@@ -115,12 +162,139 @@ func (r *CelerySchedulerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 
 	}
 
-	return ctrl.Result{}, nil
+	return result, nil
+}
+
+// rollout replaces the outdated pods without leaving beat stopped for longer than the handover.
+// The up to date standbys are created and waited to be ready first. If an outdated pod runs beat, it is demoted
+// and the lease is handed over to an up to date standby after its beat has stopped. The outdated pods are only
+// deleted after that. It returns the duration until the rollout should be checked again.
+func (r *CelerySchedulerReconciler) rollout(ctx context.Context, instance *celeryv4.CeleryScheduler, pods []corev1.Pod, activePod string) (time.Duration, error) {
+	reqLogger := r.Log.WithValues("celeryscheduler", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	updatedPods := make([]corev1.Pod, 0)
+	outdatedPods := make([]corev1.Pod, 0)
+	var holderPod *corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if instance.IsPodUpToDate(pod) {
+			updatedPods = append(updatedPods, *pod)
+			continue
+		}
+		outdatedPods = append(outdatedPods, *pod)
+		if pod.Name == activePod {
+			holderPod = pod
+		}
+	}
+
+	if toBeCreated := instance.Spec.Replicas - len(updatedPods); toBeCreated > 0 {
+		for _, pod := range instance.Generate(toBeCreated) {
+			reqLogger.Info("Creating a new Scheduler pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+			if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
+				return 0, err
+			}
+			if err := r.Client.Create(ctx, pod); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Beat keeps running on the outdated pod until the up to date standbys are ready to take over
+	if holderPod != nil && instance.Spec.Replicas > 0 {
+		readyPods := 0
+		for i := range updatedPods {
+			if isPodReady(&updatedPods[i]) {
+				readyPods++
+			}
+		}
+		if readyPods < instance.Spec.Replicas {
+			reqLogger.Info("Waiting for the new Scheduler pods to be ready", "Ready", readyPods, "Replicas", instance.Spec.Replicas)
+			return BEAT_HANDOVER_INTERVAL, nil
+		}
+		if !isBeatDemoted(holderPod) {
+			reqLogger.Info("Demoting the outdated active beat", "Pod.Namespace", holderPod.Namespace, "Pod.Name", holderPod.Name)
+			if err := r.demoteBeat(ctx, holderPod); err != nil && !errors.IsNotFound(err) {
+				return 0, err
+			}
+		}
+		return BEAT_HANDOVER_INTERVAL, nil
+	}
+
+	for i := range outdatedPods {
+		pod := &outdatedPods[i]
+		reqLogger.Info("Deleteing the outdated Scheduler pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+		if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// reconcileScheduleClaim creates the volume claim of the beat schedule if persistence is enabled.
+// The claim is deleted after persistence is disabled, while the claims not owned by the scheduler are kept.
+func (r *CelerySchedulerReconciler) reconcileScheduleClaim(ctx context.Context, instance *celeryv4.CeleryScheduler) error {
+	reqLogger := r.Log.WithValues("celeryscheduler", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	found := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: instance.GetScheduleClaimName(), Namespace: instance.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if instance.Spec.Persistence == nil {
+		if exists && metav1.IsControlledBy(found, instance) {
+			reqLogger.Info("Deleting the schedule volume claim", "PersistentVolumeClaim.Namespace", found.Namespace, "PersistentVolumeClaim.Name", found.Name)
+			if err := r.Client.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	claim := instance.GenerateScheduleClaim()
+	if !exists {
+		if err := controllerutil.SetControllerReference(instance, claim, r.Scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating the schedule volume claim", "PersistentVolumeClaim.Namespace", claim.Namespace, "PersistentVolumeClaim.Name", claim.Name)
+		return r.Client.Create(ctx, claim)
+	}
+	// Only the size of a bound claim can be changed, and it can only be expanded
+	size := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	current := found.Spec.Resources.Requests[corev1.ResourceStorage]
+	if size.Cmp(current) > 0 {
+		reqLogger.Info("Expanding the schedule volume claim", "PersistentVolumeClaim.Namespace", found.Namespace, "PersistentVolumeClaim.Name", found.Name, "Size", size.String())
+		found.Spec.Resources.Requests[corev1.ResourceStorage] = size
+		return r.Client.Update(ctx, found)
+	}
+	return nil
+}
+
+// updateStatus reports the observed pods. The selector is required by the scale subresource
+func (r *CelerySchedulerReconciler) updateStatus(ctx context.Context, instance *celeryv4.CeleryScheduler, previousStatus *celeryv4.CelerySchedulerStatus, pods []corev1.Pod, activePod string) error {
+	status := &instance.Status
+	status.ActivePod = activePod
+	observeReplicaStatus(&status.ReplicaStatus, pods, instance.Spec.Replicas, instance.IsPodUpToDate)
+	status.ObservedGeneration = instance.Generation
+	status.Selector = labels.SelectorFromSet(instance.GetPodLabels()).String()
+	if equality.Semantic.DeepEqual(status, previousStatus) {
+		return nil
+	}
+	return r.Client.Status().Update(ctx, instance)
 }
 
 func (r *CelerySchedulerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &celeryv4.CeleryPeriodicTask{}, periodicTaskTargetField, indexPeriodicTaskTarget); err != nil {
+		return err
+	}
+	// The lease is not watched as it is renewed in every reconciliation
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&celeryv4.CeleryScheduler{}).
 		Owns(&corev1.Pod{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &celeryv4.CeleryPeriodicTask{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.mapPeriodicTaskToSchedulers),
+		}).
 		Complete(r)
 }
@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -41,12 +46,14 @@ var _ = Describe("CeleryScheduler CRUD", func() {
 		err = k8sClient.Create(ctx, template)
 		Expect(err).NotTo(HaveOccurred())
 
-		Eventually(func() error {
-			return k8sClient.Get(ctx, client.ObjectKey{
+		// Wait for the status of the created pods, so the template is not outdated
+		Eventually(func() int {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
 				Namespace: "default",
 				Name:      uniqueName,
-			}, template)
-		}).Should(BeNil())
+			}, template)).Should(Succeed())
+			return template.Status.Replicas
+		}, 2, 0.1).Should(Equal(template.Spec.Replicas))
 	})
 
 	AfterEach(func() {
@@ -58,6 +65,381 @@ var _ = Describe("CeleryScheduler CRUD", func() {
 		ensureNumberOfSchedulersToBe(2)
 	})
 
+	It("should report the pods in status", func() {
+		Expect(template.Status.UpdatedReplicas).To(Equal(2))
+		Expect(template.Status.ReadyReplicas).To(Equal(0))
+		Expect(template.Status.ObservedGeneration).To(Equal(template.Generation))
+		Expect(template.Status.Selector).To(Equal("celery-app=" + uniqueName + ",type=scheduler"))
+		available := celeryv4.FindCondition(template.Status.Conditions, celeryv4.Available)
+		Expect(available).NotTo(BeNil())
+		Expect(available.Status).To(Equal(corev1.ConditionFalse))
+
+		schedulers := &corev1.PodList{}
+		Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+			"celery-app": uniqueName,
+			"type":       "scheduler",
+		})).Should(Succeed())
+		Expect(schedulers.Items).To(HaveLen(2))
+		for _, pod := range schedulers.Items {
+			Expect(markPodReady(pod.Name)).Should(Succeed())
+		}
+		Eventually(func() corev1.ConditionStatus {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			available := celeryv4.FindCondition(template.Status.Conditions, celeryv4.Available)
+			if available == nil {
+				return ""
+			}
+			return available.Status
+		}, 2, 0.1).Should(Equal(corev1.ConditionTrue))
+		Expect(template.Status.ReadyReplicas).To(Equal(2))
+	})
+
+	It("should report the crashing pods as degraded", func() {
+		schedulers := &corev1.PodList{}
+		Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+			"celery-app": uniqueName,
+			"type":       "scheduler",
+		})).Should(Succeed())
+		Expect(schedulers.Items).To(HaveLen(2))
+		pod := schedulers.Items[0]
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name:  "celery-scheduler",
+				Image: pod.Spec.Containers[0].Image,
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{
+						Reason:  "CrashLoopBackOff",
+						Message: "back-off restarting failed container",
+					},
+				},
+			},
+		}
+		Expect(k8sClient.Status().Update(ctx, &pod)).Should(Succeed())
+
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			degraded := celeryv4.FindCondition(template.Status.Conditions, celeryv4.Degraded)
+			if degraded == nil || degraded.Status != corev1.ConditionTrue {
+				return ""
+			}
+			return degraded.Reason
+		}, 2, 0.1).Should(Equal("CrashLoopBackOff"))
+	})
+
+	It("should elect a single active beat and hand it over to the standby", func() {
+		listSchedulers := func() []corev1.Pod {
+			schedulers := &corev1.PodList{}
+			Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "scheduler",
+			})).Should(Succeed())
+			return schedulers.Items
+		}
+		getActivePod := func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			return template.Status.ActivePod
+		}
+		for _, pod := range listSchedulers() {
+			Expect(markPodReady(pod.Name)).Should(Succeed())
+		}
+		Eventually(getActivePod, 2, 0.1).ShouldNot(BeEmpty())
+		activePod := template.Status.ActivePod
+
+		Eventually(func() map[string]int {
+			roles := make(map[string]int)
+			for _, pod := range listSchedulers() {
+				roles[pod.Annotations[celeryv4.BeatRoleAnnotation]]++
+			}
+			return roles
+		}, 2, 0.1).Should(Equal(map[string]int{
+			celeryv4.BeatRoleActive:  1,
+			celeryv4.BeatRoleStandby: 1,
+		}))
+		lease := &coordinationv1.Lease{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName + "-beat",
+		}, lease)).Should(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal(activePod))
+
+		// The ready standby takes over after the active pod is gone
+		Expect(k8sClient.Delete(ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: activePod},
+		})).Should(Succeed())
+		Eventually(getActivePod, 2, 0.1).ShouldNot(Or(BeEmpty(), Equal(activePod)))
+	})
+
+	It("should demote the unready beat and hand over the lease after it stops", func() {
+		getLease := func() *coordinationv1.Lease {
+			lease := &coordinationv1.Lease{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-beat",
+			}, lease)).Should(Succeed())
+			return lease
+		}
+		getPod := func(name string) *corev1.Pod {
+			pod := &corev1.Pod{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, pod)).Should(Succeed())
+			return pod
+		}
+		schedulers := ensureNumberOfSchedulersToBe(2)
+		for _, pod := range schedulers.Items {
+			Expect(markPodReady(pod.Name)).Should(Succeed())
+		}
+		Eventually(func() *string {
+			return getLease().Spec.HolderIdentity
+		}, 2, 0.1).ShouldNot(BeNil())
+		holder := *getLease().Spec.HolderIdentity
+
+		// The holder turns unready and its lease expires while its beat may still be running
+		pod := getPod(holder)
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse}}
+		Expect(k8sClient.Status().Update(ctx, pod)).Should(Succeed())
+		lease := getLease()
+		expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+		lease.Spec.RenewTime = &expired
+		Expect(k8sClient.Update(ctx, lease)).Should(Succeed())
+
+		Eventually(func() map[string]string {
+			return getPod(holder).Annotations
+		}, 2, 0.1).Should(HaveKey(celeryv4.BeatDemotedAnnotation))
+		Expect(getPod(holder).Annotations[celeryv4.BeatRoleAnnotation]).To(Equal(celeryv4.BeatRoleStandby))
+		Consistently(func() string {
+			return *getLease().Spec.HolderIdentity
+		}, 1, 0.1).Should(Equal(holder))
+
+		// The lease is handed over once the wrapper exits after stopping beat
+		pod = getPod(holder)
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "celery-scheduler",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+		}}
+		Expect(k8sClient.Status().Update(ctx, pod)).Should(Succeed())
+		Eventually(func() *string {
+			return getLease().Spec.HolderIdentity
+		}, 2, 0.1).Should(And(Not(BeNil()), Not(Equal(&holder))))
+	})
+
+	It("should hand over beat to the new pods before deleting the old ones", func() {
+		listSchedulers := func() []corev1.Pod {
+			schedulers := &corev1.PodList{}
+			Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "scheduler",
+			})).Should(Succeed())
+			return filterActivePods(schedulers.Items)
+		}
+		getActivePod := func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			return template.Status.ActivePod
+		}
+		oldPods := make(map[string]bool)
+		for _, pod := range listSchedulers() {
+			Expect(markPodReady(pod.Name)).Should(Succeed())
+			oldPods[pod.Name] = true
+		}
+		Eventually(getActivePod, 2, 0.1).ShouldNot(BeEmpty())
+		activePod := template.Status.ActivePod
+
+		template.Spec.AppName = "updatedAppName"
+		Expect(k8sClient.Update(ctx, template)).Should(Succeed())
+
+		// The old pods are kept until the new standbys are ready
+		Eventually(func() int {
+			return len(listSchedulers())
+		}, 2, 0.1).Should(Equal(4))
+		Consistently(getActivePod, 1, 0.1).Should(Equal(activePod))
+		for _, pod := range listSchedulers() {
+			if !oldPods[pod.Name] {
+				Expect(markPodReady(pod.Name)).Should(Succeed())
+			}
+		}
+
+		// The old active beat is demoted and the lease is handed over after it has stopped
+		holder := &corev1.Pod{}
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      activePod,
+			}, holder)).Should(Succeed())
+			return holder.Annotations[celeryv4.BeatDemotedAnnotation]
+		}, 2, 0.1).Should(Equal("0"))
+		Expect(holder.Annotations[celeryv4.BeatRoleAnnotation]).To(Equal(celeryv4.BeatRoleStandby))
+		Consistently(getActivePod, 1, 0.1).Should(Equal(activePod))
+
+		holder.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name:         "celery-scheduler",
+				Image:        holder.Spec.Containers[0].Image,
+				RestartCount: 1,
+				State: corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{},
+				},
+			},
+		}
+		Expect(k8sClient.Status().Update(ctx, holder)).Should(Succeed())
+		Eventually(func() bool {
+			return !oldPods[getActivePod()]
+		}, 2, 0.1).Should(BeTrue())
+		Eventually(func() []string {
+			names := []string{}
+			for _, pod := range listSchedulers() {
+				if oldPods[pod.Name] {
+					names = append(names, pod.Name)
+				}
+			}
+			return names
+		}, 2, 0.1).Should(BeEmpty())
+	})
+
+	It("should keep the schedule on the persistent volume", func() {
+		template.Spec.Persistence = &celeryv4.SchedulePersistence{}
+		Expect(k8sClient.Update(ctx, template)).Should(Succeed())
+
+		claim := &corev1.PersistentVolumeClaim{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-schedule",
+			}, claim)
+		}, 2, 0.1).Should(Succeed())
+		Expect(claim.Spec.AccessModes).To(Equal([]corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}))
+		Expect(claim.Spec.Resources.Requests.Storage().String()).To(Equal("1Gi"))
+
+		Eventually(func() bool {
+			schedulers := &corev1.PodList{}
+			Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "scheduler",
+			})).Should(Succeed())
+			persisted := 0
+			for _, pod := range schedulers.Items {
+				for _, volume := range pod.Spec.Volumes {
+					if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claim.Name {
+						Expect(pod.Spec.Containers[0].Args).To(ContainElement("/var/lib/celery-beat/celerybeat-schedule"))
+						persisted++
+					}
+				}
+			}
+			return len(schedulers.Items) == 2 && persisted == 2
+		}, 2, 0.1).Should(BeTrue())
+
+		// The claim is deleted after persistence is disabled
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName,
+		}, template)).Should(Succeed())
+		template.Spec.Persistence = nil
+		Expect(k8sClient.Update(ctx, template)).Should(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-schedule",
+			}, claim)
+			return errors.IsNotFound(err) || claim.DeletionTimestamp != nil
+		}, 2, 0.1).Should(BeTrue())
+	})
+
+	It("should render the periodic tasks into the beat schedule", func() {
+		task := &celeryv4.CeleryPeriodicTask{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      uniqueName + "-add",
+				Namespace: "default",
+			},
+			Spec: celeryv4.CeleryPeriodicTaskSpec{
+				Task:    "proj.tasks.add",
+				Crontab: "*/5 * * * *",
+				Target: celeryv4.PeriodicTaskTarget{
+					Kind: celeryv4.SchedulerTarget,
+					Name: uniqueName,
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, task)).Should(Succeed())
+		defer func() {
+			_ = k8sClient.Delete(ctx, task)
+		}()
+
+		configMap := &corev1.ConfigMap{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-beat-schedule",
+			}, configMap)
+		}, 2, 0.1).Should(Succeed())
+		Expect(configMap.Data["beat_schedule.json"]).To(ContainSubstring(`"task": "proj.tasks.add"`))
+		Expect(configMap.Data).To(HaveKey("celery_operator_beat.py"))
+
+		// The pods are recreated with the schedule
+		var hash string
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			hash = template.GetBeatScheduleHash()
+			schedulers := &corev1.PodList{}
+			Expect(k8sClient.List(ctx, schedulers, client.MatchingLabels{
+				"celery-app": uniqueName,
+				"type":       "scheduler",
+			})).Should(Succeed())
+			scheduled := 0
+			for _, pod := range filterActivePods(schedulers.Items) {
+				if hash != "" && pod.Annotations[celeryv4.BeatScheduleHashAnnotation] == hash {
+					Expect(pod.Spec.Containers[0].Args).To(ContainElement("celery_operator_beat:Scheduler"))
+					scheduled++
+				}
+			}
+			return scheduled == 2
+		}, 2, 0.1).Should(BeTrue())
+
+		// The status of task reports the scheduler and the next run
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      task.Name,
+			}, task)).Should(Succeed())
+			condition := celeryv4.FindCondition(task.Status.Conditions, celeryv4.Scheduled)
+			return condition != nil && condition.Status == corev1.ConditionTrue &&
+				task.Status.Scheduler == uniqueName && task.Status.NextDueTime != nil
+		}, 2, 0.1).Should(BeTrue())
+		Expect(task.Status.NextDueTime.Minute() % 5).To(Equal(0))
+
+		// A changed task restarts beat
+		task.Spec.Crontab = "0 * * * *"
+		Expect(k8sClient.Update(ctx, task)).Should(Succeed())
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName,
+			}, template)).Should(Succeed())
+			return template.Status.BeatScheduleHash != "" && template.Status.BeatScheduleHash != hash
+		}, 2, 0.1).Should(BeTrue())
+
+		// The config map is deleted after the last task is gone
+		Expect(k8sClient.Delete(ctx, task)).Should(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: "default",
+				Name:      uniqueName + "-beat-schedule",
+			}, configMap)
+			return errors.IsNotFound(err) || configMap.DeletionTimestamp != nil
+		}, 2, 0.1).Should(BeTrue())
+	})
+
 	It("should respawn the scheduler pod after deletion", func() {
 		// Get the old pod for comparison
 		podList := ensureNumberOfSchedulersToBe(2)
@@ -119,12 +501,91 @@ var _ = Describe("CeleryScheduler CRUD", func() {
 			"beat",
 			"-A",
 			"updatedAppName",
-			"-b",
-			template.Spec.BrokerAddress,
 		}
 		schedulers := ensureNumberOfSchedulersToBe(2)
 		for _, pod := range schedulers.Items {
-			Expect(pod.Spec.Containers[0].Command).To(Equal(expectedCommand))
+			// The command of beat is wrapped, so only the active pod runs it
+			Expect(pod.Spec.Containers[0].Args).To(Equal(expectedCommand))
+			// The plain broker address is kept in the secret of the scheduler
+			Expect(pod.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{
+				{
+					Name: "CELERY_BROKER_URL",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: uniqueName + "-broker-url"},
+							Key:                  celeryv4.BrokerURLKey,
+						},
+					},
+				},
+			}))
+		}
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: "default",
+			Name:      uniqueName + "-broker-url",
+		}, secret)).Should(Succeed())
+		Expect(string(secret.Data[celeryv4.BrokerURLKey])).To(Equal(template.Spec.BrokerAddress))
+	})
+})
+
+var _ = Describe("CeleryScheduler beat handover", func() {
+	newDemotedPod := func(restarts int32, running bool) *corev1.Pod {
+		state := corev1.ContainerState{}
+		if running {
+			state.Running = &corev1.ContainerStateRunning{}
+		} else {
+			state.Terminated = &corev1.ContainerStateTerminated{ExitCode: 0}
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "scheduler",
+				Annotations: map[string]string{celeryv4.BeatDemotedAnnotation: "2"},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "celery-scheduler", RestartCount: restarts, State: state},
+				},
+			},
+		}
+	}
+
+	It("should wait for the demoted beat to stop", func() {
+		Expect(isBeatStopped(newDemotedPod(2, true))).To(BeFalse())
+		pod := newDemotedPod(2, true)
+		pod.Status.ContainerStatuses = nil
+		Expect(isBeatStopped(pod)).To(BeFalse())
+	})
+
+	It("should tell the beat has stopped after the wrapper exits", func() {
+		Expect(isBeatStopped(newDemotedPod(2, false))).To(BeTrue())
+		Expect(isBeatStopped(newDemotedPod(3, true))).To(BeTrue())
+		pod := newDemotedPod(2, true)
+		pod.Status.Phase = corev1.PodFailed
+		Expect(isBeatStopped(pod)).To(BeTrue())
+	})
+
+	It("should not hand the lease back to the demoted pod", func() {
+		instance := &celeryv4.CeleryScheduler{}
+		demoted := newDemotedPod(3, true)
+		demoted.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		Expect(pickBeatCandidate(instance, []corev1.Pod{*demoted})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("CeleryScheduler periodic task index", func() {
+	newTask := func(kind, name string) *celeryv4.CeleryPeriodicTask {
+		return &celeryv4.CeleryPeriodicTask{
+			Spec: celeryv4.CeleryPeriodicTaskSpec{
+				Target: celeryv4.PeriodicTaskTarget{Kind: kind, Name: name},
+			},
 		}
+	}
+
+	It("should index the tasks by their targets", func() {
+		Expect(indexPeriodicTaskTarget(newTask(celeryv4.SchedulerTarget, "beat"))).To(Equal([]string{"CeleryScheduler/beat"}))
+		Expect(indexPeriodicTaskTarget(newTask(celeryv4.CeleryTarget, "app"))).To(Equal([]string{"Celery/app"}))
+		Expect(indexPeriodicTaskTarget(newTask("", "beat"))).To(Equal([]string{"CeleryScheduler/beat"}))
+		Expect(indexPeriodicTaskTarget(&corev1.Pod{})).To(BeEmpty())
 	})
 })
@@ -0,0 +1,226 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+)
+
+// reconcileBeatLease elects the only pod running beat through the lease.
+// The holder renews the lease while it is ready. The pods read their roles from their own annotations,
+// so an expired lease does not stop the beat of the holder. The unready holder is demoted first and deleted
+// if it does not stop within another lease duration, and a ready standby only takes over once the beat of
+// the holder has stopped or its pod is gone. A holder on a lost node keeps the lease until its pod is removed.
+// It returns the active pod and the duration until the lease should be checked again.
+func (r *CelerySchedulerReconciler) reconcileBeatLease(ctx context.Context, instance *celeryv4.CeleryScheduler, pods []corev1.Pod) (string, time.Duration, error) {
+	reqLogger := r.Log.WithValues("celeryscheduler", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	lease := &coordinationv1.Lease{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: instance.GetLeaseName(), Namespace: instance.Namespace}, lease)
+	if err != nil && errors.IsNotFound(err) {
+		lease = instance.GenerateLease()
+		if err := controllerutil.SetControllerReference(instance, lease, r.Scheme); err != nil {
+			return "", 0, err
+		}
+		reqLogger.Info("Creating the beat lease", "Lease.Namespace", lease.Namespace, "Lease.Name", lease.Name)
+		if err := r.Client.Create(ctx, lease); err != nil {
+			return "", 0, err
+		}
+	} else if err != nil {
+		return "", 0, err
+	}
+	original := lease.DeepCopy()
+
+	duration := celeryv4.BeatLeaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	now := metav1.NowMicro()
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	var holderPod *corev1.Pod
+	for i := range pods {
+		if pods[i].Name == holder {
+			holderPod = &pods[i]
+		}
+	}
+
+	var remaining time.Duration
+	if lease.Spec.RenewTime != nil {
+		remaining = duration - now.Sub(lease.Spec.RenewTime.Time)
+	}
+	// The demoted holder is not renewed, and the lease is handed over once its beat has stopped
+	demoted := holderPod != nil && isBeatDemoted(holderPod)
+	stopped := demoted && isBeatStopped(holderPod)
+
+	var requeueAfter time.Duration
+	switch {
+	case demoted && !stopped && remaining > 0:
+		requeueAfter = remaining
+		if requeueAfter > BEAT_HANDOVER_INTERVAL {
+			requeueAfter = BEAT_HANDOVER_INTERVAL
+		}
+	case holderPod != nil && !demoted && holderPod.DeletionTimestamp == nil && isPodReady(holderPod):
+		lease.Spec.RenewTime = &now
+		requeueAfter = duration / 3
+	case holderPod != nil && !stopped && remaining > 0:
+		// The holder may still be running beat, e.g. it is being terminated
+		requeueAfter = remaining
+	case holderPod != nil && !stopped:
+		// The lease of the unhealthy holder has expired while it may still be running beat.
+		// It is given another lease duration to stop after the demotion, and replaced if it does not.
+		requeueAfter = BEAT_HANDOVER_INTERVAL
+		if !demoted {
+			reqLogger.Info("Demoting the unhealthy beat", "Pod.Namespace", holderPod.Namespace, "Pod.Name", holderPod.Name)
+			if err := r.demoteBeat(ctx, holderPod); err != nil && !errors.IsNotFound(err) {
+				return "", 0, err
+			}
+			lease.Spec.RenewTime = &now
+		} else if holderPod.DeletionTimestamp == nil {
+			reqLogger.Info("Deleting the demoted beat which has not stopped", "Pod.Namespace", holderPod.Namespace, "Pod.Name", holderPod.Name)
+			if err := r.Client.Delete(ctx, holderPod); err != nil && !errors.IsNotFound(err) {
+				return "", 0, err
+			}
+		}
+	default:
+		candidate := pickBeatCandidate(instance, pods)
+		if candidate == "" {
+			holder = ""
+			lease.Spec.HolderIdentity = nil
+			break
+		}
+		reqLogger.Info("Handing over the beat lease", "From", holder, "To", candidate)
+		holder = candidate
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+		requeueAfter = duration / 3
+	}
+	if !equality.Semantic.DeepEqual(original.Spec, lease.Spec) {
+		if err := r.Client.Update(ctx, lease); err != nil {
+			return "", 0, err
+		}
+	}
+
+	// Tell each pod its role through the annotation. The demotion is over once the lease is handed over
+	for i := range pods {
+		pod := &pods[i]
+		role := celeryv4.BeatRoleStandby
+		if pod.Name == holder && !isBeatDemoted(pod) {
+			role = celeryv4.BeatRoleActive
+		}
+		clearDemotion := pod.Name != holder && isBeatDemoted(pod)
+		if pod.DeletionTimestamp != nil || (pod.Annotations[celeryv4.BeatRoleAnnotation] == role && !clearDemotion) {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[celeryv4.BeatRoleAnnotation] = role
+		delete(pod.Annotations, celeryv4.BeatDemotedAnnotation)
+		if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+			return "", 0, err
+		}
+	}
+	return holder, requeueAfter, nil
+}
+
+// pickBeatCandidate prefers the ready standby generated from the current spec
+func pickBeatCandidate(instance *celeryv4.CeleryScheduler, pods []corev1.Pod) string {
+	candidate := ""
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || !isPodReady(pod) || isBeatDemoted(pod) {
+			continue
+		}
+		if instance.IsPodUpToDate(pod) {
+			return pod.Name
+		}
+		if candidate == "" {
+			candidate = pod.Name
+		}
+	}
+	return candidate
+}
+
+// demoteBeat asks the active beat to stop, so the lease can be handed over without waiting for it to expire.
+// The restart count is recorded to tell when the wrapper has exited after stopping beat.
+func (r *CelerySchedulerReconciler) demoteBeat(ctx context.Context, pod *corev1.Pod) error {
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[celeryv4.BeatRoleAnnotation] = celeryv4.BeatRoleStandby
+	pod.Annotations[celeryv4.BeatDemotedAnnotation] = strconv.Itoa(int(getSchedulerRestartCount(pod)))
+	return r.Client.Patch(ctx, pod, patch)
+}
+
+// isBeatDemoted checks whether the pod has been asked to stop beat before the lease is handed over
+func isBeatDemoted(pod *corev1.Pod) bool {
+	_, ok := pod.Annotations[celeryv4.BeatDemotedAnnotation]
+	return ok
+}
+
+// isBeatStopped checks whether the demoted pod has stopped beat. The wrapper exits after beat is stopped,
+// so beat has stopped once the scheduler container is not running or has been restarted since the demotion.
+func isBeatStopped(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return true
+	}
+	// The lease is handed over after it expires if the container cannot be observed
+	restarts, err := strconv.Atoi(pod.Annotations[celeryv4.BeatDemotedAnnotation])
+	if err != nil {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == "celery-scheduler" {
+			return status.State.Running == nil || int(status.RestartCount) > restarts
+		}
+	}
+	return false
+}
+
+// getSchedulerRestartCount returns the restart count of the scheduler container
+func getSchedulerRestartCount(pod *corev1.Pod) int32 {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == "celery-scheduler" {
+			return status.RestartCount
+		}
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+)
+
+// reconcileBeatSchedule renders the periodic tasks targeting the scheduler into the config map loaded by beat.
+// The invalid tasks are skipped, and the config map is deleted once no task is left.
+// It returns the hash of the rendered schedule, which is empty if there is no task.
+func (r *CelerySchedulerReconciler) reconcileBeatSchedule(ctx context.Context, instance *celeryv4.CeleryScheduler) (string, error) {
+	reqLogger := r.Log.WithValues("celeryscheduler", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	targetingTasks, err := r.listPeriodicTasks(ctx, instance)
+	if err != nil {
+		return "", err
+	}
+	tasks := []celeryv4.CeleryPeriodicTask{}
+	for _, task := range targetingTasks {
+		if task.DeletionTimestamp != nil {
+			continue
+		}
+		if _, _, err := task.GetDueTimes(metav1.Now().Time, time.UTC); err != nil {
+			reqLogger.Info("Skipping the invalid periodic task", "CeleryPeriodicTask.Name", task.Name, "Error", err.Error())
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Name < tasks[j].Name
+	})
+
+	found := &corev1.ConfigMap{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: instance.GetBeatScheduleName(), Namespace: instance.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	exists := err == nil
+	if len(tasks) == 0 {
+		if exists && metav1.IsControlledBy(found, instance) {
+			reqLogger.Info("Deleting the beat schedule", "ConfigMap.Namespace", found.Namespace, "ConfigMap.Name", found.Name)
+			if err := r.Client.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+
+	configMap, hash, err := instance.GenerateBeatSchedule(tasks)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := controllerutil.SetControllerReference(instance, configMap, r.Scheme); err != nil {
+			return "", err
+		}
+		reqLogger.Info("Creating the beat schedule", "ConfigMap.Namespace", configMap.Namespace, "ConfigMap.Name", configMap.Name)
+		return hash, r.Client.Create(ctx, configMap)
+	}
+	if !reflect.DeepEqual(found.Data, configMap.Data) {
+		reqLogger.Info("Updating the beat schedule", "ConfigMap.Namespace", found.Namespace, "ConfigMap.Name", found.Name)
+		found.Data = configMap.Data
+		return hash, r.Client.Update(ctx, found)
+	}
+	return hash, nil
+}
+
+// periodicTaskTargetField indexes the periodic tasks by their targets, so a scheduler finds its tasks without
+// resolving the target of every task in the namespace
+const periodicTaskTargetField = "spec.target"
+
+// periodicTaskTargetKey returns the index key of the target. The kinds other than Celery refer to a CeleryScheduler
+func periodicTaskTargetKey(kind, name string) string {
+	if kind != celeryv4.CeleryTarget {
+		kind = celeryv4.SchedulerTarget
+	}
+	return kind + "/" + name
+}
+
+// indexPeriodicTaskTarget is the index function of periodicTaskTargetField
+func indexPeriodicTaskTarget(object runtime.Object) []string {
+	task, ok := object.(*celeryv4.CeleryPeriodicTask)
+	if !ok {
+		return nil
+	}
+	return []string{periodicTaskTargetKey(task.Spec.Target.Kind, task.Spec.Target.Name)}
+}
+
+// listPeriodicTasks finds the tasks targeting the scheduler directly, and the ones targeting its scheduler pool
+// if the scheduler is controlled by a Celery. The celery is only read once to resolve the pools of its tasks.
+func (r *CelerySchedulerReconciler) listPeriodicTasks(ctx context.Context, instance *celeryv4.CeleryScheduler) ([]celeryv4.CeleryPeriodicTask, error) {
+	taskList := &celeryv4.CeleryPeriodicTaskList{}
+	if err := r.Client.List(ctx, taskList, client.InNamespace(instance.Namespace),
+		client.MatchingFields{periodicTaskTargetField: periodicTaskTargetKey(celeryv4.SchedulerTarget, instance.Name)}); err != nil {
+		return nil, err
+	}
+	tasks := taskList.Items
+	owner := metav1.GetControllerOf(instance)
+	if owner == nil || owner.Kind != celeryv4.CeleryTarget {
+		return tasks, nil
+	}
+	celery := &celeryv4.Celery{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: owner.Name, Namespace: instance.Namespace}, celery); err != nil {
+		if errors.IsNotFound(err) {
+			return tasks, nil
+		}
+		return nil, err
+	}
+	poolTaskList := &celeryv4.CeleryPeriodicTaskList{}
+	if err := r.Client.List(ctx, poolTaskList, client.InNamespace(instance.Namespace),
+		client.MatchingFields{periodicTaskTargetField: periodicTaskTargetKey(celeryv4.CeleryTarget, celery.Name)}); err != nil {
+		return nil, err
+	}
+	for _, task := range poolTaskList.Items {
+		if scheduler, err := task.ResolveSchedulerName(celery); err == nil && scheduler == instance.Name {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// mapPeriodicTaskToSchedulers finds the scheduler running the task and the one which ran it before the target is changed
+func (r *CelerySchedulerReconciler) mapPeriodicTaskToSchedulers(object handler.MapObject) []reconcile.Request {
+	task, ok := object.Object.(*celeryv4.CeleryPeriodicTask)
+	if !ok {
+		return nil
+	}
+	names := map[string]bool{}
+	if task.Status.Scheduler != "" {
+		names[task.Status.Scheduler] = true
+	}
+	if scheduler, err := resolvePeriodicTaskScheduler(context.Background(), r.Client, task); err == nil {
+		names[scheduler] = true
+	}
+	requests := []reconcile.Request{}
+	for name := range names {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: name, Namespace: task.Namespace},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,155 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+	"github.com/RyanSiu1995/celery-operator/pkg/broker"
+)
+
+// autoscale checks the queue depths in the broker and the messages held by the workers, and decides the number of workers.
+// It returns the autoscaling status and the ScalingActive condition, which are written with the rest of the status,
+// and the duration until the next check. The condition is nil if the broker has not been checked.
+func (r *CeleryWorkerReconciler) autoscale(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) (*celeryv4.CeleryWorkerAutoscalingStatus, *celeryv4.Condition, time.Duration) {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	policy := instance.Spec.Autoscaling
+	now := metav1.Now()
+	status := instance.Status.Autoscaling.DeepCopy()
+	if status == nil {
+		status = &celeryv4.CeleryWorkerAutoscalingStatus{
+			DesiredReplicas: policy.ClampReplicas(instance.Spec.Replicas),
+		}
+	} else if status.LastCheckTime != nil {
+		// Avoid hammering the broker as every status update triggers a reconciliation
+		if elapsed := now.Sub(status.LastCheckTime.Time); elapsed < AUTOSCALING_INTERVAL {
+			return status, nil, AUTOSCALING_INTERVAL - elapsed
+		}
+	}
+	status.LastCheckTime = &now
+	active := &celeryv4.Condition{
+		Type:    celeryv4.ScalingActive,
+		Status:  corev1.ConditionTrue,
+		Reason:  "ValidMetrics",
+		Message: "The queue depths are read from the broker",
+	}
+
+	address, err := getBrokerAddress(ctx, r.Client, instance.Namespace, instance.Spec.BrokerAddress, instance.Spec.BrokerAddressSecretRef)
+	var depths map[string]int64
+	if err == nil {
+		depths, err = broker.GetQueueDepths(address, instance.Spec.BrokerTransportOptions, instance.GetTargetQueues())
+	}
+	var unacked int64
+	switch {
+	case errors.Is(err, broker.ErrUnsupportedBroker):
+		active.Status = corev1.ConditionFalse
+		active.Reason = "UnsupportedBroker"
+		active.Message = fmt.Sprintf("Autoscaling only supports the redis brokers: %v", err)
+		status.Message = active.Message
+	case err != nil:
+		reqLogger.Error(err, "Failed to get the queue depths from broker")
+		active.Status = corev1.ConditionFalse
+		active.Reason = "FailedGetQueueDepths"
+		active.Message = fmt.Sprintf("Failed to get the queue depths from broker: %v", err)
+		status.Message = active.Message
+	default:
+		if unacked, err = r.countUnackedMessages(ctx, instance, pods); err != nil {
+			reqLogger.Error(err, "Failed to inspect the messages held by workers")
+			active.Status = corev1.ConditionFalse
+			active.Reason = "FailedInspectWorkers"
+			active.Message = fmt.Sprintf("Failed to inspect the messages held by workers: %v", err)
+			status.Message = active.Message
+		}
+	}
+	if err != nil {
+		status.DesiredReplicas = policy.ClampReplicas(status.DesiredReplicas)
+		return status, active, AUTOSCALING_INTERVAL
+	}
+
+	status.QueueDepths = depths
+	status.UnackedMessages = unacked
+	current := status.DesiredReplicas
+	desired, pending := getDesiredWorkers(policy, depths, unacked)
+	switch {
+	case desired > current && !isInCooldown(status.LastScaleTime, now, policy.GetScaleUpCooldown()),
+		desired < current && !isInCooldown(status.LastScaleTime, now, policy.GetScaleDownCooldown()):
+		reqLogger.Info("Scaling the workers", "From", current, "To", desired, "PendingMessages", pending)
+		status.DesiredReplicas = desired
+		status.LastScaleTime = &now
+		status.Message = fmt.Sprintf("Scaled from %d to %d workers for %d pending messages", current, desired, pending)
+	case desired != current:
+		status.Message = fmt.Sprintf("Keeping %d workers within the cooldown while %d workers are wanted for %d pending messages", current, desired, pending)
+	}
+	return status, active, AUTOSCALING_INTERVAL
+}
+
+// countUnackedMessages returns the number of messages prefetched or being executed by the ready workers.
+// They have left the queues, so the busy workers would be scaled down if they were not counted.
+// The workers not replying, e.g. the ones blocked by a task in the solo pool, are not counted.
+func (r *CeleryWorkerReconciler) countUnackedMessages(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) (int64, error) {
+	nodes := make([]string, 0, len(pods))
+	for i := range pods {
+		if isPodReady(&pods[i]) {
+			nodes = append(nodes, celeryv4.GetWorkerNodeName(&pods[i]))
+		}
+	}
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+	controlClient, err := r.newControlClient(ctx, instance)
+	if err != nil {
+		return 0, err
+	}
+	defer controlClient.Close()
+	tasks, err := countWorkerTasks(controlClient, nodes)
+	if err != nil {
+		return 0, err
+	}
+	var unacked int64
+	for _, count := range tasks {
+		unacked += int64(count)
+	}
+	return unacked, nil
+}
+
+// getDesiredWorkers returns the number of workers to handle the pending messages
+// and the total number of pending messages, including the ones held by the workers
+func getDesiredWorkers(policy *celeryv4.CeleryWorkerAutoscaling, depths map[string]int64, unacked int64) (int, int64) {
+	pending := unacked
+	for _, depth := range depths {
+		pending += depth
+	}
+	target := int64(policy.TargetMessagesPerWorker)
+	if target <= 0 {
+		target = 1
+	}
+	desired := int((pending + target - 1) / target)
+	return policy.ClampReplicas(desired), pending
+}
+
+func isInCooldown(lastScaleTime *metav1.Time, now metav1.Time, cooldown time.Duration) bool {
+	return lastScaleTime != nil && now.Sub(lastScaleTime.Time) < cooldown
+}
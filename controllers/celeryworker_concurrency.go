@@ -0,0 +1,181 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+)
+
+// resizeWorkers grows or shrinks the prefork pools of the running workers to the desired concurrency,
+// so they are not restarted after the concurrency is changed. The workers are inspected after the desired
+// concurrency is changed and periodically, and the ones not matching are checked again sooner.
+// The concurrency of a worker is only reported once it is inspected, and the one being resized to is pending until then.
+// It returns the observed concurrency, the PoolResized condition, which is nil until the workers are inspected,
+// and the duration until the next check.
+func (r *CeleryWorkerReconciler) resizeWorkers(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) (*celeryv4.CeleryWorkerConcurrencyStatus, *celeryv4.Condition, time.Duration) {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	desired := instance.GetConcurrency()
+	if !instance.IsPoolResizable() || desired == 0 {
+		return nil, nil, 0
+	}
+	readyPods := make([]corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if isPodReady(&pod) {
+			readyPods = append(readyPods, pod)
+		}
+	}
+	now := metav1.Now()
+	status := instance.Status.Concurrency.DeepCopy()
+	if status != nil {
+		if checkAfter := getConcurrencyCheckDelay(status, desired, readyPods, now.Time); checkAfter > 0 {
+			return status, nil, checkAfter
+		}
+	} else {
+		status = &celeryv4.CeleryWorkerConcurrencyStatus{}
+	}
+	status.Desired = desired
+	status.LastCheckTime = &now
+	status.Workers = nil
+	if len(readyPods) == 0 {
+		return status, nil, CONCURRENCY_CHECK_INTERVAL
+	}
+
+	condition := &celeryv4.Condition{
+		Type:    celeryv4.PoolResized,
+		Status:  corev1.ConditionFalse,
+		Reason:  "FailedConnectBroker",
+	}
+	nodes := make([]string, 0, len(readyPods))
+	for i := range readyPods {
+		nodes = append(nodes, celeryv4.GetWorkerNodeName(&readyPods[i]))
+	}
+	controlClient, err := r.newControlClient(ctx, instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to the broker to resize the workers")
+		condition.Message = err.Error()
+		return status, condition, CONCURRENCY_CHECK_INTERVAL
+	}
+	defer controlClient.Close()
+	stats, err := controlClient.Stats(nodes...)
+	if err != nil {
+		reqLogger.Error(err, "Failed to inspect the concurrency of workers")
+		condition.Reason = "FailedInspectWorkers"
+		condition.Message = err.Error()
+		return status, condition, CONCURRENCY_CHECK_INTERVAL
+	}
+
+	// The workers with the same difference are resized by one broadcast
+	grow, shrink := map[int][]string{}, map[int][]string{}
+	workerIndexes := make(map[string]int, len(readyPods))
+	for i := range readyPods {
+		pod := &readyPods[i]
+		node := celeryv4.GetWorkerNodeName(pod)
+		workerStats, ok := stats[node]
+		if !ok {
+			continue
+		}
+		concurrency := workerStats.Pool.GetConcurrency()
+		workerIndexes[node] = len(status.Workers)
+		status.Workers = append(status.Workers, celeryv4.WorkerConcurrency{
+			Pod:         pod.Name,
+			Concurrency: int32(concurrency),
+		})
+		if diff := int(desired) - concurrency; diff > 0 {
+			grow[diff] = append(grow[diff], node)
+		} else if diff < 0 {
+			shrink[-diff] = append(shrink[-diff], node)
+		}
+	}
+	var resizeErr error
+	for n, workers := range grow {
+		reqLogger.Info("Growing the pools of workers", "Workers", workers, "Processes", n)
+		if _, err := controlClient.PoolGrow(n, workers...); err != nil {
+			reqLogger.Error(err, "Failed to grow the pools of workers", "Workers", workers)
+			resizeErr = fmt.Errorf("failed to grow the pools of %s: %v", strings.Join(workers, ", "), err)
+			continue
+		}
+		setPendingConcurrency(status, workerIndexes, workers, desired)
+	}
+	for n, workers := range shrink {
+		reqLogger.Info("Shrinking the pools of workers", "Workers", workers, "Processes", n)
+		if _, err := controlClient.PoolShrink(n, workers...); err != nil {
+			reqLogger.Error(err, "Failed to shrink the pools of workers", "Workers", workers)
+			resizeErr = fmt.Errorf("failed to shrink the pools of %s: %v", strings.Join(workers, ", "), err)
+			continue
+		}
+		setPendingConcurrency(status, workerIndexes, workers, desired)
+	}
+
+	switch {
+	case resizeErr != nil:
+		condition.Reason = "FailedResizePools"
+		condition.Message = resizeErr.Error()
+	case len(grow) > 0 || len(shrink) > 0 || len(status.Workers) < len(readyPods):
+		condition.Reason = "Resizing"
+		condition.Message = fmt.Sprintf("Waiting for the workers to report %d processes", desired)
+	default:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "Resized"
+		condition.Message = fmt.Sprintf("The workers run %d processes", desired)
+		return status, condition, CONCURRENCY_CHECK_INTERVAL
+	}
+	return status, condition, POOL_RESIZE_INTERVAL
+}
+
+// setPendingConcurrency records the concurrency the pools of the workers are being resized to
+func setPendingConcurrency(status *celeryv4.CeleryWorkerConcurrencyStatus, workerIndexes map[string]int, workers []string, desired int32) {
+	for _, worker := range workers {
+		if i, ok := workerIndexes[worker]; ok {
+			status.Workers[i].Pending = desired
+		}
+	}
+}
+
+// getConcurrencyCheckDelay returns the duration until the workers should be inspected, or 0 if they should be now.
+// The new workers and the ones being resized are not checked in every reconciliation, so the pools are not resized
+// twice before the workers report their new processes.
+func getConcurrencyCheckDelay(status *celeryv4.CeleryWorkerConcurrencyStatus, desired int32, pods []corev1.Pod, now time.Time) time.Duration {
+	if status.LastCheckTime == nil || status.Desired != desired {
+		return 0
+	}
+	elapsed := now.Sub(status.LastCheckTime.Time)
+	observed := make(map[string]int32, len(status.Workers))
+	for _, worker := range status.Workers {
+		observed[worker.Pod] = worker.Concurrency
+	}
+	interval := CONCURRENCY_CHECK_INTERVAL
+	for _, pod := range pods {
+		if concurrency, ok := observed[pod.Name]; !ok || concurrency != desired {
+			interval = POOL_RESIZE_INTERVAL
+			break
+		}
+	}
+	if elapsed >= interval {
+		return 0
+	}
+	return interval - elapsed
+}
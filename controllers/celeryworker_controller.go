@@ -20,7 +20,9 @@ import (
 	"context"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -36,6 +38,8 @@ type CeleryWorkerReconciler Reconciler
 // +kubebuilder:rbac:groups=celery.celeryproject.org,resources=celeryworkers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=pod,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=pod/status,verbs=get
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CeleryWorkerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -53,38 +57,75 @@ func (r *CeleryWorkerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
 	}
+	// The config is mounted by the pods, so it is rendered before they are created
+	configMap, err := instance.GenerateConfigMap()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := reconcileConfigMap(ctx, (*Reconciler)(r), instance, instance.GetConfigMapName(), configMap); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := reconcileBrokerURLSecret(ctx, (*Reconciler)(r), instance, instance.GetBrokerURLSecretName(), instance.GenerateBrokerURLSecret()); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Handle the object creation
 	existingPodList := &corev1.PodList{}
-	err = r.Client.List(ctx, existingPodList, client.MatchingLabels{
-		"celery-app": instance.Name,
-		"type":       "worker",
-	})
-
-	// If there is an update compared to existing spec, recreate all pods
-	if !instance.IsUpToDate(existingPodList.Items) {
-		reqLogger.Info("The spec has been updated...Recreating all the pods...")
-		podList := instance.Generate(instance.Spec.Replicas)
-		for _, pod := range existingPodList.Items {
-			reqLogger.Info("Deleteing the old Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-			if err := r.Client.Delete(ctx, &pod); err != nil {
-				return ctrl.Result{}, err
-			}
+	err = r.Client.List(ctx, existingPodList, client.InNamespace(instance.Namespace), client.MatchingLabels(instance.GetPodLabels()))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// The draining workers are leaving, so they are not counted like the terminating ones
+	pods, drainingPods := splitDrainingPods(filterActivePods(existingPodList.Items))
+	if err := adoptLegacyPods(ctx, r.Client, pods, instance.IsPodUpToDate, instance.GetSpecHash()); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Handle the autoscaling before deciding the number of pods.
+	// The decision is kept in memory and written with the rest of the status
+	observed := instance.Status.DeepCopy()
+	result := ctrl.Result{}
+	if instance.Spec.Autoscaling == nil {
+		instance.Status.Autoscaling = nil
+		celeryv4.RemoveCondition(&instance.Status.Conditions, celeryv4.ScalingActive)
+	} else {
+		autoscaling, scalingActive, requeueAfter := r.autoscale(ctx, instance, pods)
+		instance.Status.Autoscaling = autoscaling
+		if scalingActive != nil {
+			celeryv4.SetCondition(&instance.Status.Conditions, *scalingActive)
 		}
-		for _, pod := range podList {
-			reqLogger.Info("Creating a new Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-			if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			if err := r.Client.Create(ctx, pod); err != nil {
-				return ctrl.Result{}, err
-			}
+		result.RequeueAfter = requeueAfter
+	}
+	draining, err := r.checkDrainingWorkers(ctx, instance, drainingPods)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if draining {
+		requeueSooner(&result, DRAIN_INTERVAL)
+	}
+	concurrency, poolResized, checkAfter := r.resizeWorkers(ctx, instance, pods)
+	if concurrency == nil {
+		celeryv4.RemoveCondition(&instance.Status.Conditions, celeryv4.PoolResized)
+	} else if poolResized != nil {
+		celeryv4.SetCondition(&instance.Status.Conditions, *poolResized)
+	}
+	requeueSooner(&result, checkAfter)
+	if err := r.updateStatus(ctx, instance, observed, pods, concurrency); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// If there is an update compared to existing spec, roll out the new pods
+	if !instance.IsUpToDate(pods) {
+		reqLogger.Info("The spec has been updated...Rolling out the new pods...")
+		if err := r.rollout(ctx, instance, pods); err != nil {
+			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
+		return result, nil
 	}
 
-	replicaDiff := instance.Spec.Replicas - len(existingPodList.Items)
+	replicaDiff := instance.GetDesiredReplicas() - len(pods)
 	if replicaDiff >= 0 {
-		// If the desired replicas is smaller than existing old, create pods
+		// If the desired replicas is larger than existing pods, create pods
 		podList := instance.Generate(replicaDiff)
 		for _, pod := range podList {
 			found := &corev1.Pod{}
@@ -100,28 +141,99 @@ func (r *CeleryWorkerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 			}
 		}
 	} else {
-		// If the desired replicas is larger than existing old, delete pods
-		podList := existingPodList.Items[:(replicaDiff * -1)]
-		for _, pod := range podList {
-			found := &corev1.Pod{}
-			err = r.Client.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found)
-			if err != nil {
-				reqLogger.Info("Creating a new Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-				return ctrl.Result{}, err
-			} else {
-				if err = r.Client.Delete(ctx, found); err != nil {
-					return ctrl.Result{}, err
-				}
+		// If the desired replicas is smaller than existing pods, drain and delete the idle pods
+		if err := r.removeWorkers(ctx, instance, r.selectVictims(ctx, instance, pods, replicaDiff*-1)); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// rollout replaces the outdated pods gradually within the limits of rolling update.
+// New pods are created up to the surge limit and the outdated pods are only deleted
+// when enough pods are available, so a failing image stops the rollout.
+func (r *CeleryWorkerReconciler) rollout(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) error {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	desiredReplicas := instance.GetDesiredReplicas()
+	maxSurge, maxUnavailable, err := instance.GetRollingUpdateLimits()
+	if err != nil {
+		return err
+	}
+	updatedPods := make([]corev1.Pod, 0)
+	outdatedPods := make([]corev1.Pod, 0)
+	availablePods := 0
+	for _, pod := range pods {
+		if instance.IsPodUpToDate(&pod) {
+			updatedPods = append(updatedPods, pod)
+		} else {
+			outdatedPods = append(outdatedPods, pod)
+		}
+		if isPodReady(&pod) {
+			availablePods++
+		}
+	}
+	reqLogger.Info("Rolling update progress",
+		"Updated", len(updatedPods),
+		"Outdated", len(outdatedPods),
+		"Available", availablePods,
+		"MaxSurge", maxSurge,
+		"MaxUnavailable", maxUnavailable)
+
+	// Create the new pods within the surge limit
+	toBeCreated := desiredReplicas - len(updatedPods)
+	if allowed := desiredReplicas + maxSurge - len(pods); toBeCreated > allowed {
+		toBeCreated = allowed
+	}
+	if toBeCreated > 0 {
+		for _, pod := range instance.Generate(toBeCreated) {
+			reqLogger.Info("Creating a new Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+			if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
+				return err
+			}
+			if err := r.Client.Create(ctx, pod); err != nil {
+				return err
 			}
 		}
 	}
 
-	return ctrl.Result{}, nil
+	// Delete the outdated pods without going below the minimum available pods.
+	// The unavailable ones can always be deleted as they are not serving.
+	toBeDeleted := availablePods - (desiredReplicas - maxUnavailable)
+	removedPods := make([]corev1.Pod, 0)
+	for _, pod := range outdatedPods {
+		ready := isPodReady(&pod)
+		if ready && toBeDeleted <= 0 {
+			continue
+		}
+		removedPods = append(removedPods, pod)
+		if ready {
+			toBeDeleted--
+		}
+	}
+
+	return r.removeWorkers(ctx, instance, removedPods)
+}
+
+// updateStatus reports the observed pods. The selector is required by the scale subresource
+func (r *CeleryWorkerReconciler) updateStatus(ctx context.Context, instance *celeryv4.CeleryWorker, observed *celeryv4.CeleryWorkerStatus, pods []corev1.Pod, concurrency *celeryv4.CeleryWorkerConcurrencyStatus) error {
+	status := &instance.Status
+	status.Concurrency = concurrency
+	observeReplicaStatus(&status.ReplicaStatus, pods, instance.GetDesiredReplicas(), instance.IsPodUpToDate)
+	status.ObservedGeneration = instance.Generation
+	status.Selector = labels.SelectorFromSet(instance.GetPodLabels()).String()
+	if equality.Semantic.DeepEqual(status, observed) {
+		return nil
+	}
+	return r.Client.Status().Update(ctx, instance)
 }
 
 func (r *CeleryWorkerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&celeryv4.CeleryWorker{}).
 		Owns(&corev1.Pod{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
 		Complete(r)
 }
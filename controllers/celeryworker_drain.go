@@ -0,0 +1,227 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
+	"github.com/RyanSiu1995/celery-operator/pkg/control"
+)
+
+// splitDrainingPods separates the pods being drained from the serving ones
+func splitDrainingPods(pods []corev1.Pod) ([]corev1.Pod, []corev1.Pod) {
+	servingPods := make([]corev1.Pod, 0, len(pods))
+	drainingPods := make([]corev1.Pod, 0)
+	for _, pod := range pods {
+		if _, ok := pod.Annotations[celeryv4.DrainStartedAnnotation]; ok {
+			drainingPods = append(drainingPods, pod)
+		} else {
+			servingPods = append(servingPods, pod)
+		}
+	}
+	return servingPods, drainingPods
+}
+
+// newControlClient connects to the broker of the workers for the remote control
+func (r *CeleryWorkerReconciler) newControlClient(ctx context.Context, instance *celeryv4.CeleryWorker) (*control.Client, error) {
+	address, err := getBrokerAddress(ctx, r.Client, instance.Namespace, instance.Spec.BrokerAddress, instance.Spec.BrokerAddressSecretRef)
+	if err != nil {
+		return nil, err
+	}
+	return control.NewClient(address, instance.Spec.BrokerTransportOptions)
+}
+
+// removeWorkers deletes the pods, or starts draining them if draining is enabled.
+// The drained workers stop consuming the target queues and are deleted by checkDrainingWorkers.
+func (r *CeleryWorkerReconciler) removeWorkers(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) error {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	if len(pods) == 0 {
+		return nil
+	}
+
+	if instance.GetDrainTimeout() == 0 {
+		for i := range pods {
+			pod := &pods[i]
+			reqLogger.Info("Deleteing the old Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+			if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	nodes := make([]string, 0, len(pods))
+	for i := range pods {
+		nodes = append(nodes, celeryv4.GetWorkerNodeName(&pods[i]))
+	}
+	// The workers are still deleted after the timeout if the broker is unreachable
+	controlClient, err := r.newControlClient(ctx, instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to the broker to drain the workers")
+	} else {
+		defer controlClient.Close()
+		for _, queue := range instance.GetTargetQueues() {
+			if _, err := controlClient.CancelConsumer(queue, nodes...); err != nil {
+				reqLogger.Error(err, "Failed to stop the workers from consuming the queue", "Queue", queue)
+			}
+		}
+	}
+
+	startedAt := time.Now().UTC().Format(time.RFC3339)
+	for i := range pods {
+		pod := &pods[i]
+		reqLogger.Info("Draining the old Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[celeryv4.DrainStartedAnnotation] = startedAt
+		if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDrainingWorkers deletes the draining workers which are idle or have reached the drain timeout.
+// It returns whether any worker is still draining.
+func (r *CeleryWorkerReconciler) checkDrainingWorkers(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod) (bool, error) {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	if len(pods) == 0 {
+		return false, nil
+	}
+
+	nodes := make([]string, 0, len(pods))
+	for i := range pods {
+		nodes = append(nodes, celeryv4.GetWorkerNodeName(&pods[i]))
+	}
+	var tasks map[string]int
+	controlClient, err := r.newControlClient(ctx, instance)
+	if err == nil {
+		defer controlClient.Close()
+		tasks, err = countWorkerTasks(controlClient, nodes)
+	}
+	if err != nil {
+		reqLogger.Error(err, "Failed to inspect the draining workers")
+	}
+
+	now := time.Now()
+	draining := false
+	for i := range pods {
+		pod := &pods[i]
+		count, replied := tasks[celeryv4.GetWorkerNodeName(pod)]
+		if !isWorkerDrained(pod, count, replied, now, instance.GetDrainTimeout()) {
+			draining = true
+			continue
+		}
+		reqLogger.Info("Deleteing the drained Worker pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name, "Tasks", count)
+		if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return draining, nil
+}
+
+// selectVictims picks the workers removed by scaling down, so the long running tasks are not killed
+// because of the order of pods. The workers not ready are picked first, then the ones with the fewest
+// running and prefetched tasks. The youngest workers are picked if the workers cannot be inspected.
+func (r *CeleryWorkerReconciler) selectVictims(ctx context.Context, instance *celeryv4.CeleryWorker, pods []corev1.Pod, count int) []corev1.Pod {
+	reqLogger := r.Log.WithValues("celeryworker", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	nodes := make([]string, 0, len(pods))
+	for i := range pods {
+		if isPodReady(&pods[i]) {
+			nodes = append(nodes, celeryv4.GetWorkerNodeName(&pods[i]))
+		}
+	}
+	// The workers are not inspected if the ones not ready are enough
+	var tasks map[string]int
+	if len(nodes) > 0 && len(pods)-len(nodes) < count {
+		controlClient, err := r.newControlClient(ctx, instance)
+		if err == nil {
+			defer controlClient.Close()
+			tasks, err = countWorkerTasks(controlClient, nodes)
+		}
+		if err != nil {
+			reqLogger.Error(err, "Failed to inspect the workers, the youngest ones are scaled down")
+		}
+	}
+
+	victims := append([]corev1.Pod{}, pods...)
+	sortVictims(victims, tasks)
+	return victims[:count]
+}
+
+// sortVictims orders the workers by their preference to be removed
+func sortVictims(pods []corev1.Pod, tasks map[string]int) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		iReady, jReady := isPodReady(&pods[i]), isPodReady(&pods[j])
+		if iReady != jReady {
+			return !iReady
+		}
+		iTasks, iReplied := tasks[celeryv4.GetWorkerNodeName(&pods[i])]
+		jTasks, jReplied := tasks[celeryv4.GetWorkerNodeName(&pods[j])]
+		if iReplied != jReplied {
+			return iReplied
+		}
+		if iTasks != jTasks {
+			return iTasks < jTasks
+		}
+		return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp)
+	})
+}
+
+// countWorkerTasks returns the number of the running and prefetched tasks of the workers replying to both inspections
+func countWorkerTasks(controlClient *control.Client, nodes []string) (map[string]int, error) {
+	active, err := controlClient.Active(nodes...)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := controlClient.Reserved(nodes...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(active))
+	for node, activeTasks := range active {
+		if reservedTasks, ok := reserved[node]; ok {
+			counts[node] = len(activeTasks) + len(reservedTasks)
+		}
+	}
+	return counts, nil
+}
+
+// isWorkerDrained checks whether the draining worker can be deleted. It is deleted once it reports no task,
+// it is not running or the drain timeout is reached. The workers not replying may be busy, e.g. with the solo pool,
+// so they are waited until the timeout.
+func isWorkerDrained(pod *corev1.Pod, tasks int, replied bool, now time.Time, timeout time.Duration) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return true
+	}
+	if replied && tasks == 0 {
+		return true
+	}
+	startedAt, err := time.Parse(time.RFC3339, pod.Annotations[celeryv4.DrainStartedAnnotation])
+	return err != nil || now.Sub(startedAt) >= timeout
+}
@@ -17,17 +17,42 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	celeryv4 "github.com/RyanSiu1995/celery-operator/api/v4"
 )
 
 const REQUEUE_TIMEOUT time.Duration = 2 * time.Second
 
+// AUTOSCALING_INTERVAL defines how often the queue depths are checked for autoscaling
+const AUTOSCALING_INTERVAL time.Duration = 15 * time.Second
+
+// DRAIN_INTERVAL defines how often the draining workers are checked
+const DRAIN_INTERVAL time.Duration = 5 * time.Second
+
+// BEAT_HANDOVER_INTERVAL defines how often the rollout of schedulers checks the new standbys and the demoted beat
+const BEAT_HANDOVER_INTERVAL time.Duration = 5 * time.Second
+
+// CONCURRENCY_CHECK_INTERVAL defines how often the concurrency of workers is inspected
+const CONCURRENCY_CHECK_INTERVAL time.Duration = 60 * time.Second
+
+// POOL_RESIZE_INTERVAL defines how soon the new workers and the ones being resized are inspected again
+const POOL_RESIZE_INTERVAL time.Duration = 10 * time.Second
+
 type Reconciler struct {
 	client.Client
 	Log    logr.Logger
@@ -37,3 +62,230 @@ type Reconciler struct {
 func (_ *Reconciler) SetupWithManager(_ ctrl.Manager) error {
 	return errors.New("Not implemented")
 }
+
+// requeueSooner shortens the requeue of the result to the duration if it is sooner
+func requeueSooner(result *ctrl.Result, after time.Duration) {
+	if after > 0 && (result.RequeueAfter == 0 || result.RequeueAfter > after) {
+		result.RequeueAfter = after
+	}
+}
+
+// isPodReady checks whether the pod is running and passing its readiness check
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// filterActivePods drops the pods which are being terminated
+func filterActivePods(pods []corev1.Pod) []corev1.Pod {
+	activePods := make([]corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil {
+			activePods = append(activePods, pod)
+		}
+	}
+	return activePods
+}
+
+// getBrokerAddress resolves the broker url from the secret if it is given
+func getBrokerAddress(ctx context.Context, c client.Client, namespace string, address string, secretRef *corev1.SecretKeySelector) (string, error) {
+	if secretRef == nil {
+		return address, nil
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: secretRef.Name, Namespace: namespace}, secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[secretRef.Key]
+	if !ok {
+		return "", fmt.Errorf("key %q is not found in secret %s", secretRef.Key, secretRef.Name)
+	}
+	return string(value), nil
+}
+
+// reconcileConfigMap creates or updates the config map rendering the celery config of the owner.
+// The config map with the given name is deleted if the config is removed, unless it is not owned by the owner.
+func reconcileConfigMap(ctx context.Context, r *Reconciler, owner metav1.Object, name string, configMap *corev1.ConfigMap) error {
+	reqLogger := r.Log.WithValues("owner", types.NamespacedName{Name: owner.GetName(), Namespace: owner.GetNamespace()})
+
+	found := &corev1.ConfigMap{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: owner.GetNamespace()}, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if configMap == nil {
+		if exists && metav1.IsControlledBy(found, owner) {
+			reqLogger.Info("Deleting the celery config", "ConfigMap.Namespace", found.Namespace, "ConfigMap.Name", found.Name)
+			if err := r.Client.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if !exists {
+		if err := controllerutil.SetControllerReference(owner, configMap, r.Scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating the celery config", "ConfigMap.Namespace", configMap.Namespace, "ConfigMap.Name", configMap.Name)
+		return r.Client.Create(ctx, configMap)
+	}
+	if !reflect.DeepEqual(found.Data, configMap.Data) {
+		reqLogger.Info("Updating the celery config", "ConfigMap.Namespace", found.Namespace, "ConfigMap.Name", found.Name)
+		found.Data = configMap.Data
+		return r.Client.Update(ctx, found)
+	}
+	return nil
+}
+
+// reconcileBrokerURLSecret creates or updates the secret keeping the plain broker address of the owner,
+// so the address is not exposed in the pod spec. The secret is deleted once the address is read from another secret.
+func reconcileBrokerURLSecret(ctx context.Context, r *Reconciler, owner metav1.Object, name string, secret *corev1.Secret) error {
+	reqLogger := r.Log.WithValues("owner", types.NamespacedName{Name: owner.GetName(), Namespace: owner.GetNamespace()})
+
+	found := &corev1.Secret{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: owner.GetNamespace()}, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if exists && !metav1.IsControlledBy(found, owner) {
+		if secret == nil {
+			return nil
+		}
+		return fmt.Errorf("secret %s is not controlled by %s", name, owner.GetName())
+	}
+	if secret == nil {
+		if exists {
+			reqLogger.Info("Deleting the Broker url secret", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+			if err := r.Client.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if !exists {
+		if err := controllerutil.SetControllerReference(owner, secret, r.Scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating the Broker url secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		return r.Client.Create(ctx, secret)
+	}
+	if !reflect.DeepEqual(found.Data, secret.Data) {
+		reqLogger.Info("Updating the Broker url secret", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+		found.Data = secret.Data
+		return r.Client.Update(ctx, found)
+	}
+	return nil
+}
+
+// adoptLegacyPods stamps the spec hash on the up to date pods created by the previous versions
+// of operator, so they can be compared by the hash without being restarted
+func adoptLegacyPods(ctx context.Context, c client.Client, pods []corev1.Pod, isUpToDate func(*corev1.Pod) bool, specHash string) error {
+	for i := range pods {
+		pod := &pods[i]
+		if _, ok := pod.Annotations[celeryv4.SpecHashAnnotation]; ok || !isUpToDate(pod) {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[celeryv4.SpecHashAnnotation] = specHash
+		if err := c.Patch(ctx, pod, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeReplicaStatus counts the pods and sets the Available, Progressing and Degraded conditions
+func observeReplicaStatus(status *celeryv4.ReplicaStatus, pods []corev1.Pod, desired int, isUpToDate func(*corev1.Pod) bool) {
+	status.Replicas = len(pods)
+	status.ReadyReplicas = 0
+	status.UpdatedReplicas = 0
+	for i := range pods {
+		if isPodReady(&pods[i]) {
+			status.ReadyReplicas++
+		}
+		if isUpToDate(&pods[i]) {
+			status.UpdatedReplicas++
+		}
+	}
+
+	available := celeryv4.Condition{
+		Type:    celeryv4.Available,
+		Status:  corev1.ConditionTrue,
+		Reason:  "MinimumReplicasAvailable",
+		Message: fmt.Sprintf("%d of %d pods are ready", status.ReadyReplicas, desired),
+	}
+	if status.ReadyReplicas < desired {
+		available.Status = corev1.ConditionFalse
+		available.Reason = "MinimumReplicasUnavailable"
+	}
+	celeryv4.SetCondition(&status.Conditions, available)
+
+	progressing := celeryv4.Condition{
+		Type:    celeryv4.Progressing,
+		Status:  corev1.ConditionFalse,
+		Reason:  "ReplicasUpToDate",
+		Message: fmt.Sprintf("%d of %d pods are up to date", status.UpdatedReplicas, desired),
+	}
+	switch {
+	case status.UpdatedReplicas < status.Replicas:
+		progressing.Status = corev1.ConditionTrue
+		progressing.Reason = "RollingOut"
+	case status.Replicas != desired:
+		progressing.Status = corev1.ConditionTrue
+		progressing.Reason = "Scaling"
+	}
+	celeryv4.SetCondition(&status.Conditions, progressing)
+
+	degraded := celeryv4.Condition{
+		Type:   celeryv4.Degraded,
+		Status: corev1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	for i := range pods {
+		if reason, message := getPodFailure(&pods[i]); reason != "" {
+			degraded.Status = corev1.ConditionTrue
+			degraded.Reason = reason
+			degraded.Message = fmt.Sprintf("Pod %s is in %s", pods[i].Name, reason)
+			if message != "" {
+				degraded.Message += ": " + message
+			}
+			break
+		}
+	}
+	celeryv4.SetCondition(&status.Conditions, degraded)
+}
+
+// getPodFailure returns the reason and message if the pod cannot be scheduled or keeps failing
+func getPodFailure(pod *corev1.Pod) (string, string) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return condition.Reason, condition.Message
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case "CrashLoopBackOff", "ImagePullBackOff", "ErrImagePull", "CreateContainerConfigError":
+			return status.State.Waiting.Reason, status.State.Waiting.Message
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return "PodFailed", pod.Status.Message
+	}
+	return "", ""
+}
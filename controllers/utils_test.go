@@ -21,6 +21,9 @@ import (
 	"io/ioutil"
 
 	"github.com/ghodss/yaml"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func getTemplateConfig(pathToTemplate string, objectPointer interface{}) error {
@@ -39,3 +42,39 @@ func getTemplateConfig(pathToTemplate string, objectPointer interface{}) error {
 
 	return nil
 }
+
+// markPodReady simulates the kubelet which is not available in the test environment
+func markPodReady(name string) error {
+	pod := &corev1.Pod{}
+	err := k8sClient.Get(ctx, client.ObjectKey{
+		Namespace: "default",
+		Name:      name,
+	}, pod)
+	if err != nil {
+		return err
+	}
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{
+		{
+			Type:   corev1.PodReady,
+			Status: corev1.ConditionTrue,
+		},
+	}
+	return k8sClient.Status().Update(ctx, pod)
+}
+
+// markStatefulSetReady simulates the statefulset controller which is not available in the test environment
+func markStatefulSetReady(name string) error {
+	statefulSet := &appsv1.StatefulSet{}
+	err := k8sClient.Get(ctx, client.ObjectKey{
+		Namespace: "default",
+		Name:      name,
+	}, statefulSet)
+	if err != nil {
+		return err
+	}
+	statefulSet.Status.Replicas = *statefulSet.Spec.Replicas
+	statefulSet.Status.ReadyReplicas = *statefulSet.Spec.Replicas
+	statefulSet.Status.UpdatedReplicas = *statefulSet.Spec.Replicas
+	return k8sClient.Status().Update(ctx, statefulSet)
+}
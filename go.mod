@@ -3,12 +3,16 @@ module github.com/RyanSiu1995/celery-operator
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.13.3
 	github.com/ghodss/yaml v1.0.0
 	github.com/go-logr/logr v0.1.0
+	github.com/go-redis/redis/v7 v7.4.0
 	github.com/onsi/ginkgo v1.12.1
 	github.com/onsi/gomega v1.10.1
+	github.com/streadway/amqp v1.0.0
 	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.18.6
+	k8s.io/apiextensions-apiserver v0.18.6
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
 	sigs.k8s.io/controller-runtime v0.6.2
@@ -99,6 +99,37 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "CeleryWorker")
 		os.Exit(1)
 	}
+	if err = (&controllers.CeleryPeriodicTaskReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("CeleryPeriodicTask"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CeleryPeriodicTask")
+		os.Exit(1)
+	}
+	// The webhooks can be disabled to run the manager locally without certificates
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&celeryv4.Celery{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Celery")
+			os.Exit(1)
+		}
+		if err = (&celeryv4.CeleryBroker{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CeleryBroker")
+			os.Exit(1)
+		}
+		if err = (&celeryv4.CeleryScheduler{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CeleryScheduler")
+			os.Exit(1)
+		}
+		if err = (&celeryv4.CeleryWorker{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CeleryWorker")
+			os.Exit(1)
+		}
+		if err = (&celeryv4.CeleryPeriodicTask{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CeleryPeriodicTask")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,48 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package broker contains the clients to inspect the brokers used by celery
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialTimeout defines the timeout of connecting and talking to the broker
+const DialTimeout time.Duration = 2 * time.Second
+
+// ErrUnsupportedBroker is returned when the queue depths cannot be read from the type of broker, e.g. rabbitmq
+var ErrUnsupportedBroker = errors.New("unsupported broker")
+
+// GetQueueDepths returns the number of pending messages of each queue in the broker.
+// The transport options are the broker_transport_options of celery, e.g. master_name for sentinel.
+func GetQueueDepths(address string, transportOptions map[string]string, queues []string) (map[string]int64, error) {
+	// Sentinel addresses are separated by semicolons
+	brokerURL, err := url.Parse(strings.Split(address, ";")[0])
+	if err != nil {
+		return nil, err
+	}
+	switch brokerURL.Scheme {
+	case "redis", "rediss", "sentinel":
+		return getRedisQueueDepths(address, transportOptions, queues)
+	default:
+		return nil, fmt.Errorf("%w scheme %q", ErrUnsupportedBroker, brokerURL.Scheme)
+	}
+}
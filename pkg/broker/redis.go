@@ -0,0 +1,162 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Kombu keeps the messages with different priorities in separated lists.
+// The list of priority 0 uses the queue name as the key.
+var redisPrioritySteps = []int{0, 3, 6, 9}
+
+const redisPrioritySeparator = "\x06\x16"
+
+// NewRedisClient connects to the redis or sentinel address in the format of kombu
+func NewRedisClient(address string, transportOptions map[string]string) (*redis.Client, error) {
+	if strings.HasPrefix(address, "sentinel://") {
+		options, err := parseSentinelURL(address, transportOptions)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(options), nil
+	}
+	options, err := redis.ParseURL(address)
+	if err != nil {
+		return nil, err
+	}
+	options.DialTimeout = DialTimeout
+	options.ReadTimeout = DialTimeout
+	options.WriteTimeout = DialTimeout
+	options.MaxRetries = 0
+	return redis.NewClient(options), nil
+}
+
+// parseSentinelURL parses the sentinel addresses in the format of kombu,
+// e.g. sentinel://host-1:26379;sentinel://host-2:26379. The password and database
+// of redis are taken from the first address.
+func parseSentinelURL(address string, transportOptions map[string]string) (*redis.FailoverOptions, error) {
+	options := &redis.FailoverOptions{
+		MasterName:   transportOptions["master_name"],
+		DialTimeout:  DialTimeout,
+		ReadTimeout:  DialTimeout,
+		WriteTimeout: DialTimeout,
+		MaxRetries:   0,
+	}
+	if options.MasterName == "" {
+		return nil, fmt.Errorf("master_name is missing in the transport options of sentinel")
+	}
+	for i, part := range strings.Split(address, ";") {
+		sentinelURL, err := url.Parse(part)
+		if err != nil {
+			return nil, err
+		}
+		if sentinelURL.Scheme != "sentinel" {
+			return nil, fmt.Errorf("invalid sentinel address %q", part)
+		}
+		port := sentinelURL.Port()
+		if port == "" {
+			port = "26379"
+		}
+		options.SentinelAddrs = append(options.SentinelAddrs, net.JoinHostPort(sentinelURL.Hostname(), port))
+		if i > 0 {
+			continue
+		}
+		if password, ok := sentinelURL.User.Password(); ok {
+			options.Password = password
+		}
+		if db := strings.TrimPrefix(sentinelURL.Path, "/"); db != "" {
+			if options.DB, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid redis database %q", db)
+			}
+		}
+	}
+	return options, nil
+}
+
+// GetSentinelPrimary returns the host of the primary known by the sentinels
+func GetSentinelPrimary(address string, transportOptions map[string]string) (string, error) {
+	options, err := parseSentinelURL(address, transportOptions)
+	if err != nil {
+		return "", err
+	}
+	var lastErr error
+	for _, sentinelAddr := range options.SentinelAddrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{
+			Addr:         sentinelAddr,
+			DialTimeout:  DialTimeout,
+			ReadTimeout:  DialTimeout,
+			WriteTimeout: DialTimeout,
+			MaxRetries:   0,
+		})
+		primary, err := sentinel.GetMasterAddrByName(options.MasterName).Result()
+		sentinel.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(primary) > 0 {
+			return primary[0], nil
+		}
+	}
+	return "", fmt.Errorf("failed to get the primary from sentinels: %v", lastErr)
+}
+
+func redisQueueKeys(queue string) []string {
+	keys := make([]string, 0, len(redisPrioritySteps))
+	for _, step := range redisPrioritySteps {
+		if step == 0 {
+			keys = append(keys, queue)
+		} else {
+			keys = append(keys, fmt.Sprintf("%s%s%d", queue, redisPrioritySeparator, step))
+		}
+	}
+	return keys
+}
+
+func getRedisQueueDepths(address string, transportOptions map[string]string, queues []string) (map[string]int64, error) {
+	client, err := NewRedisClient(address, transportOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	pipeline := client.Pipeline()
+	commands := make(map[string][]*redis.IntCmd)
+	for _, queue := range queues {
+		for _, key := range redisQueueKeys(queue) {
+			commands[queue] = append(commands[queue], pipeline.LLen(key))
+		}
+	}
+	if _, err := pipeline.Exec(); err != nil {
+		return nil, err
+	}
+
+	depths := make(map[string]int64)
+	for queue, queueCommands := range commands {
+		for _, command := range queueCommands {
+			depths[queue] += command.Val()
+		}
+	}
+	return depths, nil
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestGetRedisQueueDepths(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start redis: %v", err)
+	}
+	defer server.Close()
+
+	// Kombu pushes the messages of priority 0 to the queue and the others to the keys of the priority steps
+	for key, count := range map[string]int{
+		"celery":             3,
+		"celery\x06\x163":    2,
+		"celery\x06\x166":    1,
+		"celery\x06\x169":    4,
+		"high":               5,
+		"celery\x06\x164":    7,
+		"unrelated\x06\x163": 8,
+	} {
+		for i := 0; i < count; i++ {
+			server.Lpush(key, "message")
+		}
+	}
+
+	depths, err := GetQueueDepths("redis://"+server.Addr()+"/0", nil, []string{"celery", "high", "empty"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := map[string]int64{"celery": 10, "high": 5, "empty": 0}
+	if !reflect.DeepEqual(depths, expected) {
+		t.Errorf("expected %v, got %v", expected, depths)
+	}
+}
+
+func TestGetQueueDepthsUnsupportedScheme(t *testing.T) {
+	if _, err := GetQueueDepths("amqp://guest@rabbitmq:5672//", nil, []string{"celery"}); !errors.Is(err, ErrUnsupportedBroker) {
+		t.Errorf("expected an error for the unsupported broker, got %v", err)
+	}
+}
+
+func TestParseSentinelURL(t *testing.T) {
+	options, err := parseSentinelURL(
+		"sentinel://:secret@sentinel-0:26380/2;sentinel://sentinel-1;sentinel://:other@sentinel-2:26379/5",
+		map[string]string{"master_name": "mymaster"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if options.MasterName != "mymaster" {
+		t.Errorf("expected the master name mymaster, got %q", options.MasterName)
+	}
+	expected := []string{"sentinel-0:26380", "sentinel-1:26379", "sentinel-2:26379"}
+	if !reflect.DeepEqual(options.SentinelAddrs, expected) {
+		t.Errorf("expected the sentinels %v, got %v", expected, options.SentinelAddrs)
+	}
+	// The password and database are taken from the first address
+	if options.Password != "secret" || options.DB != 2 {
+		t.Errorf("expected the password and database of the first address, got %q and %d", options.Password, options.DB)
+	}
+}
+
+func TestParseSentinelURLErrors(t *testing.T) {
+	cases := map[string]struct {
+		address          string
+		transportOptions map[string]string
+		message          string
+	}{
+		"missing master name": {
+			address: "sentinel://sentinel-0:26379",
+			message: "master_name",
+		},
+		"mixed scheme": {
+			address:          "sentinel://sentinel-0:26379;redis://redis:6379",
+			transportOptions: map[string]string{"master_name": "mymaster"},
+			message:          "invalid sentinel address",
+		},
+		"invalid database": {
+			address:          "sentinel://sentinel-0:26379/db",
+			transportOptions: map[string]string{"master_name": "mymaster"},
+			message:          "invalid redis database",
+		},
+	}
+	for name, c := range cases {
+		_, err := parseSentinelURL(c.address, c.transportOptions)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected the error about %q, got %v", name, c.message, err)
+		}
+	}
+	if _, err := NewRedisClient("sentinel://sentinel-0:26379", nil); err == nil {
+		t.Errorf("expected the client to require master_name")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package control
+
+import (
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/RyanSiu1995/celery-operator/pkg/broker"
+)
+
+// pidboxExchangeTypes are the types of the exchanges declared by the mailbox of kombu
+var pidboxExchangeTypes = map[string]string{
+	Exchange:      amqp.ExchangeFanout,
+	ReplyExchange: amqp.ExchangeDirect,
+}
+
+// replyQueueExpires drops the reply queues left by the broken connections like kombu does
+const replyQueueExpires int32 = 10000
+
+// amqpTransport talks to the exchanges of rabbitmq directly
+type amqpTransport struct {
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	deliveries map[string]<-chan amqp.Delivery
+}
+
+// toAMQPURL converts the url of kombu, e.g. pyamqp://guest@localhost//, to the one of the amqp client
+func toAMQPURL(address string) string {
+	for _, scheme := range []string{"pyamqp://", "librabbitmq://"} {
+		if strings.HasPrefix(address, scheme) {
+			return "amqp://" + strings.TrimPrefix(address, scheme)
+		}
+	}
+	return address
+}
+
+func newAMQPTransport(address string) (*amqpTransport, error) {
+	connection, err := amqp.DialConfig(toAMQPURL(address), amqp.Config{
+		Dial: amqp.DefaultDial(broker.DialTimeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return &amqpTransport{
+		connection: connection,
+		channel:    channel,
+		deliveries: map[string]<-chan amqp.Delivery{},
+	}, nil
+}
+
+func (t *amqpTransport) declareExchange(exchange string) error {
+	return t.channel.ExchangeDeclare(exchange, pidboxExchangeTypes[exchange], false, false, false, false, nil)
+}
+
+func (t *amqpTransport) declareReplyQueue(queue string, routingKey string) error {
+	if err := t.declareExchange(ReplyExchange); err != nil {
+		return err
+	}
+	_, err := t.channel.QueueDeclare(queue, false, true, false, false, amqp.Table{
+		"x-expires": replyQueueExpires,
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.channel.QueueBind(queue, routingKey, ReplyExchange, false, nil); err != nil {
+		return err
+	}
+	deliveries, err := t.channel.Consume(queue, "", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	t.deliveries[queue] = deliveries
+	return nil
+}
+
+func (t *amqpTransport) deleteReplyQueue(queue string, routingKey string) error {
+	delete(t.deliveries, queue)
+	_, err := t.channel.QueueDelete(queue, false, false, false)
+	return err
+}
+
+func (t *amqpTransport) publish(exchange string, routingKey string, msg *message) error {
+	if err := t.declareExchange(exchange); err != nil {
+		return err
+	}
+	return t.channel.Publish(exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:     "application/json",
+		ContentEncoding: "utf-8",
+		Headers:         amqp.Table(msg.Headers),
+		DeliveryMode:    amqp.Transient,
+		Body:            msg.Body,
+	})
+}
+
+func (t *amqpTransport) receive(queue string, timeout time.Duration) (*message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case delivery, ok := <-t.deliveries[queue]:
+		if !ok {
+			return nil, amqp.ErrClosed
+		}
+		return &message{Body: delivery.Body, Headers: delivery.Headers}, nil
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+func (t *amqpTransport) close() error {
+	t.channel.Close()
+	return t.connection.Close()
+}
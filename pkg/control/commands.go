@@ -0,0 +1,187 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// TaskInfo is a task reported by the inspect commands
+type TaskInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Hostname string `json:"hostname,omitempty"`
+	// Args and Kwargs are the arguments in json since celery 5, or in python repr before
+	Args         json.RawMessage `json:"args,omitempty"`
+	Kwargs       json.RawMessage `json:"kwargs,omitempty"`
+	TimeStart    *float64        `json:"time_start,omitempty"`
+	Acknowledged bool            `json:"acknowledged,omitempty"`
+	WorkerPID    *int            `json:"worker_pid,omitempty"`
+}
+
+// Reply is the reply of the control commands
+type Reply struct {
+	OK    string `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// WorkerStats is the statistics reported by inspect stats
+type WorkerStats struct {
+	PID           int              `json:"pid"`
+	Uptime        float64          `json:"uptime,omitempty"`
+	PrefetchCount int              `json:"prefetch_count,omitempty"`
+	Pool          PoolStats        `json:"pool"`
+	Total         map[string]int64 `json:"total,omitempty"`
+}
+
+// PoolStats is the statistics of the execution pool of a worker
+type PoolStats struct {
+	MaxConcurrency int `json:"max-concurrency"`
+	// Processes are the pids of the child processes of the prefork pool
+	Processes []int `json:"processes,omitempty"`
+}
+
+// GetConcurrency returns the number of processes in the pool
+func (ps *PoolStats) GetConcurrency() int {
+	if len(ps.Processes) > 0 {
+		return len(ps.Processes)
+	}
+	return ps.MaxConcurrency
+}
+
+// Ping checks which workers are alive
+func (c *Client) Ping(destination ...string) (map[string]Reply, error) {
+	return c.control("ping", nil, destination)
+}
+
+// Active returns the tasks being executed by each worker
+func (c *Client) Active(destination ...string) (map[string][]TaskInfo, error) {
+	return c.inspectTasks("active", destination)
+}
+
+// Reserved returns the tasks prefetched by each worker, which are waiting to be executed
+func (c *Client) Reserved(destination ...string) (map[string][]TaskInfo, error) {
+	return c.inspectTasks("reserved", destination)
+}
+
+// Registered returns the names of the tasks registered in each worker
+func (c *Client) Registered(destination ...string) (map[string][]string, error) {
+	replies, err := c.Broadcast("registered", nil, destination)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make(map[string][]string, len(replies))
+	for worker, reply := range replies {
+		var names []string
+		if err := json.Unmarshal(reply, &names); err != nil {
+			return nil, fmt.Errorf("invalid reply of registered from %s: %v", worker, err)
+		}
+		tasks[worker] = names
+	}
+	return tasks, nil
+}
+
+// Stats returns the statistics of each worker
+func (c *Client) Stats(destination ...string) (map[string]WorkerStats, error) {
+	replies, err := c.Broadcast("stats", nil, destination)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]WorkerStats, len(replies))
+	for worker, reply := range replies {
+		workerStats := WorkerStats{}
+		if err := json.Unmarshal(reply, &workerStats); err != nil {
+			return nil, fmt.Errorf("invalid reply of stats from %s: %v", worker, err)
+		}
+		stats[worker] = workerStats
+	}
+	return stats, nil
+}
+
+// CancelConsumer stops the workers from consuming the queue
+func (c *Client) CancelConsumer(queue string, destination ...string) (map[string]Reply, error) {
+	return c.control("cancel_consumer", map[string]interface{}{"queue": queue}, destination)
+}
+
+// AddConsumer starts the workers consuming the queue
+func (c *Client) AddConsumer(queue string, destination ...string) (map[string]Reply, error) {
+	return c.control("add_consumer", map[string]interface{}{"queue": queue}, destination)
+}
+
+// RateLimit changes the rate limit of the task, e.g. 10/m. An empty rate limit removes it
+func (c *Client) RateLimit(taskName string, rateLimit string, destination ...string) (map[string]Reply, error) {
+	return c.control("rate_limit", map[string]interface{}{
+		"task_name":  taskName,
+		"rate_limit": rateLimit,
+	}, destination)
+}
+
+// PoolGrow adds the processes to the execution pool of the workers
+func (c *Client) PoolGrow(n int, destination ...string) (map[string]Reply, error) {
+	return c.control("pool_grow", map[string]interface{}{"n": n}, destination)
+}
+
+// PoolShrink removes the processes from the execution pool of the workers
+func (c *Client) PoolShrink(n int, destination ...string) (map[string]Reply, error) {
+	return c.control("pool_shrink", map[string]interface{}{"n": n}, destination)
+}
+
+// Revoke stops the workers from executing the task. The running task is killed with the signal,
+// e.g. SIGTERM, if terminate is set
+func (c *Client) Revoke(taskID string, terminate bool, signal string, destination ...string) (map[string]Reply, error) {
+	arguments := map[string]interface{}{
+		"task_id":   taskID,
+		"terminate": terminate,
+	}
+	if signal != "" {
+		arguments["signal"] = signal
+	}
+	return c.control("revoke", arguments, destination)
+}
+
+func (c *Client) inspectTasks(method string, destination []string) (map[string][]TaskInfo, error) {
+	replies, err := c.Broadcast(method, nil, destination)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make(map[string][]TaskInfo, len(replies))
+	for worker, reply := range replies {
+		var workerTasks []TaskInfo
+		if err := json.Unmarshal(reply, &workerTasks); err != nil {
+			return nil, fmt.Errorf("invalid reply of %s from %s: %v", method, worker, err)
+		}
+		tasks[worker] = workerTasks
+	}
+	return tasks, nil
+}
+
+func (c *Client) control(method string, arguments map[string]interface{}, destination []string) (map[string]Reply, error) {
+	replies, err := c.Broadcast(method, arguments, destination)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]Reply, len(replies))
+	for worker, reply := range replies {
+		result := Reply{}
+		if err := json.Unmarshal(reply, &result); err != nil {
+			return nil, fmt.Errorf("invalid reply of %s from %s: %v", method, worker, err)
+		}
+		results[worker] = result
+	}
+	return results, nil
+}
@@ -0,0 +1,175 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package control implements the remote control of celery workers, which is
+// broadcast through the pidbox exchanges of the broker like `celery inspect` and `celery control`
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	// Exchange is the fanout exchange the workers receive the commands from
+	Exchange = "celery.pidbox"
+	// ReplyExchange is the direct exchange the workers send the replies to
+	ReplyExchange = "reply.celery.pidbox"
+)
+
+// DefaultTimeout defines how long the replies are waited for
+const DefaultTimeout time.Duration = 1 * time.Second
+
+// message is a message in the broker with the decoded body
+type message struct {
+	Body    []byte
+	Headers map[string]interface{}
+}
+
+// transport sends the commands and receives the replies through a broker
+type transport interface {
+	// declareReplyQueue creates the queue receiving the replies sent with the routing key
+	declareReplyQueue(queue string, routingKey string) error
+	// deleteReplyQueue removes the reply queue and its binding
+	deleteReplyQueue(queue string, routingKey string) error
+	// publish sends the message to the exchange
+	publish(exchange string, routingKey string, msg *message) error
+	// receive returns the next message of the queue, or nil if there is none before the timeout
+	receive(queue string, timeout time.Duration) (*message, error)
+	close() error
+}
+
+// Client broadcasts the remote control commands to the workers and collects their replies
+type Client struct {
+	transport transport
+	// Timeout defines how long the replies are waited for
+	Timeout time.Duration
+}
+
+// NewClient connects to the broker of the workers.
+// The transport options are the broker_transport_options of celery, e.g. master_name for sentinel.
+func NewClient(address string, transportOptions map[string]string) (*Client, error) {
+	// Sentinel addresses are separated by semicolons
+	brokerURL, err := url.Parse(strings.Split(address, ";")[0])
+	if err != nil {
+		return nil, err
+	}
+	var t transport
+	switch brokerURL.Scheme {
+	case "redis", "rediss", "sentinel":
+		t, err = newRedisTransport(address, transportOptions)
+	case "amqp", "amqps", "pyamqp", "librabbitmq":
+		t, err = newAMQPTransport(address)
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", brokerURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{transport: t, Timeout: DefaultTimeout}, nil
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+// command is the body of the message handled by the pidbox of workers
+type command struct {
+	Method    string                 `json:"method"`
+	Arguments map[string]interface{} `json:"arguments"`
+	// Destination is null if the command is sent to all workers
+	Destination []string          `json:"destination"`
+	Pattern     *string           `json:"pattern"`
+	Matcher     *string           `json:"matcher"`
+	ReplyTo     map[string]string `json:"reply_to"`
+	Ticket      string            `json:"ticket"`
+}
+
+// Broadcast sends the command to the workers, e.g. celery@worker-abcde, and returns the replies by their names.
+// It returns when all the destinations have replied or the timeout is reached, and it always waits
+// for the timeout if the command is sent to all workers. The workers not replying are missing in the result.
+func (c *Client) Broadcast(method string, arguments map[string]interface{}, destination []string) (map[string]json.RawMessage, error) {
+	ticket := string(uuid.NewUUID())
+	replyQueue := ticket + "." + ReplyExchange
+	if err := c.transport.declareReplyQueue(replyQueue, ticket); err != nil {
+		return nil, err
+	}
+	defer c.transport.deleteReplyQueue(replyQueue, ticket)
+
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	if len(destination) == 0 {
+		destination = nil
+	}
+	body, err := json.Marshal(&command{
+		Method:      method,
+		Arguments:   arguments,
+		Destination: destination,
+		ReplyTo: map[string]string{
+			"exchange":    ReplyExchange,
+			"routing_key": ticket,
+		},
+		Ticket: ticket,
+	})
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.Timeout)
+	err = c.transport.publish(Exchange, "", &message{
+		Body: body,
+		Headers: map[string]interface{}{
+			"clock":   int64(0),
+			"expires": float64(deadline.UnixNano()) / float64(time.Second),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replies := map[string]json.RawMessage{}
+	for destination == nil || len(replies) < len(destination) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		msg, err := c.transport.receive(replyQueue, remaining)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			break
+		}
+		// The replies of the other commands sharing the queue are dropped
+		if msg.Headers["ticket"] != nil && msg.Headers["ticket"] != ticket {
+			continue
+		}
+		reply := map[string]json.RawMessage{}
+		if err := json.Unmarshal(msg.Body, &reply); err != nil {
+			return nil, fmt.Errorf("invalid reply of %s: %v", method, err)
+		}
+		for worker, value := range reply {
+			replies[worker] = value
+		}
+	}
+	return replies, nil
+}
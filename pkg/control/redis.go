@@ -0,0 +1,139 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package control
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/RyanSiu1995/celery-operator/pkg/broker"
+)
+
+// Kombu keeps the bindings of an exchange in a set. Each member is the routing key,
+// pattern and queue joined by the separator.
+const (
+	redisBindingPrefix = "_kombu.binding."
+	redisSeparator     = "\x06\x16"
+)
+
+// redisMessage is the envelope of the messages serialized by the redis transport of kombu
+type redisMessage struct {
+	Body            string                 `json:"body"`
+	ContentEncoding string                 `json:"content-encoding"`
+	ContentType     string                 `json:"content-type"`
+	Headers         map[string]interface{} `json:"headers"`
+	Properties      redisProperties        `json:"properties"`
+}
+
+type redisProperties struct {
+	BodyEncoding string            `json:"body_encoding"`
+	DeliveryTag  string            `json:"delivery_tag"`
+	DeliveryInfo map[string]string `json:"delivery_info"`
+	DeliveryMode int               `json:"delivery_mode"`
+	Priority     int               `json:"priority"`
+}
+
+// redisTransport emulates the exchanges like kombu does.
+// The fanout exchanges are channels of pub/sub and the queues are lists.
+type redisTransport struct {
+	client *redis.Client
+}
+
+func newRedisTransport(address string, transportOptions map[string]string) (*redisTransport, error) {
+	client, err := broker.NewRedisClient(address, transportOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &redisTransport{client: client}, nil
+}
+
+// fanoutChannel returns the channel of the fanout exchange, which is prefixed with the database by kombu 4 and above
+func (t *redisTransport) fanoutChannel(exchange string) string {
+	return fmt.Sprintf("/%d.%s", t.client.Options().DB, exchange)
+}
+
+func (t *redisTransport) bindingMember(routingKey string, queue string) string {
+	return routingKey + redisSeparator + redisSeparator + queue
+}
+
+func (t *redisTransport) declareReplyQueue(queue string, routingKey string) error {
+	return t.client.SAdd(redisBindingPrefix+ReplyExchange, t.bindingMember(routingKey, queue)).Err()
+}
+
+func (t *redisTransport) deleteReplyQueue(queue string, routingKey string) error {
+	pipeline := t.client.TxPipeline()
+	pipeline.SRem(redisBindingPrefix+ReplyExchange, t.bindingMember(routingKey, queue))
+	pipeline.Del(queue)
+	_, err := pipeline.Exec()
+	return err
+}
+
+func (t *redisTransport) publish(exchange string, routingKey string, msg *message) error {
+	data, err := json.Marshal(&redisMessage{
+		Body:            base64.StdEncoding.EncodeToString(msg.Body),
+		ContentEncoding: "utf-8",
+		ContentType:     "application/json",
+		Headers:         msg.Headers,
+		Properties: redisProperties{
+			BodyEncoding: "base64",
+			DeliveryTag:  string(uuid.NewUUID()),
+			DeliveryInfo: map[string]string{
+				"exchange":    exchange,
+				"routing_key": routingKey,
+			},
+			DeliveryMode: 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return t.client.Publish(t.fanoutChannel(exchange), data).Err()
+}
+
+func (t *redisTransport) receive(queue string, timeout time.Duration) (*message, error) {
+	// The timeout of BRPOP is counted in seconds
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	result, err := t.client.BRPop(timeout.Round(time.Second), queue).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	envelope := &redisMessage{}
+	if err := json.Unmarshal([]byte(result[1]), envelope); err != nil {
+		return nil, err
+	}
+	body := []byte(envelope.Body)
+	if envelope.Properties.BodyEncoding == "base64" {
+		if body, err = base64.StdEncoding.DecodeString(envelope.Body); err != nil {
+			return nil, err
+		}
+	}
+	return &message{Body: body, Headers: envelope.Headers}, nil
+}
+
+func (t *redisTransport) close() error {
+	return t.client.Close()
+}
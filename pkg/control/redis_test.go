@@ -0,0 +1,222 @@
+package control
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+// fakeWorker emulates the pidbox of a celery worker on the redis transport of kombu
+type fakeWorker struct {
+	name   string
+	handle func(method string, arguments map[string]interface{}) interface{}
+
+	mutex     sync.Mutex
+	arguments map[string]map[string]interface{}
+}
+
+func (w *fakeWorker) dispatch(method string, arguments map[string]interface{}) interface{} {
+	w.mutex.Lock()
+	w.arguments[method] = arguments
+	w.mutex.Unlock()
+	return w.handle(method, arguments)
+}
+
+func (w *fakeWorker) getArguments(method string) map[string]interface{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.arguments[method]
+}
+
+func newFakeWorker(name string) *fakeWorker {
+	return &fakeWorker{
+		name:      name,
+		arguments: map[string]map[string]interface{}{},
+		handle: func(method string, arguments map[string]interface{}) interface{} {
+			switch method {
+			case "active", "reserved", "registered":
+				return []interface{}{}
+			case "ping":
+				return map[string]string{"ok": "pong"}
+			default:
+				return map[string]string{"ok": method + " done"}
+			}
+		},
+	}
+}
+
+// startFakeWorkers subscribes the workers to the pidbox exchange and replies to the commands like kombu does
+func startFakeWorkers(t *testing.T, server *miniredis.Miniredis, workers ...*fakeWorker) func() {
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	pubsub := client.PSubscribe("/0." + Exchange)
+	if _, err := pubsub.Receive(); err != nil {
+		t.Fatalf("failed to subscribe the pidbox: %v", err)
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			envelope := &redisMessage{}
+			if err := json.Unmarshal([]byte(msg.Payload), envelope); err != nil {
+				t.Errorf("invalid message %q: %v", msg.Payload, err)
+				continue
+			}
+			body, _ := base64.StdEncoding.DecodeString(envelope.Body)
+			cmd := &command{}
+			if err := json.Unmarshal(body, cmd); err != nil {
+				t.Errorf("invalid command %q: %v", body, err)
+				continue
+			}
+			for _, worker := range workers {
+				if cmd.Destination != nil && !contains(cmd.Destination, worker.name) {
+					continue
+				}
+				reply, _ := json.Marshal(map[string]interface{}{worker.name: worker.dispatch(cmd.Method, cmd.Arguments)})
+				replyEnvelope, _ := json.Marshal(&redisMessage{
+					Body:       base64.StdEncoding.EncodeToString(reply),
+					Headers:    map[string]interface{}{"ticket": cmd.Ticket},
+					Properties: redisProperties{BodyEncoding: "base64"},
+				})
+				// Route the reply through the bindings of the direct exchange
+				bindings, _ := client.SMembers(redisBindingPrefix + cmd.ReplyTo["exchange"]).Result()
+				for _, binding := range bindings {
+					parts := strings.Split(binding, redisSeparator)
+					if parts[0] == cmd.ReplyTo["routing_key"] {
+						client.LPush(parts[2], replyEnvelope)
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		pubsub.Close()
+		client.Close()
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, value := range items {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestClient(t *testing.T, server *miniredis.Miniredis) *Client {
+	client, err := NewClient("redis://"+server.Addr(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.Timeout = 500 * time.Millisecond
+	return client
+}
+
+func TestBroadcastToDestination(t *testing.T) {
+	server := miniredis.NewMiniRedis()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	stop := startFakeWorkers(t, server, newFakeWorker("celery@a"), newFakeWorker("celery@b"))
+	defer stop()
+	client := newTestClient(t, server)
+	defer client.Close()
+
+	replies, err := client.CancelConsumer("high", "celery@a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(replies, map[string]Reply{"celery@a": {OK: "cancel_consumer done"}}) {
+		t.Errorf("expected the reply of celery@a only, got %v", replies)
+	}
+
+	tasks, err := client.Active()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Errorf("expected the replies of all workers, got %v", tasks)
+	}
+
+	// The reply queues are removed with their bindings
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("expected no key left, got %v", keys)
+	}
+}
+
+func TestBroadcastWithoutReply(t *testing.T) {
+	server := miniredis.NewMiniRedis()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	stop := startFakeWorkers(t, server, newFakeWorker("celery@a"))
+	defer stop()
+	client := newTestClient(t, server)
+	defer client.Close()
+
+	tasks, err := client.Active("celery@a", "celery@missing")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := tasks["celery@missing"]; ok || len(tasks) != 1 {
+		t.Errorf("expected the reply of celery@a only, got %v", tasks)
+	}
+}
+
+func TestDrainCommands(t *testing.T) {
+	server := miniredis.NewMiniRedis()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	worker := newFakeWorker("celery@a")
+	worker.handle = func(method string, arguments map[string]interface{}) interface{} {
+		switch method {
+		case "active":
+			return []map[string]interface{}{
+				{"id": "1", "name": "app.add", "args": []int{1, 2}, "time_start": 1600000000.5, "acknowledged": true, "worker_pid": 10},
+			}
+		case "reserved":
+			return []map[string]interface{}{
+				{"id": "2", "name": "app.add", "args": "(1, 2)"},
+			}
+		}
+		return map[string]string{"ok": method + " done"}
+	}
+	stop := startFakeWorkers(t, server, worker)
+	defer stop()
+	client := newTestClient(t, server)
+	defer client.Close()
+
+	replies, err := client.CancelConsumer("high", "celery@a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if replies["celery@a"].OK != "cancel_consumer done" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if arguments := worker.getArguments("cancel_consumer"); !reflect.DeepEqual(arguments, map[string]interface{}{"queue": "high"}) {
+		t.Errorf("expected the queue to be cancelled, got %v", arguments)
+	}
+	active, err := client.Active("celery@a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if tasks := active["celery@a"]; len(tasks) != 1 || tasks[0].ID != "1" || !tasks[0].Acknowledged || *tasks[0].WorkerPID != 10 {
+		t.Errorf("unexpected active tasks %v", active)
+	}
+	reserved, err := client.Reserved("celery@a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if tasks := reserved["celery@a"]; len(tasks) != 1 || string(tasks[0].Args) != `"(1, 2)"` {
+		t.Errorf("unexpected reserved tasks %v", reserved)
+	}
+}